@@ -0,0 +1,149 @@
+package irc
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"sync"
+)
+
+// scramIterations is the PBKDF2 iteration count used for newly stored SCRAM credentials
+const scramIterations = 4096
+
+// AccountStore is an interface for verifying the credentials of user accounts used for SASL authentication.
+// Its methods are called from the goroutines verifying SASL responses, possibly for several clients at once
+type AccountStore interface {
+	// CheckPassword returns if the password is correct for the account
+	CheckPassword(account string, password string) bool
+	// SCRAMCredentials returns the SCRAM-SHA-256 credentials of the account, if not found ok will be false
+	SCRAMCredentials(account string) (credentials SCRAMCredentials, ok bool)
+	// CertificateAccount returns the account a TLS client certificate fingerprint belongs to, if not found ok will be false
+	CertificateAccount(fingerprint string) (account string, ok bool)
+}
+
+// SCRAMCredentials are the salted credentials stored for SCRAM-SHA-256 authentication - RFC 5802 Section 3
+type SCRAMCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewSCRAMCredentials derives SCRAM-SHA-256 credentials from a password using a random salt
+func NewSCRAMCredentials(password string) (SCRAMCredentials, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return SCRAMCredentials{}, err
+	}
+	return newSCRAMCredentials(password, salt, scramIterations), nil
+}
+
+func newSCRAMCredentials(password string, salt []byte, iterations int) SCRAMCredentials {
+	salted := scramHi([]byte(password), salt, iterations)
+	clientKey := scramHMAC(salted, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	return SCRAMCredentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  scramHMAC(salted, []byte("Server Key")),
+	}
+}
+
+// CheckPassword returns if the password matches the credentials
+func (s SCRAMCredentials) CheckPassword(password string) bool {
+	derived := newSCRAMCredentials(password, s.Salt, s.Iterations)
+	return subtle.ConstantTimeCompare(derived.StoredKey, s.StoredKey) == 1
+}
+
+// scramHMAC is HMAC-SHA-256 as used by SCRAM
+func scramHMAC(key []byte, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// scramHi is the Hi function of RFC 5802 Section 2.2, which is PBKDF2 producing a single block
+func scramHi(password []byte, salt []byte, iterations int) []byte {
+	block := make([]byte, 4)
+	binary.BigEndian.PutUint32(block, 1)
+	u := scramHMAC(password, append(append([]byte{}, salt...), block...))
+	result := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		u = scramHMAC(password, u)
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+// MemoryAccountStore is an AccountStore keeping accounts in memory
+type MemoryAccountStore struct {
+	accounts     map[string]SCRAMCredentials
+	certificates map[string]string
+	mutex        sync.RWMutex
+}
+
+// NewMemoryAccountStore creates and returns a new MemoryAccountStore
+func NewMemoryAccountStore() *MemoryAccountStore {
+	m := MemoryAccountStore{}
+	m.accounts = map[string]SCRAMCredentials{}
+	m.certificates = map[string]string{}
+	return &m
+}
+
+// Add adds or replaces an account with the given password. Only salted credentials are kept
+func (m *MemoryAccountStore) Add(account string, password string) error {
+	credentials, err := NewSCRAMCredentials(password)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.accounts[account] = credentials
+	return nil
+}
+
+// AddCertificate allows the TLS client certificate with the given SHA-256 fingerprint to log in to an account with SASL EXTERNAL
+func (m *MemoryAccountStore) AddCertificate(account string, fingerprint string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.certificates[fingerprint] = account
+}
+
+// Remove removes an account and its certificates
+func (m *MemoryAccountStore) Remove(account string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.accounts, account)
+	for fingerprint, a := range m.certificates {
+		if a == account {
+			delete(m.certificates, fingerprint)
+		}
+	}
+}
+
+// CheckPassword returns if the password is correct for the account
+func (m *MemoryAccountStore) CheckPassword(account string, password string) bool {
+	credentials, ok := m.SCRAMCredentials(account)
+	return ok && credentials.CheckPassword(password)
+}
+
+// SCRAMCredentials returns the SCRAM-SHA-256 credentials of the account
+func (m *MemoryAccountStore) SCRAMCredentials(account string) (credentials SCRAMCredentials, ok bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	credentials, ok = m.accounts[account]
+	return
+}
+
+// CertificateAccount returns the account a TLS client certificate fingerprint belongs to
+func (m *MemoryAccountStore) CertificateAccount(fingerprint string) (account string, ok bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	account, ok = m.certificates[fingerprint]
+	return
+}
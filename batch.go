@@ -0,0 +1,163 @@
+package irc
+
+import (
+	"strconv"
+	"sync/atomic"
+
+	"github.com/sorcix/irc"
+)
+
+// CapBatch is the IRCv3 capability for receiving batches
+const CapBatch = "batch"
+
+// Batch types. Clients handle messages of batch types they don't know as if they were not batched
+const (
+	BatchChatHistory        = "chathistory"
+	BatchChatHistoryTargets = "draft/chathistory-targets"
+	BatchNetsplit           = "netsplit"
+	BatchNetjoin            = "netjoin"
+	BatchNames              = "names"
+	BatchWho                = "who"
+	BatchList               = "list"
+	BatchMultiline          = "draft/multiline"
+)
+
+// batchCounter is used to give each batch a unique reference
+var batchCounter uint64
+
+// newBatchID returns a new unique batch reference
+func newBatchID() string {
+	return strconv.FormatUint(atomic.AddUint64(&batchCounter, 1), 36)
+}
+
+// Batch is a group of messages sent to a client between BATCH +id and BATCH -id - IRCv3 batch specification.
+// For clients that did not enable the batch capability the messages are sent without the BATCH lines
+type Batch struct {
+	ID     string // Reference of the batch, empty if the client doesn't support batches
+	client *Client
+	parent *Batch
+	reply  bool
+}
+
+// StartBatch opens a batch for the replies to the command being handled.
+// Until End is called every message sent to the client with Encode or EncodeWithTags is part of the batch.
+// Batches started while another one is open are nested inside it
+func (c *Client) StartBatch(batchType string, params ...string) *Batch {
+	return c.openBatch(c.Server.Prefix, nil, true, batchType, params...)
+}
+
+// StartRelayBatch opens a batch for messages relayed to the client with Batch.Relay, such as the QUITs of a netsplit.
+// Replies to the client's own commands are not affected by it
+func (c *Client) StartRelayBatch(batchType string, params ...string) *Batch {
+	return c.openBatch(c.Server.Prefix, nil, false, batchType, params...)
+}
+
+// openBatch sends the BATCH +id line with the given prefix and tags and returns the new batch
+func (c *Client) openBatch(prefix *irc.Prefix, tags Tags, reply bool, batchType string, params ...string) *Batch {
+	b := &Batch{client: c, reply: reply}
+	if reply {
+		b.parent = c.batch
+	}
+	if c.HasCap(CapBatch) {
+		b.ID = newBatchID()
+		m := irc.Message{Prefix: prefix, Command: BATCH, Params: append([]string{"+" + b.ID, batchType}, params...)}
+		if reply { // Nested inside the batch that is open, if any
+			c.EncodeWithTags(&m, tags)
+		} else {
+			c.Relay(&m, tags)
+		}
+	}
+	if reply {
+		c.batch = b
+	}
+	return b
+}
+
+// Relay relays a message with tags to the client as part of the batch
+func (b *Batch) Relay(m *irc.Message, tags Tags) error {
+	return b.client.Relay(m, b.tag(tags))
+}
+
+// send sends a message as part of the batch, as a reply or relayed depending on how the batch was opened
+func (b *Batch) send(m *irc.Message, tags Tags) error {
+	if b.reply {
+		return b.client.EncodeWithTags(m, tags)
+	}
+	return b.Relay(m, tags)
+}
+
+// tag returns a copy of tags with the batch tag added
+func (b *Batch) tag(tags Tags) Tags {
+	if len(b.ID) == 0 {
+		return tags
+	}
+	tagged := make(Tags, len(tags)+1)
+	for key, value := range tags {
+		tagged[key] = value
+	}
+	tagged["batch"] = b.ID
+	return tagged
+}
+
+// End closes the batch
+func (b *Batch) End() {
+	if b.reply {
+		b.client.batch = b.parent
+	}
+	if len(b.ID) == 0 {
+		return
+	}
+	m := irc.Message{Prefix: b.client.Server.Prefix, Command: BATCH, Params: []string{"-" + b.ID}}
+	if b.reply {
+		b.client.Encode(&m)
+	} else {
+		b.client.Relay(&m, nil)
+	}
+}
+
+// QuitClients removes clients that left together, such as the users behind a lost server link.
+// Every client sharing a channel with them gets all of the QUITs in a single batch of the given type
+func (s *Server) QuitClients(quitting []*Client, message string, batchType string, params ...string) {
+	recipients := map[*Client][]*irc.Message{}
+	order := []*Client{}
+	for _, q := range quitting {
+		m := &irc.Message{Prefix: q.Prefix, Command: irc.QUIT, Trailing: message}
+		notified := map[*Client]interface{}{}
+		for _, channel := range q.GetChannels() {
+			for _, member := range channel.getMembers() {
+				if _, done := notified[member]; done {
+					continue
+				}
+				notified[member] = nil
+				if _, found := recipients[member]; !found {
+					order = append(order, member)
+				}
+				recipients[member] = append(recipients[member], m)
+			}
+		}
+	}
+	for _, q := range quitting { // Quitting clients don't need to be told about each other
+		delete(recipients, q)
+	}
+
+	for _, recipient := range order {
+		messages, ok := recipients[recipient]
+		if !ok {
+			continue
+		}
+		batch := recipient.StartRelayBatch(batchType, params...)
+		for _, m := range messages {
+			batch.Relay(m, nil)
+		}
+		batch.End()
+	}
+
+	for _, q := range quitting {
+		for _, channel := range q.GetChannels() {
+			channel.RemoveMember(q)
+			q.RemoveChannel(channel)
+		}
+		s.RemoveClientNick(q)
+		s.notifyOffline(q.Nickname)
+	}
+}
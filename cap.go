@@ -0,0 +1,243 @@
+package irc
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sorcix/irc"
+)
+
+// Capability names defined by IRCv3
+const (
+	CapCapNotify       = "cap-notify"
+	CapEchoMessage     = "echo-message"
+	CapAwayNotify      = "away-notify"
+	CapAccountNotify   = "account-notify"
+	CapExtendedJoin    = "extended-join"
+	CapChgHost         = "chghost"
+	CapSetName         = "setname"
+	CapInviteNotify    = "invite-notify"
+	CapMultiPrefix     = "multi-prefix"
+	CapUserhostInNames = "userhost-in-names"
+)
+
+// maxCapLineLength is the longest capability list sent in a single CAP LS or LIST reply
+const maxCapLineLength = 400
+
+// CapabilityRegistry contains the capabilities the server offers to clients
+type CapabilityRegistry struct {
+	caps  map[string]string
+	mutex sync.RWMutex
+}
+
+// NewCapabilityRegistry creates and returns a new CapabilityRegistry
+func NewCapabilityRegistry() *CapabilityRegistry {
+	r := CapabilityRegistry{}
+	r.caps = map[string]string{}
+	return &r
+}
+
+// Add adds a capability with an optional value that is only shown to clients using CAP version 302 or later
+func (r *CapabilityRegistry) Add(name string, value string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.caps[name] = value
+}
+
+// Remove removes a capability
+func (r *CapabilityRegistry) Remove(name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.caps, name)
+}
+
+// Get returns the value of a capability, if not offered ok will be false
+func (r *CapabilityRegistry) Get(name string) (value string, ok bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	value, ok = r.caps[name]
+	return
+}
+
+// List returns the capabilities formatted for CAP LS, including values if withValues is set
+func (r *CapabilityRegistry) List(withValues bool) []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	caps := make([]string, 0, len(r.caps))
+	for name, value := range r.caps {
+		if withValues && len(value) != 0 {
+			name += "=" + value
+		}
+		caps = append(caps, name)
+	}
+	sort.Strings(caps)
+	return caps
+}
+
+// AddCapability offers a new capability to clients, notifying clients that enabled cap-notify.
+// It may be called from any goroutine, the clients are notified by the state goroutine after it returns
+func (s *Server) AddCapability(name string, value string) {
+	s.Capabilities.Add(name, value)
+	s.run(func() {
+		for _, client := range s.getClients() {
+			if !client.HasCap(CapCapNotify) {
+				continue
+			}
+			capability := name
+			if client.capVersion >= 302 && len(value) != 0 {
+				capability += "=" + value
+			}
+			m := irc.Message{Prefix: s.Prefix, Command: CAP, Params: []string{client.capNick(), "NEW"}, Trailing: capability}
+			client.Relay(&m, nil)
+		}
+	})
+}
+
+// RemoveCapability stops offering a capability, disabling it for clients and notifying clients that enabled cap-notify.
+// It may be called from any goroutine, the capability is disabled for clients by the state goroutine after it returns
+func (s *Server) RemoveCapability(name string) {
+	s.Capabilities.Remove(name)
+	s.run(func() {
+		for _, client := range s.getClients() {
+			client.DisableCap(name)
+			if client.HasCap(CapCapNotify) {
+				m := irc.Message{Prefix: s.Prefix, Command: CAP, Params: []string{client.capNick(), "DEL"}, Trailing: name}
+				client.Relay(&m, nil)
+			}
+		}
+	})
+}
+
+// HasCap returns if the client has enabled the given capability
+func (c *Client) HasCap(name string) bool {
+	c.capMutex.RLock()
+	defer c.capMutex.RUnlock()
+	_, found := c.caps[name]
+	return found
+}
+
+// EnableCap enables a capability for the client
+func (c *Client) EnableCap(name string) {
+	c.capMutex.Lock()
+	defer c.capMutex.Unlock()
+	c.caps[name] = nil
+}
+
+// DisableCap disables a capability for the client
+func (c *Client) DisableCap(name string) {
+	c.capMutex.Lock()
+	defer c.capMutex.Unlock()
+	delete(c.caps, name)
+}
+
+// Caps returns the capabilities the client has enabled
+func (c *Client) Caps() []string {
+	c.capMutex.RLock()
+	defer c.capMutex.RUnlock()
+	caps := make([]string, 0, len(c.caps))
+	for name := range c.caps {
+		caps = append(caps, name)
+	}
+	sort.Strings(caps)
+	return caps
+}
+
+// capNick returns the nickname used in CAP messages, which is * before the client has chosen one
+func (c *Client) capNick() string {
+	if len(c.Nickname) == 0 {
+		return "*"
+	}
+	return c.Nickname
+}
+
+// sendCap sends a CAP subcommand to the client, splitting long capability lists over several messages.
+// Only clients using CAP version 302 understand continuation lines, so others get everything in one message
+func (c *Client) sendCap(subcommand string, caps []string, multiline bool) {
+	nick := c.capNick()
+
+	lines := [][]string{}
+	if !multiline || c.capVersion < 302 {
+		lines = append(lines, caps)
+	} else {
+		line := []string{}
+		length := 0
+		for _, capability := range caps {
+			if length+len(capability) > maxCapLineLength && len(line) != 0 {
+				lines = append(lines, line)
+				line, length = []string{}, 0
+			}
+			line = append(line, capability)
+			length += len(capability) + 1
+		}
+		lines = append(lines, line)
+	}
+
+	for i, line := range lines {
+		m := irc.Message{Prefix: c.Server.Prefix, Command: CAP, Params: []string{nick, subcommand}, Trailing: strings.Join(line, " "), EmptyTrailing: len(line) == 0}
+		if i != len(lines)-1 {
+			m.Params = append(m.Params, "*")
+		}
+		c.Encode(&m)
+	}
+}
+
+// CapHandler is a CommandHandler to respond to IRCv3 CAP commands from a client
+// Implemented according to the IRCv3 Capability Negotiation specification, including version 302
+func CapHandler(message *irc.Message, client *Client) {
+	subcommand := strings.ToUpper(message.Params[0])
+	args := message.Trailing
+	if len(message.Params) > 1 {
+		args = message.Params[1]
+	}
+
+	switch subcommand {
+	case "LS":
+		if !client.Registered { // Registration waits until negotiation has ended
+			client.capNegotiating = true
+		}
+		if version, err := strconv.Atoi(args); err == nil && version > client.capVersion {
+			client.capVersion = version
+		}
+		if client.capVersion >= 302 { // CAP 302 implies cap-notify
+			client.EnableCap(CapCapNotify)
+		}
+		client.sendCap("LS", client.Server.Capabilities.List(client.capVersion >= 302), true)
+
+	case "LIST":
+		client.sendCap("LIST", client.Caps(), true)
+
+	case "REQ":
+		if !client.Registered {
+			client.capNegotiating = true
+		}
+		requested := strings.Fields(args)
+		for _, capability := range requested { // Requests are accepted or rejected as a whole
+			_, ok := client.Server.Capabilities.Get(strings.TrimPrefix(capability, "-"))
+			if !ok {
+				client.sendCap("NAK", requested, false)
+				return
+			}
+		}
+		for _, capability := range requested {
+			if strings.HasPrefix(capability, "-") {
+				client.DisableCap(capability[1:])
+			} else {
+				client.EnableCap(capability)
+			}
+		}
+		client.sendCap("ACK", requested, false)
+
+	case "END":
+		if client.Registered || !client.capNegotiating {
+			return
+		}
+		client.capNegotiating = false
+		client.completeRegistration()
+
+	default:
+		m := irc.Message{Prefix: client.Server.Prefix, Command: ERR_INVALIDCAPCMD, Params: []string{client.capNick(), message.Params[0]}, Trailing: "Invalid CAP command"}
+		client.Encode(&m)
+	}
+}
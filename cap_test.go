@@ -0,0 +1,98 @@
+package irc
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/sorcix/irc"
+)
+
+func TestCapabilityRegistry(t *testing.T) {
+	r := NewCapabilityRegistry()
+	r.Add("b", "")
+	r.Add("a", "1,2")
+	if list := strings.Join(r.List(false), " "); list != "a b" {
+		t.Errorf("List(false) = %q", list)
+	}
+	if list := strings.Join(r.List(true), " "); list != "a=1,2 b" {
+		t.Errorf("List(true) = %q", list)
+	}
+	r.Remove("a")
+	if _, ok := r.Get("a"); ok {
+		t.Error("a is still offered after Remove")
+	}
+}
+
+func TestCapNegotiation(t *testing.T) {
+	s := newTestServer(ServerConfig{Name: "irc.test"})
+	c := dialClient(t, s)
+	c.send("CAP LS 302")
+	c.expect("CAP * LS :", CapEchoMessage)
+
+	// registration is held until CAP END, the PONG comes first
+	c.send("NICK alice\r\nUSER user 0 * :alice\r\nPING :held")
+	if m := c.expectCommand(irc.RPL_WELCOME, irc.PONG); m.Command != irc.PONG {
+		t.Fatal("alice was welcomed before CAP END")
+	}
+
+	c.send("CAP REQ :echo-message unknown")
+	c.expect("CAP alice NAK :echo-message unknown")
+	c.send("CAP REQ :echo-message")
+	c.expect("CAP alice ACK :echo-message")
+	c.send("CAP LIST")
+	c.expect("CAP alice LIST :", CapEchoMessage)
+	c.send("CAP FOO")
+	c.expect(" 410 alice FOO ")
+
+	c.send("CAP END")
+	c.expectCommand(irc.RPL_WELCOME)
+	c.expectCommand(irc.RPL_ENDOFMOTD, irc.ERR_NOMOTD)
+	c.send("PRIVMSG alice :echoed")
+	c.expect(":alice!", "PRIVMSG alice :echoed")
+}
+
+func TestCapNotify(t *testing.T) {
+	s := newTestServer(ServerConfig{Name: "irc.test"})
+	c := dialClient(t, s)
+	c.send("CAP LS 302")
+	c.expect("CAP * LS :")
+	c.send("CAP REQ :echo-message")
+	c.expect("CAP * ACK :echo-message")
+	c.send("CAP END")
+	c.register("alice")
+
+	s.AddCapability("example.org/new", "value")
+	c.expect("CAP alice NEW :example.org/new=value")
+	s.RemoveCapability(CapEchoMessage)
+	c.expect("CAP alice DEL :" + CapEchoMessage)
+	waitFor(t, s, "echo-message is disabled", func() bool {
+		client, _ := s.GetClientByNick("alice")
+		return !client.HasCap(CapEchoMessage)
+	})
+}
+
+func TestCapLSContinuation(t *testing.T) {
+	s := newTestServer(ServerConfig{Name: "irc.test"})
+	for i := 0; i < 50; i++ {
+		s.Capabilities.Add("example.org/capability-"+strconv.Itoa(i), "")
+	}
+	c := dialClient(t, s)
+	c.send("CAP LS 302")
+	m := c.expectCommand(CAP)
+	if len(m.Params) != 3 || m.Params[2] != "*" || len(m.Trailing) > maxCapLineLength {
+		t.Fatalf("first CAP LS line is %v", m)
+	}
+	for {
+		m = c.expectCommand(CAP)
+		if len(m.Params) == 2 {
+			break
+		}
+	}
+
+	old := dialClient(t, s) // clients of CAP version 301 get a single line
+	old.send("CAP LS")
+	if m := old.expectCommand(CAP); len(m.Params) != 2 || !strings.Contains(m.Trailing, "example.org/capability-49") {
+		t.Fatalf("CAP LS line is %v", m)
+	}
+}
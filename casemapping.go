@@ -0,0 +1,92 @@
+package irc
+
+import (
+	"golang.org/x/text/secure/precis"
+	"golang.org/x/text/unicode/norm"
+)
+
+// CaseMapping determines which nicknames and channel names are considered equal
+type CaseMapping struct {
+	// Name is advertised to clients as the CASEMAPPING ISUPPORT token
+	Name string
+	// Fold maps a name to the canonical form used for comparisons and lookups
+	Fold func(string) string
+}
+
+var (
+	// CaseMappingASCII only treats the letters A-Z and a-z as equivalent
+	CaseMappingASCII = CaseMapping{Name: "ascii", Fold: foldASCII}
+	// CaseMappingRFC1459 additionally treats []\^ as the upper case forms of {}|~ - RFC 1459 Section 2.2
+	CaseMappingRFC1459 = CaseMapping{Name: "rfc1459", Fold: foldRFC1459}
+	// CaseMappingStrictRFC1459 treats []\ as the upper case forms of {}|
+	CaseMappingStrictRFC1459 = CaseMapping{Name: "strict-rfc1459", Fold: foldStrictRFC1459}
+	// CaseMappingPRECIS allows UTF-8 names, compared using the PRECIS UsernameCaseMapped profile of RFC 7613
+	CaseMappingPRECIS = CaseMapping{Name: "rfc7613", Fold: foldPRECIS}
+)
+
+// CaseMappings contains the supported CaseMappings by name
+var CaseMappings = map[string]CaseMapping{
+	CaseMappingASCII.Name:         CaseMappingASCII,
+	CaseMappingRFC1459.Name:       CaseMappingRFC1459,
+	CaseMappingStrictRFC1459.Name: CaseMappingStrictRFC1459,
+	CaseMappingPRECIS.Name:        CaseMappingPRECIS,
+}
+
+// foldBytes lower cases s using the given byte mapping, only allocating if a byte changes
+func foldBytes(s string, lower func(byte) byte) string {
+	for i := 0; i < len(s); i++ {
+		if lower(s[i]) == s[i] {
+			continue
+		}
+		b := []byte(s)
+		for j := i; j < len(b); j++ {
+			b[j] = lower(b[j])
+		}
+		return string(b)
+	}
+	return s
+}
+
+func lowerASCII(b byte) byte {
+	if 'A' <= b && b <= 'Z' {
+		return b + ('a' - 'A')
+	}
+	return b
+}
+
+func lowerStrictRFC1459(b byte) byte {
+	if '[' <= b && b <= ']' { // [\] map to {|}
+		return b + ('{' - '[')
+	}
+	return lowerASCII(b)
+}
+
+func lowerRFC1459(b byte) byte {
+	if b == '^' {
+		return '~'
+	}
+	return lowerStrictRFC1459(b)
+}
+
+func foldASCII(s string) string {
+	return foldBytes(s, lowerASCII)
+}
+
+func foldStrictRFC1459(s string) string {
+	return foldBytes(s, lowerStrictRFC1459)
+}
+
+func foldRFC1459(s string) string {
+	return foldBytes(s, lowerRFC1459)
+}
+
+// precisProfile is the UsernameCaseMapped profile without the Bidi Rule, which would reject channel names starting with '#'
+var precisProfile = precis.NewIdentifier(precis.FoldWidth, precis.LowerCase(), precis.Norm(norm.NFC))
+
+func foldPRECIS(s string) string {
+	folded, err := precisProfile.CompareKey(s)
+	if err != nil { // Not a valid PRECIS identifier, fall back to comparing it as ASCII
+		return foldASCII(s)
+	}
+	return folded
+}
@@ -0,0 +1,44 @@
+package irc
+
+import "testing"
+
+func TestCaseMappings(t *testing.T) {
+	tests := []struct {
+		mapping CaseMapping
+		a, b    string
+		equal   bool
+	}{
+		{CaseMappingASCII, "Nick", "nICK", true},
+		{CaseMappingASCII, "Nick[]", "nick{}", false},
+		{CaseMappingStrictRFC1459, `Nick[]\`, "nick{}|", true},
+		{CaseMappingStrictRFC1459, "nick^", "nick~", false},
+		{CaseMappingRFC1459, `Nick[]\^`, "nick{}|~", true},
+		{CaseMappingPRECIS, "Ünïcode", "ünïcode", true},
+		{CaseMappingPRECIS, "#Chan", "#chan", true},
+		{CaseMappingPRECIS, "ＷＩＤＥ", "wide", true},
+		{CaseMappingPRECIS, "Nick[]", "nick{}", false},
+	}
+	for _, test := range tests {
+		if equal := test.mapping.Fold(test.a) == test.mapping.Fold(test.b); equal != test.equal {
+			t.Errorf("%s: %q and %q equal = %v, want %v", test.mapping.Name, test.a, test.b, equal, test.equal)
+		}
+	}
+}
+
+func TestCaseMappingNicknames(t *testing.T) {
+	s := newTestServer(ServerConfig{Name: "irc.test"})
+	connectClient(t, s, "Nick[1]")
+	other := connectClient(t, s, "other")
+	other.send("NICK nick{1}")
+	other.expect(" 433 nick{1} ")
+	other.send("JOIN #Chan[x]")
+	other.expect("JOIN #Chan[x]")
+	other.send("NAMES #chan{x}")
+	other.expect(" 353 other = #Chan[x] ")
+
+	s = newTestServer(ServerConfig{Name: "irc.test", CaseMapping: CaseMappingASCII})
+	connectClient(t, s, "Nick[1]")
+	other = connectClient(t, s, "other")
+	other.send("NICK nick{1}")
+	other.expect(":other!", "NICK :nick{1}")
+}
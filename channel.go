@@ -15,34 +15,55 @@ type Channel struct {
 	Topic string
 	Key   string
 
-	members      map[string]*ChannelModeSet
+	members      map[string]*channelMember // by casefolded nickname
+	memberList   []*Client                 // clients of the members, replaced rather than changed so it can be handed out without copying
+	invited      map[string]interface{}
 	membersMutex sync.RWMutex
 
 	Server *Server
+
+	clusterVersion int // version of the topic and modes shared with the cluster
 }
 
 // NewChannel creates and returns a new Channel
 func NewChannel(s *Server, creator *Client) *Channel {
 	c := &Channel{}
-	c.members = map[string]*ChannelModeSet{}
+	c.members = map[string]*channelMember{}
+	c.invited = map[string]interface{}{}
 	c.Server = s
 	c.ChannelModeSet = NewChannelModeSet()
+	c.ChannelModeSet.maskFold = s.Casefold
 
 	return c
 }
 
+// channelMember is a member of a channel with its member modes
+type channelMember struct {
+	client *Client // nil while a user of another cluster node isn't known yet
+	modes  *ChannelModeSet
+}
+
 // Join handles a client joining the channel and notifies other channel members
 func (c *Channel) Join(client *Client, key string) {
 
 	if c.HasMember(client) { // client is already in this channel
 		return
 	}
+	if c.HasMode(ChannelModeInviteOnly) && !c.IsInvited(client) { // channel is invite only and client wasn't invited
+		m := irc.Message{Prefix: c.Server.Prefix, Command: irc.ERR_INVITEONLYCHAN, Params: []string{client.Nickname, c.Name}, Trailing: "Cannot join channel (+i)"}
+		client.Encode(&m)
+		return
+	}
+	if c.IsBanned(client) {
+		m := irc.Message{Prefix: c.Server.Prefix, Command: irc.ERR_BANNEDFROMCHAN, Params: []string{client.Nickname, c.Name}, Trailing: "Cannot join channel (+b)"}
+		client.Encode(&m)
+		return
+	}
 	if c.HasMode(ChannelModeKey) { //if key is required, verify that client provided matching key
 		if c.Key != key {
 			m := irc.Message{Prefix: c.Server.Prefix, Command: irc.ERR_BADCHANNELKEY, Params: []string{client.Nickname, c.Name}, Trailing: "Cannot join channel (+k)"}
-			err := client.Encode(&m)
-			if err != nil {
-				println(err.Error())
+			if err := client.Encode(&m); err != nil {
+				c.Server.logf("Error sending to %s: %v", client.Nickname, err)
 			}
 			return
 		}
@@ -50,37 +71,79 @@ func (c *Channel) Join(client *Client, key string) {
 	if c.HasMode(ChannelModeLimit) && c.GetMemberCount() >= c.GetLimit() { // Limit flag is set and limit is met
 		m := irc.Message{Prefix: c.Server.Prefix, Command: irc.ERR_CHANNELISFULL, Params: []string{client.Nickname, c.Name}, Trailing: "Cannot join channel (+l)"}
 		client.Encode(&m)
+		return
 	}
 
 	creator := c.GetMemberCount() == 0
 
-	c.AddMember(client)
-	client.AddChannel(c)
-
+	modes := ""
 	if creator { // Client is creating channel
 		// Creator should be a channel operator - Maybe check if it is a "safe" channel
-
-		c.AddMemberMode(client, ChannelModeOperator)
+		modes = string(ChannelModeOperator)
 		if len(key) != 0 {
 			c.SetKey(key)
 
 		}
 	}
+	c.join(client, modes)
+	if creator {
+		c.shareState()
+	}
 
-	var m irc.Message
+	// Linked servers learn about the member modes together with the JOIN - RFC 2813 Section 4.2.1
+	name := c.Name
+	if len(modes) != 0 {
+		name += "\a" + modes
+	}
+	c.Server.propagate(&irc.Message{Prefix: client.Prefix, Command: irc.JOIN, Params: []string{name}}, nil)
 
 	// Send topic if it exists
 	if len(c.Topic) != 0 {
-		m = irc.Message{Prefix: c.Server.Prefix, Command: irc.RPL_TOPIC, Params: []string{c.Name}, Trailing: c.Topic}
+		m := irc.Message{Prefix: c.Server.Prefix, Command: irc.RPL_TOPIC, Params: []string{c.Name}, Trailing: c.Topic}
 		client.Encode(&m)
 	}
 
-	//Notify existing members that new member is joining
-	m = irc.Message{Prefix: client.Prefix, Command: irc.JOIN, Params: []string{c.Name}}
-	c.SendMessage(&m)
-
+	batch := client.StartBatch(BatchNames, c.Name)
 	c.Names(client)
+	batch.End()
+
+}
 
+// join adds a client to the channel with the given member modes and notifies the members
+func (c *Channel) join(client *Client, modes string) {
+	c.AddMember(client)
+	c.RemoveInvite(client)
+	client.AddChannel(c)
+	for _, mode := range modes {
+		c.AddMemberMode(client, ChannelMode(mode))
+	}
+
+	//Notify existing members that new member is joining, with account and real name for members that enabled extended-join
+	m := irc.Message{Prefix: client.Prefix, Command: irc.JOIN, Params: []string{c.Name}}
+	tags := c.Server.stampTags(&m, nil)
+	c.Server.recordHistory(c.Server.Casefold(c.Name), &m, tags)
+	account := client.Account
+	if len(account) == 0 {
+		account = "*"
+	}
+	extended := irc.Message{Prefix: client.Prefix, Command: irc.JOIN, Params: []string{c.Name, account}, Trailing: client.RealName, EmptyTrailing: true}
+	plain, extendedJoin := prepareMessage(&m, tags), prepareMessage(&extended, tags)
+	for _, member := range c.getMembers() {
+		if member.HasCap(CapExtendedJoin) {
+			c.deliverPrepared(member, extendedJoin)
+		} else {
+			c.deliverPrepared(member, plain)
+		}
+	}
+	if client.HasMode(UserModeAway) { // Members that enabled away-notify learn right away that the new member is away
+		away := irc.Message{Prefix: client.Prefix, Command: irc.AWAY, Trailing: client.AwayMessage}
+		prepared := prepareMessage(&away, c.Server.stampTags(&away, nil))
+		for _, member := range c.getMembers() {
+			if member != client && member.HasCap(CapAwayNotify) {
+				member.relayPrepared(prepared)
+			}
+		}
+	}
 }
 
 // Names responds to to IRC NAMES command for the channel
@@ -95,12 +158,6 @@ func (c *Channel) Names(client *Client) []string {
 		return named
 	}
 
-	allMembers := make([]string, len(c.members))
-	i := 0
-	for member := range c.members {
-		allMembers[i] = member
-		i++
-	}
 	// send list of users in channel
 
 	//channelPrefix := ""
@@ -113,37 +170,50 @@ func (c *Channel) Names(client *Client) []string {
 		channelPrefix = "*"
 	}
 
-	for i := 0; i < (len(c.members)/20)+1; i++ {
-		memberStr := ""
-		end := (i + 1) * 20
-		if end > len(c.members) {
-			end = len(c.members)
+	multiPrefix := client.HasCap(CapMultiPrefix)
+	userhost := client.HasCap(CapUserhostInNames)
+	empty := irc.Message{Prefix: c.Server.Prefix, Command: irc.RPL_NAMREPLY, Params: []string{client.Nickname, channelPrefix, c.Name}}
+	maxLength := maxLineLength - 2 - len(empty.Bytes()) - 2
+
+	// Send as many names per message as fit in a line, names with their user and host take up more room
+	memberStr := ""
+	for _, mClient := range c.getMembers() {
+		if mClient.HasMode(UserModeInvisible) && !isMember { //the requesting client shouldn't know about this client
+			continue
 		}
 
-		for _, member := range allMembers[i*20 : end] {
-			mClient, _ := client.Server.GetClientByNick(member)
-			if mClient.HasMode(UserModeInvisible) && !isMember { //the requesting client shouldn't know about this client
-				continue
-			}
+		name := c.memberPrefixes(mClient, multiPrefix)
+		if userhost && mClient.Prefix != nil {
+			name += mClient.Prefix.String()
+		} else {
+			name += mClient.Nickname
+		}
+		if len(memberStr) != 0 && len(memberStr)+len(name) > maxLength {
+			m := irc.Message{Prefix: c.Server.Prefix, Command: irc.RPL_NAMREPLY, Params: []string{client.Nickname, channelPrefix, c.Name}, Trailing: memberStr}
+			client.Encode(&m)
+			memberStr = ""
+		}
+		memberStr += name + " "
+		named = append(named, mClient.Nickname)
+	}
+	m := irc.Message{Prefix: c.Server.Prefix, Command: irc.RPL_NAMREPLY, Params: []string{client.Nickname, channelPrefix, c.Name}, Trailing: memberStr}
+	client.Encode(&m)
 
-			if mClient != nil {
-				if c.MemberHasMode(mClient, ChannelModeOperator) {
-					memberStr += "@"
-				} else if c.MemberHasMode(mClient, ChannelModeVoice) {
-					memberStr += "+"
-				}
-				memberStr += mClient.Nickname + " "
-				named = append(named, mClient.Nickname)
+	return named
+}
 
+// memberPrefixes returns the prefix of the highest member mode of a member, or of all its member modes if all is set
+func (c *Channel) memberPrefixes(client *Client, all bool) string {
+	prefixes := ""
+	for _, p := range ChannelMemberPrefixes {
+		if c.MemberHasMode(client, p.ChannelMode) {
+			prefixes += string(p.Prefix)
+			if !all {
+				break
 			}
-
 		}
-		m := irc.Message{Prefix: c.Server.Prefix, Command: irc.RPL_NAMREPLY, Params: []string{client.Nickname, channelPrefix, c.Name}, Trailing: memberStr}
-		client.Encode(&m)
-
 	}
-
-	return named
+	return prefixes
 }
 
 // Part handles when a client leaves a channel
@@ -161,6 +231,7 @@ func (c *Channel) Part(client *Client, message string) {
 	}
 
 	c.SendMessage(&m)
+	c.Server.propagate(&m, client.route())
 
 	c.RemoveMember(client)
 	client.RemoveChannel(c)
@@ -182,63 +253,151 @@ func (c *Channel) Quit(client *Client, message string) {
 	c.SendMessage(&m)
 
 	c.RemoveMember(client)
+	client.RemoveChannel(c)
+}
+
+// CanSend returns if a client is allowed to send messages to the channel
+func (c *Channel) CanSend(client *Client) bool {
+	isMember := c.HasMember(client)
+	if c.HasMode(ChannelModeNoOutsideMessages) && !isMember { // +n channels only accept messages from members
+		return false
+	}
+	if c.MemberHasMode(client, ChannelModeOperator) || c.MemberHasMode(client, ChannelModeVoice) { // ops and voiced members can always speak
+		return true
+	}
+	if c.HasMode(ChannelModeModerated) { // +m channels only allow ops and voiced members to speak
+		return false
+	}
+	if isMember && c.IsBanned(client) { // banned members can't speak
+		return false
+	}
+	return true
 }
 
 // Message is when a Private Message is directed for this channel - forward the message to each member
 func (c *Channel) Message(client *Client, message string) {
+	c.MessageWithTags(client, message, nil)
+}
+
+// MessageWithTags forwards a Private Message with client-only tags to each member
+func (c *Channel) MessageWithTags(client *Client, message string, tags Tags) {
 	m := irc.Message{Prefix: client.Prefix, Command: irc.PRIVMSG, Params: []string{c.Name}, Trailing: message}
 
-	c.SendMessageToOthers(&m, client)
+	tags = c.Server.stampTags(&m, tags)
+	c.SendMessageToOthersWithTags(&m, client, tags)
+	c.Server.propagate(&m, client.route())
+	if client.HasCap(CapEchoMessage) {
+		client.deliver(&m, tags, true)
+	}
 }
 
 // Notice is when a Notice is directed for this channel - forward the notice to each member
 func (c *Channel) Notice(client *Client, message string) {
+	c.NoticeWithTags(client, message, nil)
+}
+
+// NoticeWithTags forwards a Notice with client-only tags to each member
+func (c *Channel) NoticeWithTags(client *Client, message string, tags Tags) {
 	m := irc.Message{Prefix: client.Prefix, Command: irc.NOTICE, Params: []string{c.Name}, Trailing: message}
 
-	c.SendMessageToOthers(&m, client)
+	tags = c.Server.stampTags(&m, tags)
+	c.SendMessageToOthersWithTags(&m, client, tags)
+	c.Server.propagate(&m, client.route())
+	if client.HasCap(CapEchoMessage) {
+		client.deliver(&m, tags, true)
+	}
+}
+
+// TagMsg forwards client-only tags to each member that supports message tags
+func (c *Channel) TagMsg(client *Client, tags Tags) {
+	m := irc.Message{Prefix: client.Prefix, Command: TAGMSG, Params: []string{c.Name}}
+	tags = c.Server.stampTags(&m, tags)
+	c.sendToMembers(&m, tags, client)
+	if client.HasCap(CapEchoMessage) && client.HasCap(CapMessageTags) {
+		client.EncodeWithTags(&m, tags)
+	}
 }
 
 // SendMessage allows sending an IRC message to all channel members
 func (c *Channel) SendMessage(m *irc.Message) {
-	for member := range c.members {
-		mClient, _ := c.Server.GetClientByNick(member)
-		if mClient != nil {
-			mClient.Encode(m)
-		}
+	c.SendMessageWithTags(m, nil)
+}
 
-	}
+// SendMessageWithTags allows sending an IRC message with tags to all channel members, including those on other cluster nodes.
+// The time, msgid and account tags are added for members that enabled them and the message is recorded in the history
+func (c *Channel) SendMessageWithTags(m *irc.Message, tags Tags) {
+	tags = c.Server.stampTags(m, tags)
+	c.Server.recordHistory(c.Server.Casefold(c.Name), m, tags)
+	c.sendToMembers(m, tags, nil)
 }
 
 // SendMessageToOthers allows sending an IRC message to all other channel members
 func (c *Channel) SendMessageToOthers(m *irc.Message, client *Client) {
-	for member := range c.members {
-		if member == client.Nickname {
-			continue
-		}
-		mClient, _ := c.Server.GetClientByNick(member)
+	c.SendMessageToOthersWithTags(m, client, nil)
+}
+
+// SendMessageToOthersWithTags allows sending an IRC message with tags to all other channel members.
+// The time, msgid and account tags are added for members that enabled them and the message is recorded in the history
+func (c *Channel) SendMessageToOthersWithTags(m *irc.Message, client *Client, tags Tags) {
+	tags = c.Server.stampTags(m, tags)
+	c.Server.recordHistory(c.Server.Casefold(c.Name), m, tags)
+	c.sendToMembers(m, tags, client)
+}
 
-		if mClient != nil {
-			mClient.Encode(m)
+// deliverPrepared sends a prepared message to a member, as a reply if the member caused the message and relayed otherwise
+func (c *Channel) deliverPrepared(member *Client, p *preparedMessage) {
+	if member.Prefix == p.message.Prefix {
+		member.deliver(p.message, p.tags, true)
+		return
+	}
+	member.relayPrepared(p)
+}
+
+// getMembers returns the clients that are members of the channel.
+// The slice is shared and must not be changed, it takes no lock other than the channel's own
+func (c *Channel) getMembers() []*Client {
+	c.membersMutex.RLock()
+	defer c.membersMutex.RUnlock()
+	return c.memberList
+}
+
+// listMembers rebuilds the list of the clients of the members. Callers hold membersMutex
+func (c *Channel) listMembers() {
+	list := make([]*Client, 0, len(c.members))
+	for _, member := range c.members {
+		if member.client != nil {
+			list = append(list, member.client)
 		}
 	}
+	c.memberList = list
 }
 
 // AddMember adds a member to the channel
 func (c *Channel) AddMember(client *Client) {
 	c.membersMutex.Lock()
 	defer c.membersMutex.Unlock()
-	_, ok := c.members[client.Nickname]
+	_, ok := c.members[c.memberKey(client)]
 	if ok { // client is already a member
 		return
 	}
-	c.members[client.Nickname] = NewChannelModeSet()
+	c.members[c.memberKey(client)] = &channelMember{client: client, modes: NewChannelModeSet()}
+	c.memberList = append(c.memberList[:len(c.memberList):len(c.memberList)], client) // copied, earlier lists may still be in use
+	c.shareMember(c.memberKey(client))
 }
 
 // RemoveMember removes a member from the channel
 func (c *Channel) RemoveMember(client *Client) {
 	c.membersMutex.Lock()
 	defer c.membersMutex.Unlock()
-	delete(c.members, client.Nickname)
+	delete(c.members, c.memberKey(client))
+	list := make([]*Client, 0, len(c.memberList))
+	for _, member := range c.memberList {
+		if member != client {
+			list = append(list, member)
+		}
+	}
+	c.memberList = list
+	c.shareMember(c.memberKey(client))
 	if len(c.members) == 0 { // NO more members
 		c.delete()
 	}
@@ -248,16 +407,23 @@ func (c *Channel) RemoveMember(client *Client) {
 func (c *Channel) UpdateMemberNick(client *Client, oldNick string) {
 	c.membersMutex.Lock()
 	defer c.membersMutex.Unlock()
-	modes := c.members[oldNick]
-	delete(c.members, oldNick)
-	c.members[client.Nickname] = modes
+	member := c.members[c.Server.Casefold(oldNick)]
+	delete(c.members, c.Server.Casefold(oldNick))
+	c.members[c.memberKey(client)] = member
+	c.shareMember(c.memberKey(client)) // the new nickname is shared first so the channel isn't left empty
+	c.shareMember(c.Server.Casefold(oldNick))
+}
+
+// memberKey returns the key a client is stored under in the member listing
+func (c *Channel) memberKey(client *Client) string {
+	return c.Server.Casefold(client.Nickname)
 }
 
 // HasMember returns if a client is an existing member of this channel
 func (c *Channel) HasMember(client *Client) bool {
 	c.membersMutex.RLock()
 	defer c.membersMutex.RUnlock()
-	_, found := c.members[client.Nickname]
+	_, found := c.members[c.memberKey(client)]
 	return found
 }
 
@@ -272,10 +438,10 @@ func (c *Channel) GetMemberCount() int {
 func (c *Channel) AddMemberMode(client *Client, mode ChannelMode) {
 	c.membersMutex.Lock()
 	defer c.membersMutex.Unlock()
-	m, ok := c.members[client.Nickname]
+	m, ok := c.members[c.memberKey(client)]
 	if ok {
-		m.AddMode(mode)
-		c.members[client.Nickname] = m
+		m.modes.AddMode(mode)
+		c.shareMember(c.memberKey(client))
 	}
 }
 
@@ -283,10 +449,10 @@ func (c *Channel) AddMemberMode(client *Client, mode ChannelMode) {
 func (c *Channel) RemoveMemberMode(client *Client, mode ChannelMode) {
 	c.membersMutex.Lock()
 	defer c.membersMutex.Unlock()
-	m, ok := c.members[client.Nickname]
+	m, ok := c.members[c.memberKey(client)]
 	if ok {
-		m.RemoveMode(mode)
-		c.members[client.Nickname] = m
+		m.modes.RemoveMode(mode)
+		c.shareMember(c.memberKey(client))
 	}
 
 }
@@ -295,18 +461,56 @@ func (c *Channel) RemoveMemberMode(client *Client, mode ChannelMode) {
 func (c *Channel) GetMemberModes(client *Client) *ChannelModeSet {
 	c.membersMutex.RLock()
 	defer c.membersMutex.RUnlock()
-	return c.members[client.Nickname]
+	member, ok := c.members[c.memberKey(client)]
+	if !ok {
+		return nil
+	}
+	return member.modes
 }
 
 // MemberHasMode returns whether the given client has the requested mode
 func (c *Channel) MemberHasMode(client *Client, mode ChannelMode) bool {
 	c.membersMutex.RLock()
 	defer c.membersMutex.RUnlock()
-	member, ok := c.members[client.Nickname]
+	member, ok := c.members[c.memberKey(client)]
 	if !ok { //client is not a member in channel
 		return false
 	}
-	return member.HasMode(mode)
+	return member.modes.HasMode(mode)
+}
+
+// AddInvite records that a client has been invited to the channel
+func (c *Channel) AddInvite(client *Client) {
+	c.membersMutex.Lock()
+	defer c.membersMutex.Unlock()
+	c.invited[c.memberKey(client)] = nil
+}
+
+// RemoveInvite removes a pending invite for a client
+func (c *Channel) RemoveInvite(client *Client) {
+	c.membersMutex.Lock()
+	defer c.membersMutex.Unlock()
+	delete(c.invited, c.memberKey(client))
+}
+
+// IsInvited returns if a client has a pending invite or matches an invitation mask of the channel
+func (c *Channel) IsInvited(client *Client) bool {
+	c.membersMutex.RLock()
+	_, found := c.invited[c.memberKey(client)]
+	c.membersMutex.RUnlock()
+	if found {
+		return true
+	}
+	return client.Prefix != nil && c.matchMasks(ChannelModeInvitationMask, client.Prefix.String())
+}
+
+// IsBanned returns if a client matches a ban mask of the channel without also matching an exception mask
+func (c *Channel) IsBanned(client *Client) bool {
+	if client.Prefix == nil {
+		return false
+	}
+	hostmask := client.Prefix.String()
+	return c.matchMasks(ChannelModeBan, hostmask) && !c.matchMasks(ChannelModeExceptionMask, hostmask)
 }
 
 func (c *Channel) delete() {
@@ -370,10 +574,15 @@ func (c *Channel) TopicCommand(client *Client, topic string) {
 	tMode := c.HasMode(ChannelModeTopic)
 
 	if isOp || !tMode { // Has permissions - operator or channel does not have +t mode
+		if len(topic) > c.Server.Config.TopicLength { // cut at a character boundary, so the topic stays valid UTF-8
+			topic = splitLine(topic, c.Server.Config.TopicLength)[0]
+		}
 		c.Topic = topic
+		c.shareState()
 		//Notify channel members of new topic
 		m := irc.Message{Prefix: client.Prefix, Command: irc.TOPIC, Params: []string{c.Name}, Trailing: c.Topic}
 		c.SendMessage(&m)
+		c.Server.propagate(&m, client.route())
 		return
 	}
 
@@ -421,6 +630,7 @@ func (c *Channel) Kick(client *Client, kicked []string, message string) {
 		}
 		m := irc.Message{Prefix: client.Prefix, Command: irc.KICK, Params: []string{c.Name, kickedName}, Trailing: message}
 		c.SendMessage(&m)
+		c.Server.propagate(&m, client.route())
 		c.RemoveMember(kickedClient)
 		kickedClient.RemoveChannel(c)
 	}
@@ -0,0 +1,167 @@
+package irc
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// discardConn is a connection that drops everything written to it and never has anything to read
+type discardConn struct{ net.Conn }
+
+func (discardConn) Write(b []byte) (int, error)      { return len(b), nil }
+func (discardConn) Read(b []byte) (int, error)       { select {} }
+func (discardConn) Close() error                     { return nil }
+func (discardConn) SetWriteDeadline(time.Time) error { return nil }
+func (discardConn) RemoteAddr() net.Addr             { return &net.TCPAddr{} }
+
+// newFanoutChannel creates a channel with n registered members, half of them with the server-time and message-tags capabilities
+func newFanoutChannel(n int) (*Channel, *Client) {
+	s := NewServer(ServerConfig{Name: "irc.test", SendQ: 1 << 30})
+	var channel *Channel
+	var sender *Client
+	for i := 0; i < n; i++ {
+		conn := discardConn{}
+		c := s.newClient(irc.NewConn(conn), conn)
+		c.idleTimer.Stop()
+		c.Nickname = "user" + strconv.Itoa(i)
+		c.Prefix = &irc.Prefix{Name: c.Nickname, User: "user", Host: "host"}
+		c.Registered = true
+		if i%2 == 0 {
+			c.EnableCap(CapServerTime)
+			c.EnableCap(CapMessageTags)
+		}
+		s.AddClientNick(c)
+		if channel == nil {
+			channel = NewChannel(s, c)
+			channel.Name = "#fanout"
+			s.AddChannel(channel)
+			sender = c
+		}
+		channel.AddMember(c)
+		c.AddChannel(channel)
+	}
+	return channel, sender
+}
+
+// BenchmarkChannelFanout relays a PRIVMSG with tags to every member of channels of different sizes
+func BenchmarkChannelFanout(b *testing.B) {
+	for _, n := range []int{100, 1000, 5000} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			channel, sender := newFanoutChannel(n)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				channel.MessageWithTags(sender, "hello everybody in the channel", Tags{"+draft/react": "x"})
+			}
+		})
+	}
+}
+
+// BenchmarkChannelFanoutPerMember relays the same PRIVMSG as BenchmarkChannelFanout by encoding it for every member,
+// which is what the fan-out did before messages were prepared once for the whole channel
+func BenchmarkChannelFanoutPerMember(b *testing.B) {
+	for _, n := range []int{100, 1000, 5000} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			channel, sender := newFanoutChannel(n)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				m := irc.Message{Prefix: sender.Prefix, Command: irc.PRIVMSG, Params: []string{channel.Name}, Trailing: "hello everybody in the channel"}
+				tags := channel.Server.stampTags(&m, Tags{"+draft/react": "x"})
+				for _, member := range channel.getMembers() {
+					if member != sender {
+						member.Relay(&m, tags)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestJoinChecks(t *testing.T) {
+	s := newTestServer(ServerConfig{Name: "irc.test"})
+	alice := connectClient(t, s, "alice")
+	bob := connectClient(t, s, "bob")
+	alice.send("JOIN #x")
+	alice.expect("JOIN #x")
+
+	alice.send("MODE #x +l 1")
+	alice.expect("MODE #x +l 1")
+	bob.send("JOIN #x")
+	bob.expect(" 471 bob #x ")
+	alice.send("MODE #x -l")
+	alice.expect("MODE #x -l")
+
+	alice.send("MODE #x +k key")
+	alice.expect("MODE #x +k key")
+	bob.send("JOIN #x wrong")
+	bob.expect(" 475 bob #x ")
+	alice.send("MODE #x -k key")
+	alice.expect("MODE #x -k")
+
+	alice.send("MODE #x +b bob!*@*")
+	alice.expect("MODE #x +b bob!*@*")
+	bob.send("JOIN #x")
+	bob.expect(" 474 bob #x ")
+	alice.send("MODE #x +e *!user@*")
+	alice.expect("MODE #x +e *!user@*")
+	bob.send("JOIN #x")
+	bob.expect("JOIN #x")
+	s.Do(func() {
+		channel, _ := s.GetChannel("#x")
+		if len(channel.getMembers()) != 2 {
+			t.Error("bob should be the second member of #x")
+		}
+	})
+}
+
+func TestSendChecks(t *testing.T) {
+	s := newTestServer(ServerConfig{Name: "irc.test"})
+	alice := connectClient(t, s, "alice")
+	bob := connectClient(t, s, "bob")
+	carol := connectClient(t, s, "carol")
+	alice.send("JOIN #x")
+	alice.expect("JOIN #x")
+	bob.send("JOIN #x")
+	bob.expect("JOIN #x")
+
+	carol.send("PRIVMSG #x :from outside")
+	alice.expect("PRIVMSG #x :from outside")
+	alice.send("MODE #x +n")
+	alice.expect("MODE #x +n")
+	carol.send("PRIVMSG #x :from outside")
+	carol.expect(" 404 carol #x ")
+
+	alice.send("MODE #x +m")
+	alice.expect("MODE #x +m")
+	bob.send("PRIVMSG #x :moderated")
+	bob.expect(" 404 bob #x ")
+	alice.send("MODE #x +v bob")
+	alice.expect("MODE #x +v bob")
+	bob.send("PRIVMSG #x :voiced")
+	alice.expect("PRIVMSG #x :voiced")
+	alice.send("MODE #x -v bob")
+	waitFor(t, s, "bob is no longer voiced", func() bool {
+		channel, _ := s.GetChannel("#x")
+		client, _ := s.GetClientByNick("bob")
+		return !channel.MemberHasMode(client, ChannelModeVoice)
+	})
+	alice.send("MODE #x -m")
+	alice.expect("MODE #x -m")
+
+	alice.send("MODE #x +b bob!*@*")
+	alice.expect("MODE #x +b bob!*@*")
+	bob.send("NOTICE #x :banned\r\nPRIVMSG #x :banned") // the 404 to the PRIVMSG comes once the NOTICE has been handled
+	bob.expect(" 404 bob #x ")
+	alice.send("MODE #x -b bob!*@*")
+	alice.expect("MODE #x -b bob!*@*")
+	bob.send("PRIVMSG #x :unbanned")
+	if line := alice.expect(":bob!", "#x :"); !strings.HasSuffix(line, "PRIVMSG #x :unbanned") {
+		t.Errorf("alice got %q from a banned member", line)
+	}
+}
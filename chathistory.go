@@ -0,0 +1,303 @@
+package irc
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// IRCv3 capabilities for message history
+const (
+	CapChatHistory   = "draft/chathistory"
+	CapEventPlayback = "draft/event-playback"
+)
+
+// historyCommands are the commands recorded in the history
+var historyCommands = map[string]interface{}{irc.PRIVMSG: nil, irc.NOTICE: nil, irc.JOIN: nil, irc.PART: nil, irc.TOPIC: nil}
+
+// historyEnd is later than any recorded event
+var historyEnd = time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+// SetHistoryStore sets the HistoryStore messages are recorded in and offers the draft/chathistory capability to clients.
+// Handlers read the store, so it must be called before the server is started or through Server.Do
+func (s *Server) SetHistoryStore(store HistoryStore) {
+	s.History = store
+	s.ISupport.Set("CHATHISTORY", strconv.Itoa(s.Config.ChatHistoryLimit))
+	s.ISupport.Set("MSGREFTYPES", "msgid,timestamp")
+	s.AddCapability(CapChatHistory, "")
+	s.AddCapability(CapEventPlayback, "")
+}
+
+// recordHistory records a relayed message in the history of a target
+func (s *Server) recordHistory(target string, m *irc.Message, tags Tags) {
+	s.addHistory(target, m, tags, "", "")
+}
+
+// recordDirectHistory records a message from one user to another in the history of their direct conversation.
+// Conversations are kept by account, so that whoever uses a nickname later can't read them, and are only recorded if both users are logged in
+func (s *Server) recordDirectHistory(from *Client, to *Client, m *irc.Message, tags Tags) {
+	if len(from.Account) == 0 || len(to.Account) == 0 {
+		return
+	}
+	fromAccount, toAccount := s.Casefold(from.Account), s.Casefold(to.Account)
+	s.addHistory(s.directHistoryTarget(fromAccount, toAccount), m, tags, fromAccount, toAccount)
+}
+
+// addHistory records a message in the history of a target, from and to are the accounts of the users of a direct message
+func (s *Server) addHistory(target string, m *irc.Message, tags Tags, from string, to string) {
+	if s.History == nil {
+		return
+	}
+	if _, ok := historyCommands[m.Command]; !ok {
+		return
+	}
+	event := HistoryEvent{Time: time.Now().UTC(), MsgID: tags["msgid"], Tags: tags, Message: m.String(), From: from, To: to}
+	if err := s.History.Add(target, event); err != nil {
+		s.logf("Error recording history of %s: %v", target, err)
+	}
+}
+
+// directHistoryTarget returns the history target of a direct conversation between the users of two casefolded accounts
+func (s *Server) directHistoryTarget(account string, otherAccount string) string {
+	accounts := []string{account, otherAccount}
+	sort.Strings(accounts)
+	return strings.Join(accounts, ",")
+}
+
+// historyTarget returns the history target and display name for a channel or nickname the client asked for.
+// Clients may only read the history of channels they are a member of and, when logged in, of their own direct conversations.
+// A nickname stands for the account of the user using it, or for the account of the same name if that user isn't logged in
+func (c *Client) historyTarget(name string) (target string, display string, ok bool) {
+	if len(name) == 0 || strings.Contains(name, ",") {
+		return "", "", false
+	}
+	if _, isChannel := channelStarters[name[0]]; isChannel {
+		channel, found := c.Server.GetChannel(name)
+		if !found || !channel.HasMember(c) {
+			return "", "", false
+		}
+		return c.Server.Casefold(channel.Name), channel.Name, true
+	}
+	if len(c.Account) == 0 {
+		return "", "", false
+	}
+	other := c.Server.Casefold(name)
+	if cl, found := c.Server.GetClientByNick(name); found && len(cl.Account) != 0 {
+		other = c.Server.Casefold(cl.Account)
+	}
+	return c.Server.directHistoryTarget(c.Server.Casefold(c.Account), other), name, true
+}
+
+// historyTargetName returns the display name of a history target if the client may read its history
+func (c *Client) historyTargetName(target string) (display string, ok bool) {
+	if accounts := strings.Split(target, ","); len(accounts) == 2 {
+		own := c.Server.Casefold(c.Account)
+		other := accounts[0]
+		if len(own) == 0 {
+			return "", false
+		}
+		if other == own {
+			other = accounts[1]
+		} else if accounts[1] != own {
+			return "", false
+		}
+		if cl, found := c.Server.GetClientByNick(other); found && c.Server.Casefold(cl.Account) == other {
+			return cl.Nickname, true
+		}
+		return other, true
+	}
+	channel, found := c.Server.GetChannel(target)
+	if !found || !channel.HasMember(c) {
+		return "", false
+	}
+	return channel.Name, true
+}
+
+// sendHistory plays back events to the client, wrapped in a chathistory batch if the client supports batches.
+// Events other than PRIVMSG and NOTICE are only sent to clients that enabled draft/event-playback
+func (c *Client) sendHistory(target string, events []HistoryEvent) {
+	batch := c.StartBatch(BatchChatHistory, target)
+	for _, event := range events {
+		m := irc.ParseMessage(event.Message)
+		if m == nil {
+			continue
+		}
+		if m.Command != irc.PRIVMSG && m.Command != irc.NOTICE && !c.HasCap(CapEventPlayback) {
+			continue
+		}
+		c.deliver(m, event.Tags, true)
+	}
+	batch.End()
+}
+
+// readableHistory returns the events of a target the client may read. Events of a direct conversation are checked
+// to have been sent or received by the account of the client, events recorded without their accounts are left out
+func (c *Client) readableHistory(target string, events []HistoryEvent) []HistoryEvent {
+	if !strings.Contains(target, ",") { // a channel
+		return events
+	}
+	account := c.Server.Casefold(c.Account)
+	readable := []HistoryEvent{}
+	for _, event := range events {
+		if len(account) != 0 && (event.From == account || event.To == account) {
+			readable = append(readable, event)
+		}
+	}
+	return readable
+}
+
+// parseHistorySelector returns the time referred to by a timestamp= or msgid= message reference
+func parseHistorySelector(store HistoryStore, target string, selector string) (time.Time, bool) {
+	i := strings.IndexByte(selector, '=')
+	if i < 0 {
+		return time.Time{}, false
+	}
+	switch selector[:i] {
+	case "timestamp":
+		t, err := time.Parse(time.RFC3339Nano, selector[i+1:])
+		return t, err == nil
+	case "msgid":
+		event, ok := store.Get(target, selector[i+1:])
+		return event.Time, ok
+	}
+	return time.Time{}, false
+}
+
+// historyBetween returns the events that happened after start and before end
+func historyBetween(events []HistoryEvent, start time.Time, end time.Time) []HistoryEvent {
+	between := []HistoryEvent{}
+	for _, event := range events {
+		if event.Time.After(start) && event.Time.Before(end) {
+			between = append(between, event)
+		}
+	}
+	return between
+}
+
+// ChatHistoryHandler is a CommandHandler to respond to CHATHISTORY commands from a client
+// Implemented according to the IRCv3 draft/chathistory specification
+func ChatHistoryHandler(message *irc.Message, client *Client) {
+	args := message.Params
+	if len(message.Trailing) != 0 {
+		args = append(args, message.Trailing)
+	}
+	if len(args) == 0 {
+		client.Fail(CHATHISTORY, "NEED_MORE_PARAMS", nil, "Missing parameters")
+		return
+	}
+	store := client.Server.History
+	subcommand := strings.ToUpper(args[0])
+	if store == nil {
+		client.Fail(CHATHISTORY, "MESSAGE_ERROR", []string{subcommand}, "Message history is not available")
+		return
+	}
+
+	needed := 4
+	switch subcommand {
+	case "TARGETS":
+		chatHistoryTargets(args[1:], client)
+		return
+	case "LATEST", "BEFORE", "AFTER", "AROUND":
+	case "BETWEEN":
+		needed = 5
+	default:
+		client.Fail(CHATHISTORY, "INVALID_PARAMS", []string{subcommand}, "Unknown subcommand")
+		return
+	}
+	if len(args) < needed {
+		client.Fail(CHATHISTORY, "NEED_MORE_PARAMS", []string{subcommand}, "Missing parameters")
+		return
+	}
+
+	target, display, ok := client.historyTarget(args[1])
+	if !ok {
+		client.Fail(CHATHISTORY, "INVALID_TARGET", []string{subcommand, args[1]}, "Messages could not be retrieved")
+		return
+	}
+	limit, err := strconv.Atoi(args[needed-1])
+	if err != nil || limit <= 0 {
+		client.Fail(CHATHISTORY, "INVALID_PARAMS", []string{subcommand, args[needed-1]}, "Invalid limit")
+		return
+	}
+	if limit > client.Server.Config.ChatHistoryLimit {
+		limit = client.Server.Config.ChatHistoryLimit
+	}
+
+	var t time.Time
+	if subcommand != "LATEST" || args[2] != "*" {
+		t, ok = parseHistorySelector(store, target, args[2])
+		if !ok {
+			client.Fail(CHATHISTORY, "INVALID_PARAMS", []string{subcommand, args[2]}, "Invalid message reference")
+			return
+		}
+	}
+
+	var events []HistoryEvent
+	switch subcommand {
+	case "LATEST":
+		events = historyBetween(store.Before(target, historyEnd, limit), t, historyEnd)
+	case "BEFORE":
+		events = store.Before(target, t, limit)
+	case "AFTER":
+		events = store.After(target, t, limit)
+	case "AROUND": // Half of the events come from before the reference, which is included itself if it is a message
+		events = store.Before(target, t, limit/2)
+		events = append(events, store.After(target, t.Add(-time.Nanosecond), limit-len(events))...)
+	case "BETWEEN":
+		end, ok := parseHistorySelector(store, target, args[3])
+		if !ok {
+			client.Fail(CHATHISTORY, "INVALID_PARAMS", []string{subcommand, args[3]}, "Invalid message reference")
+			return
+		}
+		if t.Before(end) {
+			events = historyBetween(store.After(target, t, limit), t, end)
+		} else {
+			events = historyBetween(store.Before(target, t, limit), end, t)
+		}
+	}
+	client.sendHistory(display, client.readableHistory(target, events))
+}
+
+// chatHistoryTargets responds to CHATHISTORY TARGETS with the conversations of the client that had activity between two timestamps
+func chatHistoryTargets(args []string, client *Client) {
+	if len(args) < 3 {
+		client.Fail(CHATHISTORY, "NEED_MORE_PARAMS", []string{"TARGETS"}, "Missing parameters")
+		return
+	}
+	start, ok := parseHistorySelector(client.Server.History, "", args[0])
+	end, endOk := parseHistorySelector(client.Server.History, "", args[1])
+	if !ok || !endOk || !strings.HasPrefix(args[0], "timestamp=") || !strings.HasPrefix(args[1], "timestamp=") {
+		client.Fail(CHATHISTORY, "INVALID_PARAMS", []string{"TARGETS"}, "Invalid timestamp")
+		return
+	}
+	limit, err := strconv.Atoi(args[2])
+	if err != nil || limit <= 0 {
+		client.Fail(CHATHISTORY, "INVALID_PARAMS", []string{"TARGETS", args[2]}, "Invalid limit")
+		return
+	}
+	if limit > client.Server.Config.ChatHistoryLimit {
+		limit = client.Server.Config.ChatHistoryLimit
+	}
+	if start.After(end) {
+		start, end = end, start
+	}
+
+	batch := client.StartBatch(BatchChatHistoryTargets)
+	sent := 0
+	for _, target := range client.Server.History.Targets(start, end) {
+		if sent == limit {
+			break
+		}
+		display, ok := client.historyTargetName(target.Target)
+		if !ok {
+			continue
+		}
+		m := irc.Message{Prefix: client.Server.Prefix, Command: CHATHISTORY, Params: []string{"TARGETS", display, target.Latest.UTC().Format(serverTimeFormat)}}
+		client.Encode(&m)
+		sent++
+	}
+	batch.End()
+}
@@ -1,6 +1,7 @@
 package irc
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"net"
@@ -15,6 +16,8 @@ import (
 type Client struct {
 	*irc.Conn
 	conn     net.Conn
+	reader   *bufio.Reader
+	tags     Tags // tags of the message currently being handled
 	Nickname string
 	Name     string
 	Host     string
@@ -26,6 +29,19 @@ type Client struct {
 	Server     *Server
 	Authorized bool
 	Registered bool
+	Secure     bool   // Client is connected with TLS or over a Unix socket
+	Class      string // Connection class of the listener the client connected to
+
+	// Account is the name of the account the client has logged in to with SASL, empty if not logged in
+	Account  string
+	sasl     *saslSession
+	saslBusy bool // set while a SASL response is verified off the state goroutine
+
+	password string        // password sent with PASS
+	home     *RemoteServer // server a remote client is connected to, nil for local clients
+	hops     int           // number of links between this server and the home server
+	upgrade  *irc.Message  // SERVER message the connection is to be turned into a link with
+	node     string        // cluster node a user of another node is connected to, empty for users of this server
 
 	idleTimer *time.Timer
 	quitTimer *time.Timer
@@ -35,30 +51,65 @@ type Client struct {
 	channels     map[string]*Channel
 	channelMutex sync.RWMutex
 
+	monitoring map[string]string // nicknames being monitored, by their casefolded form
+
+	caps           map[string]interface{}
+	capMutex       sync.RWMutex
+	capVersion     int
+	capNegotiating bool
+
+	batch     *Batch           // batch the replies to the command being handled are part of
+	multiline *multilineBatch  // draft/multiline batch being sent by the client
+	response  *labeledResponse // replies to the labeled command being handled
+
+	sendq *sendQueue // messages waiting to be written to the connection
+
 	*UserModeSet
 }
 
 func (s *Server) newClient(ircConn *irc.Conn, conn net.Conn) *Client {
 	client := &Client{Conn: ircConn, conn: conn, Server: s}
+	client.reader = bufio.NewReaderSize(conn, maxClientTagsLength+2+maxLineLength)
 	client.Authorized = len(s.Config.Password) == 0
-	client.idleTimer = time.AfterFunc(time.Minute*1, client.quit)
+	client.idleTimer = time.AfterFunc(time.Minute*1, client.timeout(client.quit))
 	client.channels = map[string]*Channel{}
+	client.caps = map[string]interface{}{}
+	client.monitoring = map[string]string{}
 	client.UserModeSet = NewUserModeSet()
+	client.startWriter()
 	return client
 }
 
-// Close cleans up the IRC client and closes the connection
+// Close cleans up the IRC client and closes the connection once the messages queued for it have been written
 func (c *Client) Close() error {
+	return c.closeWithin(time.Now().Add(closeTimeout))
+}
+
+// closeWithin cleans up the IRC client and closes the connection once the messages queued for it have been written,
+// or at the deadline
+func (c *Client) closeWithin(deadline time.Time) error {
 	c.Server.RemoveClient(c)
-	c.Server.RemoveClientNick(c)
+	if cl, found := c.Server.GetClientByNick(c.Nickname); found && cl == c {
+		c.Server.RemoveClientNick(c)
+		if c.Registered {
+			c.Server.notifyOffline(c.Nickname)
+		}
+	}
+	c.clearMonitor()
+
+	return c.closeWriter(deadline)
+}
 
-	return c.Conn.Close()
+// Fail sends an IRCv3 standard FAIL reply to the client
+func (c *Client) Fail(command string, code string, context []string, description string) {
+	m := irc.Message{Prefix: c.Server.Prefix, Command: FAIL, Params: append([]string{command, code}, context...), Trailing: description}
+	c.Encode(&m)
 }
 
 // Ping sends an IRC PING command to a client
 func (c *Client) Ping() {
 	m := irc.Message{Command: irc.PING, Trailing: c.Server.Config.Name}
-	c.Encode(&m)
+	c.Relay(&m, nil)
 }
 
 // Pong sends an IRC PONG command to the client
@@ -68,44 +119,77 @@ func (c *Client) Pong() {
 }
 
 func (c *Client) handleIncoming() {
-	c.Server.AddClient(c)
+	if !c.Server.startHandling(c) {
+		c.Conn.Close()
+		return
+	}
+	defer c.Server.stopHandling()
 	for {
-		message, err := c.Decode()
+		message, tags, err := c.readMessage()
 		if err != nil {
 
 			_, closedError := err.(*net.OpError)
 			if err == io.EOF || err == io.ErrClosedPipe || closedError || strings.Contains(err.Error(), "use of closed network connection") {
 				return
 			}
-
+			if err != errInputTooLong { // the connection keeps failing, like after an invalid PROXY protocol header
+				c.Server.logf("Error reading from %v: %v", c.conn.RemoteAddr(), err)
+				return
+			}
+			c.Server.Do(func() {
+				m := irc.Message{Prefix: c.Server.Prefix, Command: ERR_INPUTTOOLONG, Params: []string{c.Nickname}, Trailing: "Input line was too long"}
+				c.Encode(&m)
+			})
 			continue
 		}
 		if message == nil || message.Len() == 0 {
 			continue
 		}
 
-		c.idleTimer.Stop()
+		c.Server.Do(func() { c.handle(message, tags) })
 
-		if !c.Registered { // if client isn't registered don't bother with PINGs
-			c.idleTimer = time.AfterFunc(time.Minute*1, c.quit)
-		} else {
-			c.idleTimer = time.AfterFunc(time.Minute*3, c.idle)
+		if c.upgrade != nil { // the connection is a server link now
+			c.upgradeToLink()
+			return
 		}
 
-		if c.quitTimer != nil {
-			c.quitTimer.Stop()
-			c.quitTimer = nil
-		}
+	}
+
+}
 
-		c.Server.CommandsMux.ServeIRC(message, c)
+// handle serves a message from the client on the state goroutine
+func (c *Client) handle(message *irc.Message, tags Tags) {
+	if c.closed() { // messages still read after the client quit or was disconnected are ignored
+		return
+	}
+	c.idleTimer.Stop()
+
+	if !c.Registered { // if client isn't registered don't bother with PINGs
+		c.idleTimer = time.AfterFunc(time.Minute*1, c.timeout(c.quit))
+	} else {
+		c.idleTimer = time.AfterFunc(time.Minute*3, c.timeout(c.idle))
+	}
 
+	if c.quitTimer != nil {
+		c.quitTimer.Stop()
+		c.quitTimer = nil
 	}
 
+	c.tags = tags
+	c.Server.CommandsMux.ServeIRC(message, c)
+	c.tags = nil
+}
+
+// timeout returns a function for a timer that runs f on the state goroutine
+func (c *Client) timeout(f func()) func() {
+	return func() {
+		c.Server.run(f)
+	}
 }
 
 func (c *Client) idle() {
 	c.Ping()
-	c.quitTimer = time.AfterFunc(time.Minute*3, c.quit)
+	c.quitTimer = time.AfterFunc(time.Minute*3, c.timeout(c.quit))
 }
 
 func (c *Client) quit() {
@@ -113,6 +197,7 @@ func (c *Client) quit() {
 	for _, channel := range c.GetChannels() {
 		channel.Quit(c, "Disconnected")
 	}
+	c.propagateQuit("Disconnected")
 	c.Quit()
 }
 
@@ -121,10 +206,37 @@ func (c *Client) Quit() {
 	m := irc.Message{Prefix: &irc.Prefix{Name: c.Server.Config.Name}, Command: irc.QUIT,
 		Params: []string{c.Nickname}}
 
-	c.Encode(&m)
+	c.Relay(&m, nil)
 	c.Close()
 }
 
+// disconnect makes the client quit its channels and closes the connection with an ERROR message,
+// the messages queued for the client are given until the deadline to be written
+func (c *Client) disconnect(reason string, deadline time.Time) {
+	for _, channel := range c.GetChannels() {
+		channel.Quit(c, reason)
+	}
+	c.propagateQuit(reason)
+	m := irc.Message{Prefix: c.Server.Prefix, Command: irc.ERROR, Trailing: "Closing Link: " + reason}
+	c.Relay(&m, nil)
+	c.closeWithin(deadline)
+}
+
+// propagateQuit tells linked servers that a registered client quit
+func (c *Client) propagateQuit(message string) {
+	if c.Registered {
+		c.Server.propagate(&irc.Message{Prefix: c.Prefix, Command: irc.QUIT, Trailing: message}, nil)
+	}
+}
+
+// completeRegistration welcomes the client once both NICK and USER have been received and capability negotiation has ended
+func (c *Client) completeRegistration() {
+	if c.Registered || c.capNegotiating || len(c.Nickname) == 0 || len(c.Username) == 0 {
+		return
+	}
+	c.Welcome()
+}
+
 // Welcome handles initial client connection IRC protocols for a client.
 // Welcome procedure includes IRC WELCOME, Host Info, and MOTD
 func (c *Client) Welcome() {
@@ -165,9 +277,23 @@ func (c *Client) Welcome() {
 		return
 	}
 
+	for _, tokens := range c.Server.ISupport.Lines() {
+		m = irc.Message{Prefix: c.Server.Prefix, Command: RPL_ISUPPORT,
+			Params: append([]string{c.Nickname}, tokens...), Trailing: "are supported by this server"}
+
+		err = c.Encode(&m)
+		if err != nil {
+			return
+		}
+	}
+
 	// Send MOTD
 	c.MOTD()
 
+	c.Server.propagate(c.Server.nickMessage(c), nil)
+	c.Server.claimNick(c, c.Nickname) // the other cluster nodes learn the username and hostname
+	c.notifyOnline()
+
 }
 
 // MOTD returns the Message of the Day of the server to the client
@@ -186,12 +312,14 @@ func (c *Client) MOTD() {
 		return
 	}
 
-	m = irc.Message{Prefix: c.Server.Prefix, Command: irc.RPL_MOTD,
-		Params: []string{c.Nickname, c.Server.Config.MOTD}}
+	for _, line := range strings.Split(c.Server.Config.MOTD, "\n") { // MOTDs read from files have several lines
+		m = irc.Message{Prefix: c.Server.Prefix, Command: irc.RPL_MOTD,
+			Params: []string{c.Nickname}, Trailing: "- " + strings.TrimRight(line, "\r")}
 
-	err = c.Encode(&m)
-	if err != nil {
-		return
+		err = c.Encode(&m)
+		if err != nil {
+			return
+		}
 	}
 
 	m = irc.Message{Prefix: c.Server.Prefix, Command: irc.RPL_ENDOFMOTD,
@@ -217,9 +345,15 @@ func (c *Client) RemoveChannel(channel *Channel) {
 	delete(c.channels, channel.Name)
 }
 
-// GetChannels gets a list of channels this client is joined to
+// GetChannels gets a snapshot of the channels this client is joined to
 func (c *Client) GetChannels() map[string]*Channel {
-	return c.channels
+	c.channelMutex.RLock()
+	defer c.channelMutex.RUnlock()
+	channels := make(map[string]*Channel, len(c.channels))
+	for name, channel := range c.channels {
+		channels[name] = channel
+	}
+	return channels
 }
 
 // UpdateNick updates the clients nicknamae to a new nickname
@@ -233,42 +367,43 @@ func (c *Client) UpdateNick(newNick string) {
 
 	// Notify all people that should know (people on channels with this client)
 	m := irc.Message{Prefix: c.Prefix, Command: irc.NICK, Trailing: c.Nickname}
-	notified := map[string]interface{}{} // Just notify people once
+	notified := map[*Client]interface{}{c: nil} // Just notify people once
 	c.Encode(&m)
-	notified[c.Nickname] = nil
 
+	prepared := prepareMessage(&m, nil)
 	for _, channel := range c.channels {
 
 		channel.UpdateMemberNick(c, oldNick)
 
-		for client := range channel.members {
-			cl, ok := c.Server.GetClientByNick(client)
-			_, alreadyNotified := notified[client]
-			if ok && !alreadyNotified {
-				cl.Encode(&m)
-				notified[client] = nil
+		for _, member := range channel.getMembers() {
+			if _, alreadyNotified := notified[member]; !alreadyNotified {
+				member.relayPrepared(prepared)
+				notified[member] = nil
 			}
 		}
 	}
 
+	c.Server.propagate(&m, c.route())
 	c.Prefix.Name = newNick
+
+	if c.Server.Casefold(oldNick) != c.Server.Casefold(newNick) {
+		c.Server.notifyOffline(oldNick)
+		c.notifyOnline()
+	}
 }
 
 // GetVisible returns a map of clients visible to this client
 func (c *Client) GetVisible() map[string]*Client {
 	clients := map[string]*Client{}
-	for name, client := range c.Server.clientsByNick {
+	for _, client := range c.Server.getUsers() {
 		if client.HasMode(UserModeInvisible) {
 			continue
 		}
-		clients[name] = client
+		clients[c.Server.Casefold(client.Nickname)] = client
 	}
-	for _, channel := range c.channels {
-		for member := range channel.members {
-			tmp, ok := c.Server.GetClientByNick(member)
-			if ok {
-				clients[member] = tmp
-			}
+	for _, channel := range c.GetChannels() {
+		for _, member := range channel.getMembers() {
+			clients[c.Server.Casefold(member.Nickname)] = member
 		}
 	}
 	return clients
@@ -277,14 +412,14 @@ func (c *Client) GetVisible() map[string]*Client {
 // SendMessagetoVisible sends a message to all other visible clients
 func (c *Client) SendMessagetoVisible(m *irc.Message) {
 	for _, client := range c.GetVisible() {
-		client.Encode(m)
+		client.Relay(m, nil)
 	}
 }
 
 // Who rmanages responding to the WHO request for all visible clients of this client
 func (c *Client) Who() {
 	clients := map[string]*Client{}
-	for name, client := range c.Server.clientsByNick {
+	for _, client := range c.Server.getUsers() {
 		if client.HasMode(UserModeInvisible) {
 			continue
 		}
@@ -292,17 +427,16 @@ func (c *Client) Who() {
 		m := irc.Message{Prefix: c.Server.Prefix, Command: irc.RPL_WHOREPLY, Params: strings.Fields(msg)}
 		c.Encode(&m)
 
-		clients[name] = client
+		clients[c.Server.Casefold(client.Nickname)] = client
 	}
-	for _, channel := range c.channels {
-		for member := range channel.members {
-			tmp, ok := c.Server.GetClientByNick(member)
-			_, alreadySent := clients[member]
-			if ok && !alreadySent {
-				msg := whoLine(tmp, channel, c.Nickname)
+	for _, channel := range c.GetChannels() {
+		for _, member := range channel.getMembers() {
+			name := c.Server.Casefold(member.Nickname)
+			if _, alreadySent := clients[name]; !alreadySent {
+				msg := whoLine(member, channel, c.Nickname)
 				m := irc.Message{Prefix: c.Server.Prefix, Command: irc.RPL_WHOREPLY, Params: strings.Fields(msg)}
 				c.Encode(&m)
-				clients[member] = tmp
+				clients[name] = member
 			}
 		}
 	}
@@ -314,11 +448,11 @@ func (c *Client) Who() {
 func (c *Client) MakeOper() {
 	c.AddMode(UserModeOperator)
 	m := irc.Message{Prefix: c.Server.Prefix, Command: irc.MODE, Params: []string{c.Nickname, "+o"}}
-	for name, client := range c.Server.clientsByNick {
-		if name == c.Nickname {
+	for _, client := range c.Server.getUsers() {
+		if client == c {
 			continue
 		}
-		client.Encode(&m)
+		client.Relay(&m, nil)
 
 	}
 	m = irc.Message{Prefix: c.Server.Prefix, Command: irc.RPL_YOUREOPER, Params: []string{c.Nickname}, Trailing: "You are now an IRC operator"}
@@ -0,0 +1,420 @@
+package irc
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/sorcix/irc"
+)
+
+// ClusterUser is a user of a cluster node as it is shared with the other nodes
+type ClusterUser struct {
+	Nick     string
+	User     string
+	Host     string
+	RealName string
+	Account  string
+	Node     string // Name of the node the user is connected to
+}
+
+// ClusterChannel is the state of a channel shared by the nodes of a cluster
+type ClusterChannel struct {
+	Name    string
+	Topic   string
+	Modes   [][]string        // MODE parameters setting the channel modes, without member modes
+	Members map[string]string // Member mode characters of each member, by casefolded nickname
+	Version int               // Incremented whenever the topic or the modes change
+}
+
+// ClusterEvent is a message passed from one cluster node to another, for one of its users or for the members of a channel on it
+type ClusterEvent struct {
+	Origin  string // Node that published the event
+	Node    string // Node the event is for
+	Nick    string // Casefolded nickname of the user the message is for
+	Channel string // Casefolded name of the channel whose members the message is for
+	Except  string // Casefolded nickname of a channel member that must not get the message
+	Tags    Tags
+	Message string // Message line without tags
+}
+
+// ClusterBus is an interface for sharing nickname ownership, channel membership and messages between the Server instances of a cluster.
+// Nicknames and channel names are casefolded by the servers before they are passed to the bus
+type ClusterBus interface {
+	// Subscribe adds a node to the cluster. Events published for the node are passed to handle
+	Subscribe(node string, handle func(event ClusterEvent)) error
+	// Publish passes an event on to the node it is for
+	Publish(event ClusterEvent) error
+
+	// ClaimNick makes the node of a user the owner of its nickname, or updates the user if the node already owns it.
+	// It returns false if the nickname is owned by another node
+	ClaimNick(nick string, user ClusterUser) bool
+	// ReleaseNick gives up ownership of a nickname if it is owned by the node
+	ReleaseNick(nick string, node string)
+	// GetUser returns the user owning a nickname, if not found ok will be false
+	GetUser(nick string) (user ClusterUser, ok bool)
+
+	// UpdateChannel changes the state of a channel with update, creating the channel if needed. Channels left without members are deleted
+	UpdateChannel(channel string, update func(state *ClusterChannel))
+	// GetChannel returns the state of a channel, if not found ok will be false
+	GetChannel(channel string) (state ClusterChannel, ok bool)
+}
+
+// MemoryClusterBus is a ClusterBus for Server instances running in the same process, events are delivered synchronously
+type MemoryClusterBus struct {
+	nodes    map[string]func(event ClusterEvent)
+	users    map[string]ClusterUser
+	channels map[string]*ClusterChannel
+	mutex    sync.RWMutex
+}
+
+// NewMemoryClusterBus creates and returns a new MemoryClusterBus
+func NewMemoryClusterBus() *MemoryClusterBus {
+	b := MemoryClusterBus{}
+	b.nodes = map[string]func(event ClusterEvent){}
+	b.users = map[string]ClusterUser{}
+	b.channels = map[string]*ClusterChannel{}
+	return &b
+}
+
+// Subscribe adds a node to the cluster
+func (b *MemoryClusterBus) Subscribe(node string, handle func(event ClusterEvent)) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if _, found := b.nodes[node]; found {
+		return fmt.Errorf("node %s is already part of the cluster", node)
+	}
+	b.nodes[node] = handle
+	return nil
+}
+
+// Publish passes an event on to the node it is for
+func (b *MemoryClusterBus) Publish(event ClusterEvent) error {
+	b.mutex.RLock()
+	handle, found := b.nodes[event.Node]
+	b.mutex.RUnlock()
+	if !found {
+		return fmt.Errorf("node %s is not part of the cluster", event.Node)
+	}
+	handle(event)
+	return nil
+}
+
+// ClaimNick makes the node of a user the owner of its nickname
+func (b *MemoryClusterBus) ClaimNick(nick string, user ClusterUser) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if owner, found := b.users[nick]; found && owner.Node != user.Node {
+		return false
+	}
+	b.users[nick] = user
+	return true
+}
+
+// ReleaseNick gives up ownership of a nickname if it is owned by the node
+func (b *MemoryClusterBus) ReleaseNick(nick string, node string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if owner, found := b.users[nick]; found && owner.Node == node {
+		delete(b.users, nick)
+	}
+}
+
+// GetUser returns the user owning a nickname
+func (b *MemoryClusterBus) GetUser(nick string) (user ClusterUser, ok bool) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	user, ok = b.users[nick]
+	return
+}
+
+// UpdateChannel changes the state of a channel
+func (b *MemoryClusterBus) UpdateChannel(channel string, update func(state *ClusterChannel)) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	state, found := b.channels[channel]
+	if !found {
+		state = &ClusterChannel{Members: map[string]string{}}
+	}
+	update(state)
+	if len(state.Members) == 0 {
+		delete(b.channels, channel)
+		return
+	}
+	b.channels[channel] = state
+}
+
+// GetChannel returns a copy of the state of a channel
+func (b *MemoryClusterBus) GetChannel(channel string) (state ClusterChannel, ok bool) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	current, ok := b.channels[channel]
+	if !ok {
+		return
+	}
+	state = *current
+	state.Members = make(map[string]string, len(current.Members))
+	for nick, modes := range current.Members {
+		state.Members[nick] = modes
+	}
+	return
+}
+
+// SetClusterBus makes the server a node of a cluster sharing nicknames, channels and messages through bus.
+// The server name identifies the node and has to be unique within the cluster
+func (s *Server) SetClusterBus(bus ClusterBus) error {
+	handle := func(event ClusterEvent) { // events may be published from the state goroutine of another node, so they are not waited for
+		s.run(func() { s.handleClusterEvent(event) })
+	}
+	if err := bus.Subscribe(s.Config.Name, handle); err != nil {
+		return err
+	}
+	s.Cluster = bus
+	return nil
+}
+
+// clusterUser returns a client as it is shared with the other nodes, using the given nickname
+func (s *Server) clusterUser(client *Client, nick string) ClusterUser {
+	return ClusterUser{Nick: nick, User: client.Name, Host: client.Host, RealName: client.RealName, Account: client.Account, Node: s.Config.Name}
+}
+
+// claimNick claims a nickname for a client on the cluster, it returns false if a user of another node owns the nickname
+func (s *Server) claimNick(client *Client, nick string) bool {
+	if s.Cluster == nil {
+		return true
+	}
+	return s.Cluster.ClaimNick(s.Casefold(nick), s.clusterUser(client, nick))
+}
+
+// releaseNick gives up the nickname of a client on the cluster
+func (s *Server) releaseNick(nick string) {
+	if s.Cluster != nil && len(nick) != 0 {
+		s.Cluster.ReleaseNick(s.Casefold(nick), s.Config.Name)
+	}
+}
+
+// clusterClient returns a client standing in for the user of another node owning a nickname.
+// The same client is returned as long as the user doesn't change, so it can be compared with clients returned earlier
+func (s *Server) clusterClient(nick string) (*Client, bool) {
+	folded := s.Casefold(nick)
+	user, ok := s.Cluster.GetUser(folded)
+	s.clusterMutex.Lock()
+	defer s.clusterMutex.Unlock()
+	if !ok || user.Node == s.Config.Name {
+		delete(s.clusterClients, folded)
+		return nil, false
+	}
+	if client, found := s.clusterClients[folded]; found {
+		current := ClusterUser{Nick: client.Nickname, User: client.Name, Host: client.Host, RealName: client.RealName, Account: client.Account, Node: client.node}
+		if current == user {
+			return client, true
+		}
+	}
+	client := s.newRemoteClient(nil, 0, user.Nick, user.User, user.Host, user.RealName)
+	client.Account = user.Account
+	client.node = user.Node
+	s.clusterClients[folded] = client
+	return client, true
+}
+
+// publish sends an event to another node of the cluster
+func (s *Server) publish(event ClusterEvent) {
+	event.Origin = s.Config.Name
+	if err := s.Cluster.Publish(event); err != nil {
+		s.logf("Error publishing to cluster: %v", err)
+	}
+}
+
+// publishToNode passes a message for a user of another cluster node on to that node.
+// Capabilities of users of other nodes are not known here, their own node filters the tags for them
+func (c *Client) publishToNode(m *irc.Message, tags Tags) error {
+	c.Server.publish(ClusterEvent{Node: c.node, Nick: c.Server.Casefold(c.Nickname), Tags: tags, Message: m.String()})
+	return nil
+}
+
+// handleClusterEvent delivers a message published by another node to the local users it is for
+func (s *Server) handleClusterEvent(event ClusterEvent) {
+	m := irc.ParseMessage(event.Message)
+	if m == nil {
+		return
+	}
+	if len(event.Channel) != 0 {
+		channel, found := s.GetChannel(event.Channel)
+		if !found {
+			return
+		}
+		var except *Client
+		if len(event.Except) != 0 {
+			except, _ = s.GetClientByNick(event.Except)
+		}
+		channel.deliverToMembers(m, event.Tags, except)
+		return
+	}
+	s.clientByNickMutex.RLock()
+	client, found := s.clientsByNick[event.Nick]
+	s.clientByNickMutex.RUnlock()
+	if found {
+		client.Relay(m, event.Tags)
+	}
+}
+
+// sendToMembers delivers a message to the members of the channel except one, and passes it on once to every cluster node with members
+func (c *Channel) sendToMembers(m *irc.Message, tags Tags, except *Client) {
+	nodes := c.deliverToMembers(m, tags, except)
+	event := ClusterEvent{Channel: c.Server.Casefold(c.Name), Tags: tags, Message: m.String()}
+	if except != nil {
+		event.Except = c.memberKey(except)
+	}
+	for node := range nodes {
+		event.Node = node
+		c.Server.publish(event)
+	}
+}
+
+// deliverToMembers delivers a message to the members of the channel on this node except one.
+// It returns the other cluster nodes with members of the channel
+func (c *Channel) deliverToMembers(m *irc.Message, tags Tags, except *Client) map[string]interface{} {
+	nodes := map[string]interface{}{}
+	prepared := prepareMessage(m, tags)
+	for _, member := range c.getMembers() {
+		switch {
+		case member == except:
+		case len(member.node) != 0:
+			nodes[member.node] = nil
+		case m.Command == TAGMSG && !member.HasCap(CapMessageTags):
+		default:
+			c.deliverPrepared(member, prepared)
+		}
+	}
+	return nodes
+}
+
+// memberModeString returns the member mode characters of a member
+func memberModeString(modes *ChannelModeSet) string {
+	s := ""
+	for _, p := range ChannelMemberPrefixes {
+		if modes.HasMode(p.ChannelMode) {
+			s += string(p.ChannelMode)
+		}
+	}
+	return s
+}
+
+// updateCluster changes the state of the channel shared with the cluster, if the server is part of one
+func (c *Channel) updateCluster(update func(state *ClusterChannel)) {
+	if c.Server.Cluster == nil {
+		return
+	}
+	c.Server.Cluster.UpdateChannel(c.Server.Casefold(c.Name), func(state *ClusterChannel) {
+		state.Name = c.Name
+		update(state)
+	})
+}
+
+// shareMember shares the member modes of a member with the cluster. Callers hold membersMutex
+func (c *Channel) shareMember(key string) {
+	member, ok := c.members[key]
+	c.updateCluster(func(state *ClusterChannel) {
+		if ok {
+			state.Members[key] = memberModeString(member.modes)
+		} else {
+			delete(state.Members, key)
+		}
+	})
+}
+
+// shareState shares the topic and modes of the channel with the cluster after they changed
+func (c *Channel) shareState() {
+	modes := channelModeMessages(c)
+	c.updateCluster(func(state *ClusterChannel) {
+		state.Topic = c.Topic
+		state.Modes = modes
+		state.Version++
+		c.clusterVersion = state.Version
+	})
+}
+
+// syncCluster updates the channel with its state on the cluster.
+// It returns false if the channel no longer exists on the cluster
+func (c *Channel) syncCluster() bool {
+	c.membersMutex.Lock()
+	state, found := c.Server.Cluster.GetChannel(c.Server.Casefold(c.Name))
+	dropped := 0
+	removed := []*Client{}
+	for key, member := range c.members {
+		if _, found := state.Members[key]; found {
+			continue
+		}
+		delete(c.members, key)
+		dropped++
+		if member.client != nil && len(member.client.node) == 0 {
+			removed = append(removed, member.client)
+		}
+	}
+	changed := dropped != 0
+	for key, modes := range state.Members {
+		member, found := c.members[key]
+		if !found {
+			member = &channelMember{modes: NewChannelModeSet()}
+			c.members[key] = member
+		}
+		if member.client == nil || len(member.client.node) != 0 { // users of other nodes are looked up again in case they changed
+			client, _ := c.Server.GetClientByNick(key)
+			changed = changed || client != member.client
+			member.client = client
+		}
+		if memberModeString(member.modes) == modes {
+			continue
+		}
+		set := NewChannelModeSet()
+		for _, mode := range modes {
+			set.AddMode(ChannelMode(mode))
+		}
+		member.modes = set
+	}
+	if changed {
+		c.listMembers()
+	}
+	c.membersMutex.Unlock()
+
+	for _, client := range removed {
+		client.RemoveChannel(c)
+	}
+	if !found {
+		if dropped != 0 { // every member left on the other nodes
+			c.Server.RemoveChannel(c)
+			return false
+		}
+		return true // channels are shared once their first member joined
+	}
+	if state.Version != c.clusterVersion {
+		c.clusterVersion = state.Version
+		c.Topic = state.Topic
+		c.ChannelModeSet.reset()
+		for _, params := range state.Modes {
+			c.serverModes(params)
+		}
+	}
+	return true
+}
+
+// getClusterChannel returns the local copy of a channel that exists on the cluster, creating it if needed
+func (s *Server) getClusterChannel(channelName string, channel *Channel) (*Channel, bool) {
+	if channel == nil {
+		state, found := s.Cluster.GetChannel(s.Casefold(channelName))
+		if !found {
+			return nil, false
+		}
+		s.channelMutex.Lock()
+		channel = s.channels[s.Casefold(channelName)]
+		if channel == nil {
+			channel = NewChannel(s, nil)
+			channel.Name = state.Name
+			s.channels[s.Casefold(channelName)] = channel
+		}
+		s.channelMutex.Unlock()
+	}
+	if !channel.syncCluster() {
+		return nil, false
+	}
+	return channel, true
+}
@@ -0,0 +1,56 @@
+package irc
+
+import "testing"
+
+// newClusterServers creates servers sharing nicknames, channels and messages over a MemoryClusterBus
+func newClusterServers(t *testing.T, names ...string) []*Server {
+	bus := NewMemoryClusterBus()
+	servers := []*Server{}
+	for _, name := range names {
+		s := newTestServer(ServerConfig{Name: name})
+		if err := s.SetClusterBus(bus); err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, s)
+	}
+	return servers
+}
+
+func TestClusterNicknames(t *testing.T) {
+	servers := newClusterServers(t, "node1.test", "node2.test")
+	alice := connectClient(t, servers[0], "alice")
+	other := connectClient(t, servers[1], "other")
+	other.send("NICK Alice")
+	other.expect(" 433 Alice ")
+
+	alice.send("QUIT")
+	alice.expectClosed()
+	waitFor(t, servers[1], "alice is released", func() bool {
+		_, ok := servers[1].GetClientByNick("alice")
+		return !ok
+	})
+	other.send("NICK alice")
+	other.expect(":other!", "NICK :alice")
+}
+
+func TestClusterMessages(t *testing.T) {
+	servers := newClusterServers(t, "node1.test", "node2.test")
+	alice := connectClient(t, servers[0], "alice")
+	bob := connectClient(t, servers[1], "bob")
+
+	alice.send("PRIVMSG bob :direct")
+	bob.expect(":alice!", "PRIVMSG bob :direct")
+
+	alice.send("JOIN #c")
+	alice.expect("JOIN #c")
+	bob.send("JOIN #c")
+	bob.expect(":bob!", "JOIN #c")
+	alice.expect(":bob!", "JOIN #c")
+	bob.send("NAMES #c")
+	bob.expect(" 353 bob ", "alice")
+
+	alice.send("PRIVMSG #c :to the channel")
+	bob.expect(":alice!", "PRIVMSG #c :to the channel")
+	bob.send("PART #c")
+	alice.expect(":bob!", "PART #c")
+}
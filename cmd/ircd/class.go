@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// class tracks the clients connected in a connection class
+type class struct {
+	ClassConfig
+	networks []*net.IPNet
+
+	clients map[string]int // number of clients by address
+	total   int
+	mutex   sync.Mutex
+}
+
+// newClasses prepares the configured connection classes, a last class without limits takes the clients no class matches
+func newClasses(configs []ClassConfig) ([]*class, error) {
+	classes := []*class{}
+	for _, config := range append(configs, ClassConfig{Name: "default"}) {
+		c := &class{ClassConfig: config, clients: map[string]int{}}
+		for _, host := range config.Hosts {
+			if !strings.Contains(host, "/") {
+				if strings.Contains(host, ":") {
+					host += "/128"
+				} else {
+					host += "/32"
+				}
+			}
+			_, network, err := net.ParseCIDR(host)
+			if err != nil {
+				return nil, fmt.Errorf("class %s: %v", config.Name, err)
+			}
+			c.networks = append(c.networks, network)
+		}
+		classes = append(classes, c)
+	}
+	return classes, nil
+}
+
+// findClass returns the class with the given name
+func findClass(classes []*class, name string) (*class, bool) {
+	for _, c := range classes {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// matchClass returns the class of a client connecting from addr
+func matchClass(classes []*class, addr net.Addr) *class {
+	ip := addrIP(addr)
+	for _, c := range classes {
+		if len(c.networks) == 0 {
+			return c
+		}
+		for _, network := range c.networks {
+			if ip != nil && network.Contains(ip) {
+				return c
+			}
+		}
+	}
+	return classes[len(classes)-1]
+}
+
+// addrIP returns the IP address of a network address, or nil if it has none
+func addrIP(addr net.Addr) net.IP {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// admit counts a client connecting from addr, it returns false if the class is full
+func (c *class) admit(addr net.Addr) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	host := addrIP(addr).String()
+	if c.MaxClients != 0 && c.total >= c.MaxClients {
+		return false
+	}
+	if c.MaxPerHost != 0 && c.clients[host] >= c.MaxPerHost {
+		return false
+	}
+	c.total++
+	c.clients[host]++
+	return true
+}
+
+// release stops counting a client that disconnected
+func (c *class) release(addr net.Addr) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	host := addrIP(addr).String()
+	c.total--
+	c.clients[host]--
+	if c.clients[host] == 0 {
+		delete(c.clients, host)
+	}
+}
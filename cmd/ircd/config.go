@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	"github.com/JustinJudd/irc"
+)
+
+// Config is the configuration file of the daemon
+type Config struct {
+	Server    ServerSection    `yaml:"server" toml:"server"`
+	Listeners []ListenerConfig `yaml:"listeners" toml:"listeners"`
+	Opers     []OperConfig     `yaml:"opers" toml:"opers"`
+	Limits    LimitsConfig     `yaml:"limits" toml:"limits"`
+	Classes   []ClassConfig    `yaml:"classes" toml:"classes"`
+}
+
+// ServerSection describes the server itself
+type ServerSection struct {
+	Name     string `yaml:"name" toml:"name"`
+	Network  string `yaml:"network" toml:"network"`
+	Info     string `yaml:"info" toml:"info"`
+	Password string `yaml:"password" toml:"password"` // Password clients have to send with PASS, none if empty
+	MOTDFile string `yaml:"motd_file" toml:"motd_file"`
+}
+
+// ListenerConfig is an address the server accepts connections on, with TLS if a certificate is given
+type ListenerConfig struct {
+	Network       string `yaml:"network" toml:"network"` // tcp, tcp4, tcp6 or unix, defaults to tcp
+	Address       string `yaml:"address" toml:"address"` // Path of the socket for unix listeners
+	TLSCert       string `yaml:"tls_cert" toml:"tls_cert"`
+	TLSKey        string `yaml:"tls_key" toml:"tls_key"`
+	ProxyProtocol bool   `yaml:"proxy_protocol" toml:"proxy_protocol"` // Connections come from a proxy sending a PROXY protocol header
+	Class         string `yaml:"class" toml:"class"`                   // Class of every client of the listener, instead of the class matching its address
+}
+
+// OperConfig is a server operator that can log in with OPER
+type OperConfig struct {
+	Name     string `yaml:"name" toml:"name"`
+	Password string `yaml:"password" toml:"password"`
+}
+
+// LimitsConfig overrides the limits of the server, zero values keep the defaults of the library
+type LimitsConfig struct {
+	NickLength        int `yaml:"nick_length" toml:"nick_length"`
+	ChannelLength     int `yaml:"channel_length" toml:"channel_length"`
+	TopicLength       int `yaml:"topic_length" toml:"topic_length"`
+	MonitorLimit      int `yaml:"monitor" toml:"monitor"`
+	ChatHistoryLimit  int `yaml:"chathistory" toml:"chathistory"`
+	MultilineMaxBytes int `yaml:"multiline_max_bytes" toml:"multiline_max_bytes"`
+	MultilineMaxLines int `yaml:"multiline_max_lines" toml:"multiline_max_lines"`
+	SendQ             int `yaml:"sendq" toml:"sendq"` // Bytes waiting to be written to a client before it is disconnected
+}
+
+// ClassConfig is a connection class limiting the number of clients connecting from a set of networks.
+// A client belongs to the first class whose hosts contain its address, classes without hosts match every address
+type ClassConfig struct {
+	Name       string   `yaml:"name" toml:"name"`
+	Hosts      []string `yaml:"hosts" toml:"hosts"`               // Networks in CIDR notation or single addresses
+	MaxClients int      `yaml:"max_clients" toml:"max_clients"`   // Maximum number of clients of the class, unlimited if 0
+	MaxPerHost int      `yaml:"max_per_host" toml:"max_per_host"` // Maximum number of clients of the class from one address, unlimited if 0
+}
+
+// loadConfig reads a configuration file, its format is chosen by the extension: .yaml, .yml or .toml
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := Config{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &config)
+	case ".toml":
+		err = toml.Unmarshal(data, &config)
+	default:
+		return nil, fmt.Errorf("unknown configuration format %q, use .yaml, .yml or .toml", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(config.Listeners) == 0 {
+		return nil, fmt.Errorf("no listeners configured")
+	}
+	return &config, nil
+}
+
+// serverConfig returns the library configuration of the server
+func (c *Config) serverConfig() (irc.ServerConfig, error) {
+	config := irc.ServerConfig{
+		Name:              c.Server.Name,
+		Network:           c.Server.Network,
+		Info:              c.Server.Info,
+		Password:          c.Server.Password,
+		NickLength:        c.Limits.NickLength,
+		ChannelLength:     c.Limits.ChannelLength,
+		TopicLength:       c.Limits.TopicLength,
+		MonitorLimit:      c.Limits.MonitorLimit,
+		ChatHistoryLimit:  c.Limits.ChatHistoryLimit,
+		MultilineMaxBytes: c.Limits.MultilineMaxBytes,
+		MultilineMaxLines: c.Limits.MultilineMaxLines,
+		SendQ:             c.Limits.SendQ,
+	}
+	motd, err := c.motd()
+	config.MOTD = motd
+	return config, err
+}
+
+// motd reads the MOTD file, the MOTD is empty if no file is configured
+func (c *Config) motd() (string, error) {
+	if len(c.Server.MOTDFile) == 0 {
+		return "", nil
+	}
+	data, err := os.ReadFile(c.Server.MOTDFile)
+	return strings.TrimRight(string(data), "\r\n"), err
+}
+
+// operAuth returns the operators that can log in with OPER
+func (c *Config) operAuth() *irc.BasicOperAuthMethod {
+	opers := irc.NewBasicOperAuthMethod()
+	for _, oper := range c.Opers {
+		opers.Add(oper.Name, oper.Password)
+	}
+	return opers
+}
+
+// listen opens the listener, with TLS if a certificate is configured
+func (l ListenerConfig) listen() (*irc.Listener, error) {
+	config := irc.ListenerConfig{Network: l.Network, Addr: l.Address, ProxyProtocol: l.ProxyProtocol, Class: l.Class}
+	if len(l.TLSCert) != 0 {
+		certificate, err := tls.LoadX509KeyPair(l.TLSCert, l.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		config.TLSConfig = &tls.Config{Certificates: []tls.Certificate{certificate}, ClientAuth: tls.RequestClientCert}
+	}
+	return config.Listen()
+}
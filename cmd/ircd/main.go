@@ -0,0 +1,116 @@
+// Command ircd runs an IRC server configured with a YAML or TOML file.
+//
+// Usage:
+//
+//	ircd -config ircd.yaml
+//
+// SIGHUP reloads the MOTD file and the operators from the configuration file, SIGINT and SIGTERM disconnect the clients and stop the server
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/JustinJudd/irc"
+)
+
+// shutdownTimeout is how long clients are given to receive their last messages when the server stops
+const shutdownTimeout = 10 * time.Second
+
+func main() {
+	configPath := flag.String("config", "ircd.yaml", "path of the YAML or TOML configuration file")
+	flag.Parse()
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatalln("Error loading configuration:", err)
+	}
+	serverConfig, err := config.serverConfig()
+	if err != nil {
+		log.Fatalln("Error loading configuration:", err)
+	}
+	classes, err := newClasses(config.Classes)
+	if err != nil {
+		log.Fatalln("Error loading configuration:", err)
+	}
+
+	server := irc.NewServer(serverConfig)
+	server.OperAuthMethod = config.operAuth()
+	server.CommandsMux.RegisterDefaults()
+	server.CommandsMux.Use(irc.RecoverHandler)
+	server.Admit = admit(classes)
+
+	for _, listenerConfig := range config.Listeners {
+		if _, ok := findClass(classes, listenerConfig.Class); len(listenerConfig.Class) != 0 && !ok {
+			log.Fatalln("Error loading configuration: unknown class", listenerConfig.Class)
+		}
+		listener, err := listenerConfig.listen()
+		if err != nil {
+			log.Fatalln("Error starting listener:", err)
+		}
+		log.Println("Listening on", listener.Addr())
+		go func() {
+			if err := server.Serve(context.Background(), listener); !errors.Is(err, irc.ErrServerClosed) {
+				log.Println("Error serving", listener.Addr(), "-", err)
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			reload(server, *configPath)
+			continue
+		}
+		log.Println("Received", sig, "- shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		err := server.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			log.Println("Error shutting down:", err)
+		}
+		return
+	}
+}
+
+// admit returns the Admit hook of the server, turning away clients whose class is full.
+// Clients belong to the class of their listener if it has one, otherwise to the class matching their address
+func admit(classes []*class) func(net.Conn, irc.ListenerConfig) (string, func(), error) {
+	return func(conn net.Conn, listener irc.ListenerConfig) (string, func(), error) {
+		class := matchClass(classes, conn.RemoteAddr())
+		if len(listener.Class) != 0 {
+			class, _ = findClass(classes, listener.Class)
+		}
+		if !class.admit(conn.RemoteAddr()) {
+			return "", nil, errors.New("too many connections in class " + class.Name)
+		}
+		return class.Name, func() { class.release(conn.RemoteAddr()) }, nil
+	}
+}
+
+// reload rereads the MOTD file and the operators of the configuration file
+func reload(server *irc.Server, configPath string) {
+	config, err := loadConfig(configPath)
+	if err != nil {
+		log.Println("Error reloading configuration:", err)
+		return
+	}
+	motd, err := config.motd()
+	if err != nil {
+		log.Println("Error reloading MOTD:", err)
+		return
+	}
+	server.Do(func() { // handlers read the MOTD and operators on the state goroutine
+		server.Config.MOTD = motd
+		server.OperAuthMethod = config.operAuth()
+	})
+	log.Println("Reloaded MOTD and operators")
+}
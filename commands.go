@@ -2,7 +2,7 @@ package irc
 
 import (
 	"fmt"
-	"regexp"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"time"
@@ -52,6 +52,7 @@ func QuitHandler(message *irc.Message, client *Client) {
 	for _, channel := range client.GetChannels() {
 		channel.Quit(client, leavingMessage)
 	}
+	client.propagateQuit(leavingMessage)
 
 	m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERROR, Trailing: "quit"}
 
@@ -59,28 +60,31 @@ func QuitHandler(message *irc.Message, client *Client) {
 	client.Close()
 }
 
-// RegisteredHandler is a CommandHandler middleware to check that a user/client is properly registered
+// RegisteredHandler is a CommandHandler middleware to check that a user/client is properly registered.
+// Commands registered with Registered set in their Command are checked by the CommandsMux already
 func RegisteredHandler(h CommandHandler) CommandHandler {
 	return CommandHandlerFunc(func(message *irc.Message, client *Client) {
-		if client.Registered {
+		if (Command{Registered: true}).allowed(message, client) {
 			h.ServeIRC(message, client)
-		} else {
-			m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_NOTREGISTERED, Trailing: "You have not registered"}
-
-			client.Encode(&m)
 		}
 	})
 }
 
+// RecoverHandler is a CommandHandler middleware to recover from a panic in a handler, logging it instead of crashing the server
+func RecoverHandler(h CommandHandler) CommandHandler {
+	return CommandHandlerFunc(func(message *irc.Message, client *Client) {
+		defer func() {
+			if err := recover(); err != nil {
+				client.Server.logf("Error handling %s command: %v\n%s", message.Command, err, debug.Stack())
+			}
+		}()
+		h.ServeIRC(message, client)
+	})
+}
+
 // PassHandler is a CommandHandler to respond to IRC PASS commands from a client
 // Implemented according to RFC 1459 Section 4.1.1 and RFC 2812 Section 3.1.1
 func PassHandler(message *irc.Message, client *Client) {
-	if len(message.Params) == 0 {
-		m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_NEEDMOREPARAMS, Trailing: "No nickname given"}
-		client.Encode(&m)
-		return
-	}
-
 	if len(client.Nickname) != 0 || len(client.Username) != 0 {
 		m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_ALREADYREGISTRED, Trailing: "Unauthorized command (already registered)"}
 		client.Encode(&m)
@@ -88,6 +92,7 @@ func PassHandler(message *irc.Message, client *Client) {
 	}
 
 	client.Authorized = message.Params[0] == client.Server.Config.Password
+	client.password = message.Params[0]
 
 }
 
@@ -105,28 +110,30 @@ func NickHandler(message *irc.Message, client *Client) {
 	}
 
 	newNickname := message.Params[0]
+	if len(newNickname) > client.Server.Config.NickLength {
+		m = irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_ERRONEUSNICKNAME, Params: []string{newNickname}, Trailing: "Erroneous nickname"}
+		client.Encode(&m)
+		return
+	}
 
-	_, found := client.Server.GetClientByNick(newNickname)
+	existing, found := client.Server.GetClientByNick(newNickname)
+	found = found && existing != client // clients may change the case of their own nickname
 
 	switch {
 	case !client.Authorized:
 		m = irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_PASSWDMISMATCH, Params: []string{newNickname}, Trailing: "Password incorrect"}
 
-	case found: // nickname already in use
-		fmt.Println("Nickname already used")
+	case found, !client.Server.claimNick(client, newNickname): // nickname already in use, here or on another cluster node
 		m = irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_NICKNAMEINUSE, Params: []string{newNickname}, Trailing: "Nickname is already in use"}
 
 	default:
-		if len(client.Nickname) == 0 && len(client.Username) != 0 { // Client is connected now, show MOTD ...
-			client.Nickname = newNickname
-			client.Server.AddClientNick(client)
-			client.Welcome()
-		} else if len(client.Username) != 0 { //change client name
+		if client.Registered { //change client name
 			client.UpdateNick(newNickname)
-			//fmt.Println("Updating client name")
-		} else {
+		} else { // Client is still registering, show MOTD ... once everything is received
+			oldNick := client.Nickname
 			client.Nickname = newNickname
-			client.Server.UpdateClientNick(client, newNickname)
+			client.Server.UpdateClientNick(client, oldNick)
+			client.completeRegistration()
 		}
 	}
 
@@ -148,23 +155,20 @@ func UserHandler(message *irc.Message, client *Client) {
 		return
 	}
 
-	if len(message.Params) != 3 {
-		m = irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_NEEDMOREPARAMS, Trailing: "Not enough parameters"}
-		client.Encode(&m)
-		return
-	}
-
 	name := message.Params[0]
 	username := message.Params[1]
 	hostname := message.Params[2]
 	realName := message.Trailing
+	if len(message.Params) > 3 {
+		realName = message.Params[3]
+	}
 
 	client.Name = name
 	client.Username = username
 	client.Host = hostname
 	client.RealName = realName
 	if len(m.Command) == 0 && len(client.Nickname) != 0 { // Client has finished connecting
-		client.Welcome()
+		client.completeRegistration()
 		return
 	}
 
@@ -196,6 +200,11 @@ func JoinHandler(message *irc.Message, client *Client) {
 		if len(keyList) > i {
 			key = keyList[i]
 		}
+		if len(cName) > client.Server.Config.ChannelLength {
+			m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_BADCHANMASK, Params: []string{client.Nickname, cName}, Trailing: "Bad Channel Mask"}
+			client.Encode(&m)
+			continue
+		}
 		channel, ok := client.Server.GetChannel(cName)
 		if !ok { // Channel doesn't exist  yet
 			channel = NewChannel(client.Server, client)
@@ -218,12 +227,6 @@ func JoinHandler(message *irc.Message, client *Client) {
 // PartHandler is a CommandHandler to respond to IRC PART commands from a client
 // Implemented according to RFC 1459 Section 4.2.2 and RFC 2812 Section 3.2.2
 func PartHandler(message *irc.Message, client *Client) {
-	if len(message.Params) == 0 {
-		m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_NEEDMOREPARAMS, Trailing: "Not enough parameters"}
-		client.Encode(&m)
-		return
-	}
-
 	for _, cName := range message.Params {
 		channel, ok := client.Server.GetChannel(cName)
 		if !ok { // Channel doesn't exist  yet
@@ -243,6 +246,9 @@ func PartHandler(message *irc.Message, client *Client) {
 // PrivMsgHandler is a CommandHandler to respond to IRC PRIVMSG commands from a client
 // Implemented according to RFC 1459 Section 4.4.1 and RFC 2812 Section 3.3.1
 func PrivMsgHandler(message *irc.Message, client *Client) {
+	if client.addMultilineLine(message) { // line of a draft/multiline batch
+		return
+	}
 	if len(message.Params) == 0 {
 		m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_NORECIPIENT, Params: []string{client.Nickname}, Trailing: "No recipient given (PRIVMSG)"}
 		client.Encode(&m)
@@ -262,7 +268,12 @@ func PrivMsgHandler(message *irc.Message, client *Client) {
 	to := message.Params[0]
 	ch, ok := client.Server.GetChannel(to)
 	if ok { // message is to a channel
-		ch.Message(client, message.Trailing)
+		if !ch.CanSend(client) {
+			m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_CANNOTSENDTOCHAN, Params: []string{client.Nickname, ch.Name}, Trailing: "Cannot send to channel"}
+			client.Encode(&m)
+			return
+		}
+		ch.MessageWithTags(client, message.Trailing, client.MessageTags().ClientOnly())
 		return
 
 	}
@@ -270,7 +281,12 @@ func PrivMsgHandler(message *irc.Message, client *Client) {
 	cl, ok := client.Server.GetClientByNick(to)
 	if ok {
 		m := irc.Message{Prefix: client.Prefix, Command: irc.PRIVMSG, Params: []string{cl.Nickname}, Trailing: message.Trailing}
-		cl.Encode(&m)
+		tags := client.Server.stampTags(&m, client.MessageTags().ClientOnly())
+		cl.deliver(&m, tags, false)
+		if client.HasCap(CapEchoMessage) {
+			client.deliver(&m, tags, true)
+		}
+		client.Server.recordDirectHistory(client, cl, &m, tags)
 
 		if cl.HasMode(UserModeAway) {
 			m := irc.Message{Prefix: cl.Server.Prefix, Command: irc.RPL_AWAY, Params: []string{client.Nickname, cl.Nickname}, Trailing: cl.AwayMessage}
@@ -288,6 +304,9 @@ func PrivMsgHandler(message *irc.Message, client *Client) {
 // NoticeHandler is a CommandHandler to respond to IRC NOTICE commands from a client
 // Implemented according to RFC 1459 Section 4.4.2 and RFC 2812 Section 3.3.2
 func NoticeHandler(message *irc.Message, client *Client) {
+	if client.addMultilineLine(message) { // line of a draft/multiline batch
+		return
+	}
 	if len(message.Params) == 0 {
 		m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_NORECIPIENT, Params: []string{client.Nickname}, Trailing: "No recipient given (PRIVMSG)"}
 		client.Encode(&m)
@@ -307,7 +326,10 @@ func NoticeHandler(message *irc.Message, client *Client) {
 	to := message.Params[0]
 	ch, ok := client.Server.GetChannel(to)
 	if ok { // message is to a channel
-		ch.Notice(client, message.Trailing)
+		if !ch.CanSend(client) { // NOTICEs are never answered with errors
+			return
+		}
+		ch.NoticeWithTags(client, message.Trailing, client.MessageTags().ClientOnly())
 		return
 
 	}
@@ -315,7 +337,12 @@ func NoticeHandler(message *irc.Message, client *Client) {
 	cl, ok := client.Server.GetClientByNick(to)
 	if ok {
 		m := irc.Message{Prefix: client.Prefix, Command: irc.NOTICE, Params: []string{cl.Nickname}, Trailing: message.Trailing}
-		cl.Encode(&m)
+		tags := client.Server.stampTags(&m, client.MessageTags().ClientOnly())
+		cl.deliver(&m, tags, false)
+		if client.HasCap(CapEchoMessage) {
+			client.deliver(&m, tags, true)
+		}
+		client.Server.recordDirectHistory(client, cl, &m, tags)
 		return
 	}
 
@@ -327,6 +354,9 @@ func NoticeHandler(message *irc.Message, client *Client) {
 // WhoHandler is a CommandHandler to respond to IRC WHO commands from a client
 // Implemented according to RFC 1459 Section 4.5.1 and RFC 2812 Section 3.6.1
 func WhoHandler(message *irc.Message, client *Client) {
+	batch := client.StartBatch(BatchWho)
+	defer batch.End()
+
 	if len(message.Params) == 0 || len(message.Params[0]) == 0 || message.Params[0][0] == '*' {
 		//return listing of all visible users - visible people and people in channels with this client
 		client.Who()
@@ -335,10 +365,8 @@ func WhoHandler(message *irc.Message, client *Client) {
 	}
 	ch, ok := client.Server.GetChannel(message.Params[0])
 	if ok { //Channel exists
-		for clientName := range ch.members {
-			cl, found := client.Server.GetClientByNick(clientName)
-
-			if found && !client.HasMode(UserModeInvisible) {
+		for _, cl := range ch.getMembers() {
+			if !client.HasMode(UserModeInvisible) {
 				msg := whoLine(cl, ch, client.Nickname)
 				m := irc.Message{Prefix: client.Server.Prefix, Command: irc.RPL_WHOREPLY, Params: strings.Fields(msg)}
 				client.Encode(&m)
@@ -352,6 +380,20 @@ func WhoHandler(message *irc.Message, client *Client) {
 			msg := whoLine(cl, nil, client.Nickname)
 			m := irc.Message{Prefix: client.Server.Prefix, Command: irc.RPL_WHOREPLY, Params: strings.Fields(msg)}
 			client.Encode(&m)
+		} else { // Treat it as a mask against all visible users
+			mask := CompileMask(message.Params[0], client.Server.Casefold)
+			operOnly := len(message.Params) > 1 && message.Params[1] == "o"
+			for _, cl := range client.GetVisible() {
+				if operOnly && !cl.HasMode(UserModeOperator) && !cl.HasMode(UserModeLocalOperator) {
+					continue
+				}
+				if !whoMatch(mask, cl) {
+					continue
+				}
+				msg := whoLine(cl, nil, client.Nickname)
+				m := irc.Message{Prefix: client.Server.Prefix, Command: irc.RPL_WHOREPLY, Params: strings.Fields(msg)}
+				client.Encode(&m)
+			}
 		}
 	}
 
@@ -360,6 +402,11 @@ func WhoHandler(message *irc.Message, client *Client) {
 
 }
 
+// whoMatch checks a WHO mask against a client's host, server, real name and nickname - RFC 2812 Section 3.6.1
+func whoMatch(mask *Mask, client *Client) bool {
+	return mask.Match(client.Host) || mask.Match(client.ServerName()) || mask.Match(client.RealName) || mask.Match(client.Nickname)
+}
+
 func whoLine(client *Client, channel *Channel, recipientClient string) string {
 	channelName := "*"
 
@@ -378,21 +425,13 @@ func whoLine(client *Client, channel *Channel, recipientClient string) string {
 		}
 	}
 
-	hopCount := 0 //For now only local clients allowed - no federation
-
-	return fmt.Sprintf("%s %s %s %s %s %s %s%s :%d %s", recipientClient, channelName, client.Name, client.Host, client.Server.Config.Name, client.Nickname, here, opStatus, hopCount, client.RealName)
+	return fmt.Sprintf("%s %s %s %s %s %s %s%s :%d %s", recipientClient, channelName, client.Name, client.Host, client.ServerName(), client.Nickname, here, opStatus, client.HopCount(), client.RealName)
 
 }
 
 // TopicHandler is a CommandHandler to respond to IRC TOPIC commands from a client
 // Implemented according to RFC 1459 Section 4.2.4 and RFC 2812 Section 3.2.4
 func TopicHandler(message *irc.Message, client *Client) {
-	if len(message.Params) == 0 {
-		m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_NEEDMOREPARAMS, Params: []string{client.Nickname}, Trailing: "Not enough parameters"}
-		client.Encode(&m)
-		return
-	}
-
 	channelName := message.Params[0]
 	channel, ok := client.Server.GetChannel(channelName)
 	if !ok || channel.HasMode(ChannelModeSecret) {
@@ -417,6 +456,7 @@ func AwayHandler(message *irc.Message, client *Client) {
 	if len(message.Params) == 0 && len(message.Trailing) == 0 {
 		client.AwayMessage = ""
 		client.RemoveMode(UserModeAway)
+		client.notifyAway()
 		m := irc.Message{Prefix: client.Server.Prefix, Command: irc.RPL_UNAWAY, Params: []string{client.Nickname}, Trailing: "You are no longer marked as being away"}
 		client.Encode(&m)
 		return
@@ -427,6 +467,7 @@ func AwayHandler(message *irc.Message, client *Client) {
 		client.AwayMessage = strings.Join(message.Params, " ")
 	}
 	client.AddMode(UserModeAway)
+	client.notifyAway()
 	m := irc.Message{Prefix: client.Server.Prefix, Command: irc.RPL_NOWAWAY, Params: []string{client.Nickname}, Trailing: "You have been marked as being away"}
 
 	client.Encode(&m)
@@ -437,12 +478,6 @@ func AwayHandler(message *irc.Message, client *Client) {
 // ModeHandler is a CommandHandler to respond to IRC MODE commands from a client
 // Implemented according to RFC 1459 Section 4.2.3 and RFC 2812 Section 3.1.5 and RFC 2811
 func ModeHandler(message *irc.Message, client *Client) {
-	if len(message.Params) == 0 {
-		m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_NEEDMOREPARAMS, Params: []string{client.Nickname}, Trailing: "Not enough parameters"}
-		client.Encode(&m)
-		return
-	}
-
 	id := message.Params[0]
 	_, ok := client.Server.GetChannel(id)
 	if ok {
@@ -456,12 +491,6 @@ func ModeHandler(message *irc.Message, client *Client) {
 // UserModeHandler is a specialized CommandHandler to respond to global or user IRC MODE commands from a client
 // Implemented according to RFC 1459 Section 4.2.3.2 and RFC 2812 Section 3.1.5
 func UserModeHandler(message *irc.Message, client *Client) {
-	if len(message.Params) == 0 {
-		m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_NEEDMOREPARAMS, Params: []string{client.Nickname}, Trailing: "Not enough parameters"}
-		client.Encode(&m)
-		return
-	}
-
 	username := message.Params[0]
 	if username != client.Nickname {
 		m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_USERSDONTMATCH, Params: []string{client.Nickname}, Trailing: "Cannot change mode for other users"}
@@ -490,7 +519,7 @@ func UserModeHandler(message *irc.Message, client *Client) {
 		for _, modeFlag := range modeFlags[1:] {
 			mode := UserMode(modeFlag)
 			_, ok := UserModes[mode]
-			if !ok || mode == UserModeAway { // Away flag should only be set with AWAY command
+			if !ok || mode == UserModeAway || mode == UserModeSecure { // Away flag should only be set with AWAY command, secure flag by the connection
 				m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_UMODEUNKNOWNFLAG, Params: []string{client.Nickname}, Trailing: "Unknown MODE flag"}
 				client.Encode(&m)
 				return
@@ -519,16 +548,12 @@ func UserModeHandler(message *irc.Message, client *Client) {
 
 }
 
+// maxModeParams is how many mode changes with a parameter are allowed per MODE command
+const maxModeParams = 3
+
 // ChannelModeHandler is a specialized CommandHandler to respond to channel IRC MODE commands from a client
 // Implemented according to RFC 1459 Section 4.2.3.1 and RFC 2811
 func ChannelModeHandler(message *irc.Message, client *Client) {
-
-	if len(message.Params) == 0 {
-		m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_NEEDMOREPARAMS, Trailing: "Not enough parameters"}
-		client.Encode(&m)
-		return
-	}
-
 	channelName := message.Params[0]
 	channel, ok := client.Server.GetChannel(channelName)
 	if !ok {
@@ -569,7 +594,7 @@ func ChannelModeHandler(message *irc.Message, client *Client) {
 			mode := needsArgs[0]
 			needsArgs = needsArgs[1:]
 			argsCount++
-			if argsCount > 3 { //Only allow 3 argument based flags per mode command
+			if argsCount > maxModeParams { //Only allow 3 argument based flags per mode command
 				needsArgs = []fullFlag{}
 				break
 			}
@@ -599,54 +624,21 @@ func ChannelModeHandler(message *irc.Message, client *Client) {
 					changes = append(changes, mode)
 				}
 			case ChannelModeKey:
-				channel.SetKey(param)
-				changes = append(changes, mode)
-			case ChannelModeBan, ChannelModeExceptionMask, ChannelModeInvitationMask:
-
-				fillMask := func(mask string) string {
-					p := irc.ParsePrefix(param)
-					if len(p.Name) == 0 {
-						p.Name = "*"
-					}
-					if len(p.User) == 0 {
-						p.User = "*"
-					}
-					if len(p.Host) == 0 {
-						p.Host = "*"
-					}
-
-					return p.String()
+				if mode.ModeModifier == ModeModifierAdd {
+					channel.SetKey(param)
+					changes = append(changes, mode)
+				} else if channel.HasMode(ChannelModeKey) {
+					channel.RemoveMode(ChannelModeKey)
+					changes = append(changes, mode)
 				}
-
-				mask := fillMask(param)
-				switch mode.ChannelMode {
-				case ChannelModeBan:
-					masks := channel.GetBanMasks()
-					_, ok := masks[mask]
-					if !ok {
-						channel.AddBanMask(mask)
-						mode.Param = mask
-						changes = append(changes, mode)
-					}
-
-				case ChannelModeExceptionMask:
-					masks := channel.GetExceptionMasks()
-					_, ok := masks[mask]
-					if !ok {
-						channel.AddExceptionMask(mask)
-						mode.Param = mask
-						changes = append(changes, mode)
-					}
-
-				case ChannelModeInvitationMask:
-					masks := channel.GetInvitationMasks()
-					_, ok := masks[mask]
-					if !ok {
-						channel.AddInvitationMask(mask)
-						mode.Param = mask
+			case ChannelModeBan, ChannelModeExceptionMask, ChannelModeInvitationMask:
+				mode.Param = NormalizeMask(param)
+				if mode.ModeModifier == ModeModifierAdd {
+					if channel.addMask(mode.ChannelMode, mode.Param) {
 						changes = append(changes, mode)
 					}
-
+				} else if channel.removeMask(mode.ChannelMode, mode.Param) {
+					changes = append(changes, mode)
 				}
 
 			}
@@ -664,15 +656,21 @@ func ChannelModeHandler(message *irc.Message, client *Client) {
 
 				}
 				flag := ChannelMode(char)
-				switch flag {
-				case ChannelModeVoice, ChannelModeOperator, ChannelModeExceptionMask, ChannelModeInvitationMask, ChannelModeBan, ChannelModeLimit:
+				modeType, ok := ChannelModes[flag]
+				switch {
+				case !ok:
+					m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_UNKNOWNMODE, Params: []string{client.Nickname, string(flag)}, Trailing: "is unknown mode char to me for " + channel.Name}
+					client.Encode(&m)
+				case modeType == ChannelModeTypeList, modeType == ChannelModeTypeParam, modeType == ChannelModeTypeMember:
 					needsArgs = append(needsArgs, fullFlag{modifier, flag, ""})
-				case ChannelModeKey:
+				case modeType == ChannelModeTypeSetParam:
 					if modifier == ModeModifierAdd {
 						needsArgs = append(needsArgs, fullFlag{modifier, flag, ""})
+					} else if channel.HasMode(flag) {
+						channel.RemoveMode(flag)
+						changes = append(changes, fullFlag{modifier, flag, ""})
 					}
-				case ChannelModeAnonymous, ChannelModeInviteOnly, ChannelModeModerated, ChannelModeNoOutsideMessages,
-					ChannelModePrivate, ChannelModeSecret, ChannelModeQuiet, ChannelModeReOp, ChannelModeTopic:
+				case modeType == ChannelModeTypeFlag:
 
 					if flag == ChannelModeAnonymous {
 						switch channel.Name[0] {
@@ -710,9 +708,6 @@ func ChannelModeHandler(message *irc.Message, client *Client) {
 							changes = append(changes, fullFlag{modifier, flag, ""})
 						}
 					}
-				default:
-					m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_UNKNOWNMODE, Params: []string{client.Nickname, string(flag)}, Trailing: "is unknown mode char to me for " + channel.Name}
-					client.Encode(&m)
 				}
 			}
 
@@ -728,9 +723,7 @@ func ChannelModeHandler(message *irc.Message, client *Client) {
 			switch arg.ChannelMode {
 			case ChannelModeBan:
 				m.Command = irc.RPL_BANLIST
-				for mask := range channel.GetBanMasks() {
-					p := irc.ParsePrefix(mask)
-					fmt.Println("New BanMask: ", p.String())
+				for _, mask := range channel.GetBanMasks().Masks() {
 					m.Params = []string{client.Nickname, channel.Name, mask}
 
 					client.Encode(&m)
@@ -743,7 +736,7 @@ func ChannelModeHandler(message *irc.Message, client *Client) {
 			case ChannelModeExceptionMask:
 				m.Command = irc.RPL_EXCEPTLIST
 
-				for mask := range channel.GetExceptionMasks() {
+				for _, mask := range channel.GetExceptionMasks().Masks() {
 					m.Params = []string{client.Nickname, channel.Name, mask}
 
 					client.Encode(&m)
@@ -756,7 +749,7 @@ func ChannelModeHandler(message *irc.Message, client *Client) {
 
 			case ChannelModeInvitationMask:
 				m.Command = irc.RPL_INVITELIST
-				for mask := range channel.GetInvitationMasks() {
+				for _, mask := range channel.GetInvitationMasks().Masks() {
 					m.Params = []string{client.Nickname, channel.Name, mask}
 
 					client.Encode(&m)
@@ -790,28 +783,33 @@ func ChannelModeHandler(message *irc.Message, client *Client) {
 	params := []string{channel.Name, changeString}
 	params = append(params, paramsChanged...)
 	m := irc.Message{Prefix: client.Prefix, Command: irc.MODE, Params: params}
+	channel.shareState()
 
 	// Notify channel members of channel changes
 	channel.SendMessage(&m)
+	client.Server.propagate(&m, client.route())
 	return
 }
 
 // NamesHandler is a specialized CommandHandler to respond to channel IRC NAMES commands from a client
 // Implemented according to RFC 1459 Section 4.2.5 and RFC 2812 Section 3.2.5
 func NamesHandler(message *irc.Message, client *Client) {
+	batch := client.StartBatch(BatchNames)
+	defer batch.End()
+
 	if len(message.Params) == 0 { // Send NAMES response for all channels
 
 		named := map[string]interface{}{}
-		for _, ch := range client.Server.channels {
+		for _, ch := range client.Server.getChannels() {
 			n := ch.Names(client)
 			for _, k := range n {
-				named[k] = nil
+				named[client.Server.Casefold(k)] = nil
 			}
 		}
 		count := 0
 		memberStr := ""
-		for n, cl := range client.Server.clientsByNick {
-			_, alreadyNamed := named[n]
+		for _, cl := range client.Server.getUsers() {
+			_, alreadyNamed := named[client.Server.Casefold(cl.Nickname)]
 			if !alreadyNamed && !cl.HasMode(UserModeInvisible) { //don't name people that are already named or that shouldn't be named
 				count++
 				if cl != nil {
@@ -868,11 +866,13 @@ func ListHandler(message *irc.Message, client *Client) {
 	client.Encode(&m)
 	*/
 
+	batch := client.StartBatch(BatchList)
+	defer batch.End()
+
 	if len(message.Params) == 0 || len(message.Params[0]) == 0 { // Send LIST response for all channels
-		for _, ch := range client.Server.channels {
+		for _, ch := range client.Server.getChannels() {
 			m := ch.ListMessage(client)
 			if m != nil {
-				fmt.Println(m.String())
 				client.Encode(m)
 			}
 
@@ -884,7 +884,6 @@ func ListHandler(message *irc.Message, client *Client) {
 			if ok {
 				m := ch.ListMessage(client)
 				if m != nil {
-					fmt.Println(m.String())
 					client.Encode(m)
 				}
 			}
@@ -898,11 +897,6 @@ func ListHandler(message *irc.Message, client *Client) {
 // KickHandler is a specialized CommandHandler to respond to channel IRC KICK commands from a client
 // Implemented according to RFC 1459 Section 4.2.8 and RFC 2812 Section 3.2.8
 func KickHandler(message *irc.Message, client *Client) {
-	if len(message.Params) == 0 {
-		m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_NEEDMOREPARAMS, Trailing: "Not enough parameters"}
-		client.Encode(&m)
-		return
-	}
 	channels := strings.Split(message.Params[0], ",")
 	nicks := strings.Split(message.Params[1], ",")
 	if len(channels) != 1 && len(channels) != len(nicks) {
@@ -939,9 +933,7 @@ func KickHandler(message *irc.Message, client *Client) {
 // TimeHandler is a specialized CommandHandler to respond to channel IRC TIME commands from a client
 // Implemented according to RFC 1459 Section 4.3.4 and RFC 2812 Section 3.4.6
 func TimeHandler(message *irc.Message, client *Client) {
-	if len(message.Params) != 0 {
-		m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_NOSUCHSERVER, Params: []string{client.Nickname, message.Params[0]}, Trailing: "No such server"}
-		client.Encode(&m)
+	if client.Server.routeQuery(message, client) {
 		return
 	}
 
@@ -952,9 +944,7 @@ func TimeHandler(message *irc.Message, client *Client) {
 // VersionHandler is a specialized CommandHandler to respond to channel IRC VERSION commands from a client
 // Implemented according to RFC 1459 Section 4.3.1 and RFC 2812 Section 3.4.3
 func VersionHandler(message *irc.Message, client *Client) {
-	if len(message.Params) != 0 {
-		m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_NOSUCHSERVER, Params: []string{client.Nickname, message.Params[0]}, Trailing: "No such server"}
-		client.Encode(&m)
+	if client.Server.routeQuery(message, client) {
 		return
 	}
 
@@ -966,22 +956,33 @@ func VersionHandler(message *irc.Message, client *Client) {
 // LinksHandler is a specialized CommandHandler to respond to channel IRC LINKS commands from a client
 // Implemented according to RFC 1459 Section 4.3.3 and RFC 2812 Section 3.4.5
 func LinksHandler(message *irc.Message, client *Client) {
-	if len(message.Params) == 2 {
-		m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_NOSUCHSERVER, Params: []string{client.Nickname, message.Params[0]}, Trailing: "No such server"}
-		client.Encode(&m)
-		return
-	}
-
+	s := client.Server
 	mask := "*"
-	if len(message.Params) != 0 {
+	switch len(message.Params) {
+	case 0:
+	case 1:
 		mask = message.Params[0]
+	default: // Every server knows the whole network, so the answer is the same whichever server is asked
+		_, ok := s.getServer(message.Params[0])
+		if !ok && !CompileMask(message.Params[0], strings.ToLower).Match(s.Config.Name) {
+			m := irc.Message{Prefix: s.Prefix, Command: irc.ERR_NOSUCHSERVER, Params: []string{client.Nickname, message.Params[0]}, Trailing: "No such server"}
+			client.Encode(&m)
+			return
+		}
+		mask = message.Params[1]
 	}
-	regMask := strings.Replace(mask, "*", ".*", -1)
-	ok, err := regexp.MatchString(regMask, client.Server.Config.Name)
-	if ok && err == nil {
-		m := irc.Message{Prefix: client.Server.Prefix, Command: irc.RPL_LINKS, Params: []string{client.Nickname, mask, client.Server.Config.Name}, Trailing: "0"}
+
+	compiled := CompileMask(mask, strings.ToLower)
+	if compiled.Match(s.Config.Name) {
+		m := irc.Message{Prefix: s.Prefix, Command: irc.RPL_LINKS, Params: []string{client.Nickname, s.Config.Name, s.Config.Name}, Trailing: "0 " + s.Config.Info}
 		client.Encode(&m)
 	}
+	for _, rs := range s.GetServers() {
+		if compiled.Match(rs.Name) {
+			m := irc.Message{Prefix: s.Prefix, Command: irc.RPL_LINKS, Params: []string{client.Nickname, rs.Name, rs.Uplink}, Trailing: strconv.Itoa(rs.Hops) + " " + rs.Info}
+			client.Encode(&m)
+		}
+	}
 	m := irc.Message{Prefix: client.Server.Prefix, Command: irc.RPL_ENDOFLINKS, Params: []string{client.Nickname, mask}, Trailing: "End of LINKS list"}
 	client.Encode(&m)
 }
@@ -989,11 +990,6 @@ func LinksHandler(message *irc.Message, client *Client) {
 // InviteHandler is a specialized CommandHandler to respond to channel IRC INVITE commands from a client
 // Implemented according to RFC 1459 Section 4.2.7 and RFC 2812 Section 3.2.7
 func InviteHandler(message *irc.Message, client *Client) {
-	if len(message.Params) != 2 {
-		m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_NEEDMOREPARAMS, Params: []string{client.Nickname}, Trailing: "Not enough parameters"}
-		client.Encode(&m)
-		return
-	}
 	nick := message.Params[0]
 	channelName := message.Params[1]
 	cl, ok := client.Server.GetClientByNick(nick)
@@ -1005,7 +1001,7 @@ func InviteHandler(message *irc.Message, client *Client) {
 
 	channel, ok := client.Server.GetChannel(channelName)
 	if !ok { //channel doesn't exist, send invite
-		SendInvite(client, cl, channel)
+		SendInvite(client, cl, &Channel{Name: channelName, Server: client.Server})
 		return
 	}
 
@@ -1027,8 +1023,8 @@ func InviteHandler(message *irc.Message, client *Client) {
 			client.Encode(&m)
 			return
 		}
-		channel.AddInvitationMask(cl.Prefix.String())
 	}
+	channel.AddInvite(cl)
 
 	SendInvite(client, cl, channel)
 
@@ -1039,7 +1035,16 @@ func SendInvite(inviter *Client, invitee *Client, channel *Channel) {
 	m := irc.Message{Prefix: inviter.Server.Prefix, Command: irc.RPL_INVITING, Params: []string{inviter.Nickname, channel.Name, invitee.Nickname}}
 	inviter.Encode(&m)
 	m.Params[0] = invitee.Nickname
-	invitee.Encode(&m)
+	invitee.Relay(&m, nil)
+
+	// Tell channel members that enabled invite-notify
+	notify := irc.Message{Prefix: inviter.Prefix, Command: irc.INVITE, Params: []string{invitee.Nickname, channel.Name}}
+	tags := inviter.Server.stampTags(&notify, nil)
+	for _, member := range channel.getMembers() {
+		if member != inviter && member != invitee && member.HasCap(CapInviteNotify) {
+			member.Relay(&notify, tags)
+		}
+	}
 
 	if invitee.HasMode(UserModeAway) {
 		m := irc.Message{Prefix: inviter.Server.Prefix, Command: irc.RPL_AWAY, Params: []string{inviter.Nickname, invitee.Nickname}, Trailing: invitee.AwayMessage}
@@ -1051,15 +1056,11 @@ func SendInvite(inviter *Client, invitee *Client, channel *Channel) {
 // IsonHandler is a specialized CommandHandler to respond to channel IRC ISON commands from a client
 // Implemented according to RFC 1459 Section 5.8 and RFC 2812 Section 4.9
 func IsonHandler(message *irc.Message, client *Client) {
-	if len(message.Params) == 0 && len(message.Trailing) == 0 {
-		m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_NEEDMOREPARAMS, Params: []string{client.Nickname}, Trailing: "Not enough parameters"}
-		client.Encode(&m)
-		return
-	}
-	nicks := message.Params
-	if len(nicks) == 0 {
-		nicks = strings.Split(message.Trailing, " ")
+	nicks := []string{}
+	for _, param := range message.Params {
+		nicks = append(nicks, strings.Fields(param)...)
 	}
+	nicks = append(nicks, strings.Fields(message.Trailing)...)
 	found := []string{}
 	for _, nick := range nicks {
 		_, ok := client.Server.GetClientByNick(nick)
@@ -1075,11 +1076,5 @@ func IsonHandler(message *irc.Message, client *Client) {
 // OperHandler is a specialized CommandHandler to respond to channel IRC OPER commands from a client
 // Implemented according to RFC 1459 Section 4.1.5 and RFC 2812 Section 3.1.4
 func OperHandler(message *irc.Message, client *Client) {
-	if len(message.Params) < 2 {
-		m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_NEEDMOREPARAMS, Params: []string{client.Nickname}, Trailing: "Not enough parameters"}
-		client.Encode(&m)
-		return
-	}
-
 	client.Server.Authenticate(message.Params[0], message.Params[1], client)
 }
@@ -0,0 +1,259 @@
+package irc
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HistoryEvent is a message recorded in the history of a channel or a direct conversation
+type HistoryEvent struct {
+	Time    time.Time `json:"time"`
+	MsgID   string    `json:"msgid"`
+	Tags    Tags      `json:"tags,omitempty"` // Tags the message was relayed with, including time, msgid and account
+	Message string    `json:"message"`        // Message line without tags
+
+	// From and To are the casefolded accounts of the sender and the recipient of a direct message,
+	// only clients logged in to one of them may read it
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+}
+
+// HistoryTarget is a target with recorded history and the time of its latest event
+type HistoryTarget struct {
+	Target string
+	Latest time.Time
+}
+
+// HistoryStore is an interface for storing and querying message history.
+// Targets are casefolded channel names, or the casefolded nicknames of both users of a direct conversation joined by a comma
+type HistoryStore interface {
+	// Add records an event for a target. Events are added in the order they happened
+	Add(target string, event HistoryEvent) error
+	// Get returns the event of a target with the given msgid, if not found ok will be false
+	Get(target string, msgid string) (event HistoryEvent, ok bool)
+	// Before returns up to limit of the latest events of a target that happened before t, oldest first
+	Before(target string, t time.Time, limit int) []HistoryEvent
+	// After returns up to limit of the earliest events of a target that happened after t, oldest first
+	After(target string, t time.Time, limit int) []HistoryEvent
+	// Targets returns the targets whose latest event happened between start and end, oldest first
+	Targets(start time.Time, end time.Time) []HistoryTarget
+}
+
+// historyRing is a ring buffer of the events of a single target
+type historyRing struct {
+	events []HistoryEvent
+	start  int
+}
+
+// add appends an event, overwriting the oldest one once the ring holds size events. A size of 0 keeps all events
+func (r *historyRing) add(event HistoryEvent, size int) {
+	if size <= 0 || len(r.events) < size {
+		r.events = append(r.events, event)
+		return
+	}
+	r.events[r.start] = event
+	r.start = (r.start + 1) % len(r.events)
+}
+
+// at returns the i-th oldest event
+func (r *historyRing) at(i int) HistoryEvent {
+	return r.events[(r.start+i)%len(r.events)]
+}
+
+// search returns the index of the first event that happened after t, or at t if inclusive is set
+func (r *historyRing) search(t time.Time, inclusive bool) int {
+	return sort.Search(len(r.events), func(i int) bool {
+		eventTime := r.at(i).Time
+		return eventTime.After(t) || (inclusive && eventTime.Equal(t))
+	})
+}
+
+// slice returns the events from index start up to but not including end
+func (r *historyRing) slice(start int, end int) []HistoryEvent {
+	events := make([]HistoryEvent, 0, end-start)
+	for i := start; i < end; i++ {
+		events = append(events, r.at(i))
+	}
+	return events
+}
+
+// MemoryHistoryStore is a HistoryStore keeping the latest events of each target in memory
+type MemoryHistoryStore struct {
+	size    int
+	targets map[string]*historyRing
+	mutex   sync.RWMutex
+}
+
+// NewMemoryHistoryStore creates and returns a new MemoryHistoryStore keeping up to size events per target, or all events if size is 0
+func NewMemoryHistoryStore(size int) *MemoryHistoryStore {
+	m := MemoryHistoryStore{}
+	m.size = size
+	m.targets = map[string]*historyRing{}
+	return &m
+}
+
+// Add records an event for a target
+func (m *MemoryHistoryStore) Add(target string, event HistoryEvent) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	ring, ok := m.targets[target]
+	if !ok {
+		ring = &historyRing{}
+		m.targets[target] = ring
+	}
+	ring.add(event, m.size)
+	return nil
+}
+
+// Get returns the event of a target with the given msgid
+func (m *MemoryHistoryStore) Get(target string, msgid string) (event HistoryEvent, ok bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	ring, found := m.targets[target]
+	if !found {
+		return
+	}
+	for i := len(ring.events) - 1; i >= 0; i-- { // Recent events are the most likely to be asked for
+		if e := ring.at(i); e.MsgID == msgid {
+			return e, true
+		}
+	}
+	return
+}
+
+// Before returns up to limit of the latest events of a target that happened before t
+func (m *MemoryHistoryStore) Before(target string, t time.Time, limit int) []HistoryEvent {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	ring, ok := m.targets[target]
+	if !ok {
+		return nil
+	}
+	end := ring.search(t, true)
+	start := end - limit
+	if start < 0 {
+		start = 0
+	}
+	return ring.slice(start, end)
+}
+
+// After returns up to limit of the earliest events of a target that happened after t
+func (m *MemoryHistoryStore) After(target string, t time.Time, limit int) []HistoryEvent {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	ring, ok := m.targets[target]
+	if !ok {
+		return nil
+	}
+	start := ring.search(t, false)
+	end := start + limit
+	if end > len(ring.events) {
+		end = len(ring.events)
+	}
+	return ring.slice(start, end)
+}
+
+// Targets returns the targets whose latest event happened between start and end
+func (m *MemoryHistoryStore) Targets(start time.Time, end time.Time) []HistoryTarget {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	targets := []HistoryTarget{}
+	for target, ring := range m.targets {
+		if len(ring.events) == 0 {
+			continue
+		}
+		latest := ring.at(len(ring.events) - 1).Time
+		if latest.After(start) && latest.Before(end) {
+			targets = append(targets, HistoryTarget{Target: target, Latest: latest})
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].Latest.Before(targets[j].Latest)
+	})
+	return targets
+}
+
+// fileHistoryRecord is a single line of the history file
+type fileHistoryRecord struct {
+	Target string `json:"target"`
+	HistoryEvent
+}
+
+// FileHistoryStore is a HistoryStore that appends every event to a file as a line of JSON.
+// The file is replayed when opened and queries are answered from the latest events kept in memory
+type FileHistoryStore struct {
+	*MemoryHistoryStore
+	file    *os.File
+	encoder *json.Encoder
+	mutex   sync.Mutex
+}
+
+// NewFileHistoryStore opens or creates the history file at path, keeping up to size events per target in memory for queries
+func NewFileHistoryStore(path string, size int) (*FileHistoryStore, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	f := FileHistoryStore{}
+	f.MemoryHistoryStore = NewMemoryHistoryStore(size)
+	f.file = file
+	f.encoder = json.NewEncoder(file)
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record fileHistoryRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil { // Skip lines that were only partly written
+			continue
+		}
+		f.MemoryHistoryStore.Add(record.Target, record.HistoryEvent)
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := endLastLine(file); err != nil { // so the next event isn't appended to a partly written line
+		file.Close()
+		return nil, err
+	}
+	return &f, nil
+}
+
+// endLastLine adds a newline to the end of the file if its last line isn't ended
+func endLastLine(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	last := make([]byte, 1)
+	if _, err := file.ReadAt(last, info.Size()-1); err != nil {
+		return err
+	}
+	if last[0] == '\n' {
+		return nil
+	}
+	_, err = file.Write([]byte{'\n'})
+	return err
+}
+
+// Add appends an event for a target to the history file
+func (f *FileHistoryStore) Add(target string, event HistoryEvent) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.encoder.Encode(fileHistoryRecord{Target: target, HistoryEvent: event}); err != nil {
+		return err
+	}
+	return f.MemoryHistoryStore.Add(target, event)
+}
+
+// Close closes the history file
+func (f *FileHistoryStore) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.file.Close()
+}
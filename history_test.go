@@ -0,0 +1,165 @@
+package irc
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// historyEvents returns count events one second apart starting at start, with the msgids and messages m0, m1...
+func historyEvents(start time.Time, count int) []HistoryEvent {
+	events := []HistoryEvent{}
+	for i := 0; i < count; i++ {
+		id := "m" + strconv.Itoa(i)
+		events = append(events, HistoryEvent{Time: start.Add(time.Duration(i) * time.Second), MsgID: id, Message: "PRIVMSG #c :" + id})
+	}
+	return events
+}
+
+// msgIDs returns the msgids of the events
+func msgIDs(events []HistoryEvent) string {
+	ids := []string{}
+	for _, event := range events {
+		ids = append(ids, event.MsgID)
+	}
+	return strings.Join(ids, " ")
+}
+
+func TestMemoryHistoryStore(t *testing.T) {
+	store := NewMemoryHistoryStore(4)
+	start := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	events := historyEvents(start, 6)
+	for _, event := range events {
+		store.Add("#c", event)
+	}
+	store.Add("#d", HistoryEvent{Time: start.Add(time.Minute), MsgID: "d"})
+
+	if _, ok := store.Get("#c", "m1"); ok {
+		t.Error("m1 should have been dropped from the ring")
+	}
+	if event, ok := store.Get("#c", "m3"); !ok || !event.Time.Equal(events[3].Time) {
+		t.Errorf("Get m3 = %v, %v", event, ok)
+	}
+	if ids := msgIDs(store.Before("#c", events[5].Time, 2)); ids != "m3 m4" {
+		t.Errorf("Before m5 = %s", ids)
+	}
+	if ids := msgIDs(store.After("#c", events[2].Time, 10)); ids != "m3 m4 m5" {
+		t.Errorf("After m2 = %s", ids)
+	}
+	targets := store.Targets(start, start.Add(time.Hour))
+	if len(targets) != 2 || targets[0].Target != "#c" || targets[1].Target != "#d" {
+		t.Errorf("Targets = %v", targets)
+	}
+}
+
+func TestFileHistoryStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.json")
+	store, err := NewFileHistoryStore(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	events := historyEvents(start, 3)
+	for _, event := range events[:2] {
+		if err := store.Add("#c", event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"target":"#c","msgid":"partly wri`) // left by a crash while writing
+	file.Close()
+
+	store, err = NewFileHistoryStore(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if ids := msgIDs(store.After("#c", start.Add(-time.Second), 10)); ids != "m0 m1" {
+		t.Fatalf("reopened history is %s", ids)
+	}
+	if err := store.Add("#c", events[2]); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	store, err = NewFileHistoryStore(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event, ok := store.Get("#c", "m2"); !ok || event.Message != "PRIVMSG #c :m2" {
+		t.Errorf("event added after reopening = %v, %v", event, ok)
+	}
+}
+
+// historyReply returns the text of the messages of the chathistory batch sent to the client
+func historyReply(c *testClient) string {
+	c.expect("BATCH +", "chathistory")
+	texts := []string{}
+	for {
+		line := c.expect(" ")
+		if strings.Contains(line, "BATCH -") {
+			return strings.Join(texts, " ")
+		}
+		texts = append(texts, line[strings.LastIndex(line, ":")+1:])
+	}
+}
+
+func TestChatHistory(t *testing.T) {
+	s := newTestServer(ServerConfig{Name: "irc.test"})
+	s.SetHistoryStore(NewMemoryHistoryStore(100))
+	alice := connectClient(t, s, "alice")
+	bob := connectClient(t, s, "bob")
+	bob.send("CAP REQ :batch message-tags draft/chathistory")
+	bob.expect("ACK")
+	alice.send("JOIN #c")
+	alice.expect("JOIN #c")
+	bob.send("JOIN #c")
+	bob.expect("JOIN #c")
+
+	ids := []string{}
+	for i := 0; i < 5; i++ {
+		alice.send("PRIVMSG #c :msg" + strconv.Itoa(i))
+		raw, _ := splitTags(bob.expect("PRIVMSG #c :msg" + strconv.Itoa(i)))
+		ids = append(ids, ParseTags(raw)["msgid"])
+	}
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"LATEST #c * 2", "msg3 msg4"},
+		{"LATEST #c msgid=" + ids[2] + " 10", "msg3 msg4"},
+		{"BEFORE #c msgid=" + ids[2] + " 10", "msg0 msg1"},
+		{"AFTER #c msgid=" + ids[2] + " 1", "msg3"},
+		{"AROUND #c msgid=" + ids[2] + " 3", "msg1 msg2 msg3"},
+		{"BETWEEN #c msgid=" + ids[0] + " msgid=" + ids[4] + " 10", "msg1 msg2 msg3"},
+		{"BETWEEN #c msgid=" + ids[4] + " msgid=" + ids[0] + " 10", "msg1 msg2 msg3"},
+	}
+	for _, test := range tests {
+		bob.send("CHATHISTORY " + test.command)
+		if got := historyReply(bob); got != test.want {
+			t.Errorf("CHATHISTORY %s = %q, want %q", test.command, got, test.want)
+		}
+	}
+
+	bob.send("CHATHISTORY TARGETS timestamp=2000-01-01T00:00:00.000Z timestamp=2100-01-01T00:00:00.000Z 10")
+	bob.expect("BATCH +", "draft/chathistory-targets")
+	bob.expect("CHATHISTORY TARGETS #c ")
+
+	carol := connectClient(t, s, "carol")
+	carol.send("CHATHISTORY LATEST #c * 10")
+	carol.expect("FAIL CHATHISTORY INVALID_TARGET LATEST #c ")
+	bob.send("CHATHISTORY LATEST #c * none")
+	bob.expect("FAIL CHATHISTORY INVALID_PARAMS LATEST none ")
+	bob.send("CHATHISTORY BEFORE #c msgid=unknown 10")
+	bob.expect("FAIL CHATHISTORY INVALID_PARAMS BEFORE msgid=unknown ")
+	bob.send("CHATHISTORY SOMETIME #c")
+	bob.expect("FAIL CHATHISTORY INVALID_PARAMS SOMETIME ")
+}
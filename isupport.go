@@ -0,0 +1,134 @@
+package irc
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxISupportTokens is how many tokens are sent per RPL_ISUPPORT message
+const maxISupportTokens = 13
+
+// ISupport holds the tokens advertised to clients with RPL_ISUPPORT
+type ISupport struct {
+	tokens map[string]string
+	mutex  sync.RWMutex
+}
+
+// NewISupport creates and returns a new, empty ISupport
+func NewISupport() *ISupport {
+	i := ISupport{}
+	i.tokens = map[string]string{}
+	return &i
+}
+
+// Set adds or replaces a token. An empty value advertises the token without a value
+func (i *ISupport) Set(name string, value string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.tokens[strings.ToUpper(name)] = value
+}
+
+// Remove stops advertising a token
+func (i *ISupport) Remove(name string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	delete(i.tokens, strings.ToUpper(name))
+}
+
+// Get returns the value of a token, if not advertised ok will be false
+func (i *ISupport) Get(name string) (value string, ok bool) {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	value, ok = i.tokens[strings.ToUpper(name)]
+	return
+}
+
+// Tokens returns all tokens formatted for RPL_ISUPPORT, sorted by name
+func (i *ISupport) Tokens() []string {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	tokens := make([]string, 0, len(i.tokens))
+	for name, value := range i.tokens {
+		if len(value) == 0 {
+			tokens = append(tokens, name)
+			continue
+		}
+		tokens = append(tokens, name+"="+value)
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
+// Lines splits the tokens into groups that each fit in a single RPL_ISUPPORT message
+func (i *ISupport) Lines() [][]string {
+	tokens := i.Tokens()
+	lines := [][]string{}
+	for len(tokens) > maxISupportTokens {
+		lines = append(lines, tokens[:maxISupportTokens])
+		tokens = tokens[maxISupportTokens:]
+	}
+	if len(tokens) != 0 {
+		lines = append(lines, tokens)
+	}
+	return lines
+}
+
+// newServerISupport builds the default ISUPPORT tokens from the server configuration
+func newServerISupport(s *Server) *ISupport {
+	i := NewISupport()
+	i.Set("CASEMAPPING", s.Config.CaseMapping.Name)
+	i.Set("CHANTYPES", chanTypes())
+	i.Set("CHANMODES", chanModes())
+	i.Set("PREFIX", prefixes())
+	i.Set("EXCEPTS", string(ChannelModeExceptionMask))
+	i.Set("INVEX", string(ChannelModeInvitationMask))
+	i.Set("MODES", strconv.Itoa(maxModeParams))
+	i.Set("NICKLEN", strconv.Itoa(s.Config.NickLength))
+	i.Set("CHANNELLEN", strconv.Itoa(s.Config.ChannelLength))
+	i.Set("TOPICLEN", strconv.Itoa(s.Config.TopicLength))
+	i.Set("NETWORK", s.Config.Network)
+	i.Set("MONITOR", strconv.Itoa(s.Config.MonitorLimit))
+	i.Set("TARGMAX", "JOIN:,KICK:,LIST:,NAMES:,NOTICE:1,PRIVMSG:1")
+	return i
+}
+
+// chanTypes returns the supported channel prefixes for the CHANTYPES token
+func chanTypes() string {
+	types := make([]string, 0, len(channelStarters))
+	for starter := range channelStarters {
+		types = append(types, string(starter))
+	}
+	sort.Strings(types)
+	return strings.Join(types, "")
+}
+
+// chanModes returns the supported channel modes grouped for the CHANMODES token
+func chanModes() string {
+	groups := make([][]string, ChannelModeTypeFlag+1)
+	for mode, modeType := range ChannelModes {
+		if modeType > ChannelModeTypeFlag { // Member modes are advertised by PREFIX
+			continue
+		}
+		groups[modeType] = append(groups[modeType], string(mode))
+	}
+	tokens := make([]string, len(groups))
+	for i, group := range groups {
+		sort.Strings(group)
+		tokens[i] = strings.Join(group, "")
+	}
+	return strings.Join(tokens, ",")
+}
+
+// prefixes returns the member modes and their nickname prefixes for the PREFIX token
+func prefixes() string {
+	modes := ""
+	symbols := ""
+	for _, p := range ChannelMemberPrefixes {
+		modes += string(p.ChannelMode)
+		symbols += string(p.Prefix)
+	}
+	return fmt.Sprintf("(%s)%s", modes, symbols)
+}
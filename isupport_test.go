@@ -0,0 +1,53 @@
+package irc
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/sorcix/irc"
+)
+
+func TestISupportLines(t *testing.T) {
+	i := NewISupport()
+	for n := 0; n < 2*maxISupportTokens+1; n++ {
+		i.Set("TOKEN"+strconv.Itoa(n), strconv.Itoa(n))
+	}
+	i.Set("flag", "")
+	lines := i.Lines()
+	if len(lines) != 3 || len(lines[0]) != maxISupportTokens || len(lines[2]) != 2 {
+		t.Fatalf("got lines of %v tokens", lines)
+	}
+	if lines[0][0] != "FLAG" || lines[0][1] != "TOKEN0=0" {
+		t.Errorf("tokens should be upper case and sorted, got %v", lines[0])
+	}
+	i.Remove("FLAG")
+	if _, ok := i.Get("flag"); ok {
+		t.Error("FLAG is still advertised after Remove")
+	}
+}
+
+func TestISupportWelcome(t *testing.T) {
+	s := newTestServer(ServerConfig{Name: "irc.test", Network: "TestNet", NickLength: 12, CaseMapping: CaseMappingASCII})
+	s.ISupport.Set("CUSTOM", "x")
+	c := dialClient(t, s)
+	c.send("NICK alice")
+	c.send("USER user 0 * :alice")
+	tokens := []string{}
+	for {
+		m := c.expectCommand(RPL_ISUPPORT, irc.RPL_ENDOFMOTD, irc.ERR_NOMOTD)
+		if m.Command != RPL_ISUPPORT {
+			break
+		}
+		if m.Params[0] != "alice" || m.Trailing != "are supported by this server" {
+			t.Errorf("malformed RPL_ISUPPORT %v", m)
+		}
+		tokens = append(tokens, m.Params[1:]...)
+	}
+	advertised := strings.Join(tokens, " ")
+	for _, token := range []string{"CASEMAPPING=ascii", "NETWORK=TestNet", "NICKLEN=12", "CUSTOM=x", "PREFIX=(ov)@+", "CHANMODES=Ibe,k,l,aimnpqrst", "CHANTYPES=!#&+"} {
+		if !strings.Contains(advertised, token) {
+			t.Errorf("%s is not advertised in %q", token, advertised)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package irc
+
+import (
+	"github.com/sorcix/irc"
+)
+
+// CapLabeledResponse is the IRCv3 capability for matching replies to the commands that caused them
+const CapLabeledResponse = "labeled-response"
+
+// BatchLabeledResponse is the batch type used for labeled replies with more than one message
+const BatchLabeledResponse = "labeled-response"
+
+// labeledResponse collects the replies to a command sent with a label tag
+type labeledResponse struct {
+	label    string
+	messages []labeledMessage
+	noAck    bool // Set when the reply is sent later, like for the start of a multiline batch
+}
+
+// labeledMessage is a reply waiting to be sent with the label
+type labeledMessage struct {
+	message *irc.Message
+	tags    Tags
+}
+
+// add keeps a copy of a reply, as handlers may reuse the message after sending it
+func (r *labeledResponse) add(m *irc.Message, tags Tags) {
+	message := *m
+	message.Params = append([]string(nil), m.Params...)
+	if m.Prefix != nil {
+		prefix := *m.Prefix
+		message.Prefix = &prefix
+	}
+	r.messages = append(r.messages, labeledMessage{message: &message, tags: tags})
+}
+
+// startLabeledResponse starts collecting the replies to the command being handled if it has a label the client can get back
+func (c *Client) startLabeledResponse() bool {
+	label, ok := c.MessageTags()["label"]
+	if !ok || len(label) == 0 || c.response != nil || !c.HasCap(CapLabeledResponse) {
+		return false
+	}
+	c.response = &labeledResponse{label: label}
+	return true
+}
+
+// finishLabeledResponse sends the collected replies with the label: an ACK if there were none,
+// the reply itself if there was one and a labeled-response batch if there were more
+func (c *Client) finishLabeledResponse() {
+	r := c.response
+	c.response = nil
+	if r == nil {
+		return
+	}
+
+	labeled := func(tags Tags) Tags {
+		t := make(Tags, len(tags)+1)
+		for key, value := range tags {
+			t[key] = value
+		}
+		t["label"] = r.label
+		return t
+	}
+
+	switch {
+	case len(r.messages) == 0:
+		if r.noAck {
+			return
+		}
+		m := irc.Message{Prefix: c.Server.Prefix, Command: ACK}
+		c.Relay(&m, labeled(nil))
+
+	case len(r.messages) == 1:
+		c.Relay(r.messages[0].message, labeled(r.messages[0].tags))
+
+	case !c.HasCap(CapBatch): // Without batches every reply carries the label
+		for _, reply := range r.messages {
+			c.Relay(reply.message, labeled(reply.tags))
+		}
+
+	default:
+		id := newBatchID()
+		m := irc.Message{Prefix: c.Server.Prefix, Command: BATCH, Params: []string{"+" + id, BatchLabeledResponse}}
+		c.Relay(&m, labeled(nil))
+		for _, reply := range r.messages {
+			tags := reply.tags
+			if _, nested := tags["batch"]; !nested { // Messages of nested batches are covered by their own BATCH lines
+				tags = Tags{}
+				for key, value := range reply.tags {
+					tags[key] = value
+				}
+				tags["batch"] = id
+			}
+			c.Relay(reply.message, tags)
+		}
+		m = irc.Message{Prefix: c.Server.Prefix, Command: BATCH, Params: []string{"-" + id}}
+		c.Relay(&m, nil)
+	}
+}
@@ -0,0 +1,48 @@
+package irc
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLabeledResponse(t *testing.T) {
+	s := newTestServer(ServerConfig{Name: "irc.test"})
+	c := connectClient(t, s, "alice")
+	c.send("CAP REQ :labeled-response batch")
+	c.expect("ACK :labeled-response batch")
+	c.send("JOIN #c")
+	c.expect("JOIN #c")
+
+	c.send("@label=none PONG :x")
+	if line := c.expect("label=none"); !strings.HasSuffix(line, " :irc.test ACK") {
+		t.Errorf("a command without replies got %q", line)
+	}
+	c.send("@label=one PING :x")
+	c.expect("@label=one ", " PONG ")
+
+	c.send("@label=many NAMES #c")
+	start := c.expect("@label=many ", "BATCH +", "labeled-response")
+	id := strings.TrimPrefix(strings.Fields(start)[3], "+")
+	c.expect("@batch="+id+" ", "BATCH +", " names") // NAMES replies are a batch nested in the labeled one
+	c.expect(" 353 alice ")
+	c.expect(" 366 alice ")
+	c.expect(":irc.test BATCH -" + id)
+}
+
+func TestLabeledResponseWithoutBatch(t *testing.T) {
+	s := newTestServer(ServerConfig{Name: "irc.test"})
+	c := connectClient(t, s, "alice")
+	c.send("CAP REQ :labeled-response")
+	c.expect("ACK :labeled-response")
+	c.send("JOIN #c")
+	c.expect("JOIN #c")
+	c.send("@label=many NAMES #c") // every reply carries the label
+	c.expect("@label=many ", " 353 alice ")
+	c.expect("@label=many ", " 366 alice ")
+
+	plain := connectClient(t, s, "plain")
+	plain.send("@label=ignored PING :x")
+	if line := plain.expect("PONG"); strings.Contains(line, "label") {
+		t.Errorf("a client without labeled-response got %q", line)
+	}
+}
@@ -0,0 +1,1095 @@
+package irc
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// linkVersion is the protocol version sent with PASS when linking - RFC 2813 Section 4.1.1
+const linkVersion = "0210"
+
+// localToken is the token this server uses for itself in SERVER and NICK messages - RFC 2813 Section 4.1.2
+const localToken = "1"
+
+// errLinkRefused is returned when a server is not configured to be linked with or sent the wrong password
+var errLinkRefused = errors.New("link refused")
+
+// LinkConfig describes a server that may be linked with this one
+type LinkConfig struct {
+	Name     string // Name of the other server
+	Addr     string // Address Connect uses to reach the other server
+	Password string // Password both servers send with PASS
+}
+
+// RemoteServer is a server that is part of the network through a link
+type RemoteServer struct {
+	Name   string
+	Info   string
+	Hops   int    // Number of links between this server and the remote server
+	Uplink string // Name of the server the remote server is connected to
+
+	token string // token this server uses for the remote server
+	link  *Link  // direct link the remote server is reached through
+}
+
+// Link is a direct connection to another server - RFC 2813
+type Link struct {
+	Name   string // Name of the server at the other end
+	Server *Server
+
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// Messages are queued and written by their own goroutine, so two servers sending bursts at once don't block each other
+	queue      [][]byte
+	queueMutex sync.Mutex
+	queued     chan struct{}
+	done       chan struct{}
+	closing    bool // set once the connection is to be closed after the queue has been written
+
+	outgoing    bool              // set if this server started the handshake
+	password    string            // password received with PASS
+	tokens      map[string]string // server tokens announced by the other server, mapped to server names
+	remote      *RemoteServer
+	established bool
+}
+
+func (s *Server) newLink(conn net.Conn, reader *bufio.Reader) *Link {
+	l := &Link{Server: s, conn: conn, reader: reader, tokens: map[string]string{}}
+	l.queued = make(chan struct{}, 1)
+	l.done = make(chan struct{})
+	go l.write()
+	return l
+}
+
+// linkConfig finds the configuration of a server that may be linked with
+func (s *Server) linkConfig(name string) (LinkConfig, bool) {
+	for _, config := range s.Config.Links {
+		if strings.EqualFold(config.Name, name) {
+			return config, true
+		}
+	}
+	return LinkConfig{}, false
+}
+
+// Connect links with a configured server by connecting to its address
+func (s *Server) Connect(name string) error {
+	config, ok := s.linkConfig(name)
+	if !ok {
+		return errLinkRefused
+	}
+	conn, err := net.Dial("tcp", config.Addr)
+	if err != nil {
+		return err
+	}
+	go s.LinkConn(conn, config.Name)
+	return nil
+}
+
+// LinkConn links with a configured server over an existing connection.
+// It starts the PASS and SERVER handshake and handles the link until the connection is closed
+func (s *Server) LinkConn(conn net.Conn, name string) error {
+	config, ok := s.linkConfig(name)
+	if !ok {
+		conn.Close()
+		return errLinkRefused
+	}
+	l := s.newLink(conn, bufio.NewReader(conn))
+	l.Name = config.Name
+	l.outgoing = true
+	l.sendHandshake(config.Password)
+	return l.serve()
+}
+
+// ServerHandler is a CommandHandler to respond to SERVER commands from an unregistered connection, turning it into a link
+// Implemented according to RFC 2813 Section 4.1.2
+func ServerHandler(message *irc.Message, client *Client) {
+	if client.Registered || client.conn == nil {
+		m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_ALREADYREGISTRED, Params: []string{client.Nickname}, Trailing: "You may not reregister"}
+		client.Encode(&m)
+		return
+	}
+	if reason := client.Server.refuseLink(message.Params[0], client.password); len(reason) != 0 {
+		m := irc.Message{Command: irc.ERROR, Trailing: reason}
+		client.Encode(&m)
+		client.Close()
+		return
+	}
+	// The connection is handled as a link from now on, it is taken over by the goroutine reading it.
+	// Waiting for the messages queued for the client to be written would hold up the state goroutine
+	client.idleTimer.Stop()
+	client.Server.RemoveClient(client)
+	client.Server.RemoveClientNick(client)
+	client.upgrade = message
+}
+
+// upgradeToLink turns the connection of a client that sent SERVER into a link and handles the link until it is closed.
+// It is called by the goroutine reading the connection, once the writer of the client has written what was queued for it
+func (c *Client) upgradeToLink() {
+	c.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	c.detachWriter()
+	c.conn.SetWriteDeadline(time.Time{})
+
+	l := c.Server.newLink(c.conn, c.reader)
+	l.password = c.password
+	var err error
+	c.Server.Do(func() { err = l.establish(c.upgrade) })
+	if err != nil { // the ERROR sent by establish is written before the connection is closed
+		l.closeWithin(time.Now().Add(closeTimeout))
+		return
+	}
+	l.serve()
+}
+
+// sendHandshake introduces this server with PASS and SERVER
+func (l *Link) sendHandshake(password string) {
+	l.send(&irc.Message{Command: irc.PASS, Params: []string{password, linkVersion, "IRC|"}})
+	l.send(&irc.Message{Command: irc.SERVER, Params: []string{l.Server.Config.Name, "1", localToken}, Trailing: l.Server.Config.Info})
+}
+
+// establish checks the SERVER message of the other server and registers the link.
+// The handshake is answered if the other server started it, then the state of this side of the network is sent
+func (l *Link) establish(message *irc.Message) error {
+	s := l.Server
+	name := message.Params[0]
+	reason := s.refuseLink(name, l.password)
+	if len(reason) == 0 && l.outgoing && !strings.EqualFold(l.Name, name) {
+		reason = "Unauthorized connection"
+	}
+	if len(reason) != 0 {
+		l.send(&irc.Message{Command: irc.ERROR, Trailing: reason})
+		return errLinkRefused
+	}
+	if !l.outgoing {
+		config, _ := s.linkConfig(name)
+		l.sendHandshake(config.Password)
+	}
+
+	l.Name = name
+	l.tokens[message.Params[2]] = name
+	l.remote = &RemoteServer{Name: name, Info: message.Trailing, Hops: 1, Uplink: s.Config.Name, link: l}
+	l.established = true
+	s.addServer(l.remote)
+	s.addLink(l)
+	s.propagate(s.serverMessage(l.remote), l)
+	l.burst()
+	return nil
+}
+
+// refuseLink checks if a server may be linked with using a password, returning the reason sent in ERROR if it may not
+func (s *Server) refuseLink(name string, password string) string {
+	config, ok := s.linkConfig(name)
+	if !ok || config.Password != password {
+		return "Unauthorized connection"
+	}
+	if _, known := s.getServer(name); known || strings.EqualFold(name, s.Config.Name) {
+		return "Server " + name + " already exists"
+	}
+	return ""
+}
+
+// serve reads and handles messages from the other server until the link is closed
+func (l *Link) serve() error {
+	defer close(l.done)
+	defer l.conn.Close()
+	for {
+		line, err := l.reader.ReadString('\n')
+		if err != nil {
+			l.Server.Do(func() {
+				if l.established {
+					l.Server.unlink(l, "Connection closed")
+				}
+			})
+			return err
+		}
+		_, rest := splitTags(line)
+		m := irc.ParseMessage(rest)
+		if m == nil {
+			continue
+		}
+		open := true
+		l.Server.Do(func() { open, err = l.receive(m) })
+		if !open {
+			return err
+		}
+	}
+}
+
+// receive handles a message from the other server on the state goroutine, completing the handshake first.
+// It returns false once the link is closed
+func (l *Link) receive(m *irc.Message) (bool, error) {
+	if l.established {
+		return l.handle(m), nil
+	}
+	switch m.Command {
+	case irc.PASS:
+		if len(m.Params) != 0 {
+			l.password = m.Params[0]
+		}
+	case irc.SERVER:
+		if len(m.Params) < 3 {
+			return false, errLinkRefused
+		}
+		if err := l.establish(m); err != nil {
+			return false, err
+		}
+	case irc.ERROR:
+		return false, errLinkRefused
+	}
+	return true, nil
+}
+
+// send queues a message for the other server
+func (l *Link) send(m *irc.Message) {
+	l.queueMutex.Lock()
+	l.queue = append(l.queue, append(m.Bytes(), '\r', '\n'))
+	l.queueMutex.Unlock()
+	select {
+	case l.queued <- struct{}{}:
+	default:
+	}
+}
+
+// write writes queued messages to the connection until the link is closed
+func (l *Link) write() {
+	for {
+		select {
+		case <-l.queued:
+		case <-l.done:
+			return
+		}
+		l.queueMutex.Lock()
+		queue := l.queue
+		l.queue = nil
+		l.queueMutex.Unlock()
+		for _, line := range queue {
+			if _, err := l.conn.Write(line); err != nil {
+				l.conn.Close()
+				return
+			}
+		}
+		l.queueMutex.Lock()
+		closing := l.closing && len(l.queue) == 0
+		l.queueMutex.Unlock()
+		if closing {
+			l.conn.Close()
+			return
+		}
+	}
+}
+
+// drain closes the link like Close, but only once the messages already queued have been written or the deadline has passed
+func (l *Link) drain(reason string, deadline time.Time) {
+	l.send(&irc.Message{Command: irc.ERROR, Trailing: reason})
+	l.Server.unlink(l, reason)
+	l.closeWithin(deadline)
+}
+
+// closeWithin makes the writer close the connection once the messages already queued have been written, or at the deadline
+func (l *Link) closeWithin(deadline time.Time) {
+	l.conn.SetWriteDeadline(deadline)
+	l.queueMutex.Lock()
+	l.closing = true
+	l.queueMutex.Unlock()
+	select {
+	case l.queued <- struct{}{}:
+	default:
+	}
+}
+
+// Close closes the link, splitting the servers behind it off the network
+func (l *Link) Close(reason string) {
+	l.send(&irc.Message{Command: irc.ERROR, Trailing: reason})
+	l.Server.unlink(l, reason)
+	l.conn.Close()
+}
+
+// addLink adds an established link
+func (s *Server) addLink(l *Link) {
+	s.linkMutex.Lock()
+	defer s.linkMutex.Unlock()
+	s.links[strings.ToLower(l.Name)] = l
+}
+
+// getLinks returns the established links
+func (s *Server) getLinks() []*Link {
+	s.linkMutex.RLock()
+	defer s.linkMutex.RUnlock()
+	links := make([]*Link, 0, len(s.links))
+	for _, l := range s.links {
+		links = append(links, l)
+	}
+	return links
+}
+
+// addServer adds a server that joined the network, giving it a token
+func (s *Server) addServer(rs *RemoteServer) {
+	s.linkMutex.Lock()
+	defer s.linkMutex.Unlock()
+	s.serverTokens++
+	rs.token = strconv.Itoa(s.serverTokens + 1) // token 1 is this server
+	s.servers[strings.ToLower(rs.Name)] = rs
+}
+
+// getServer finds a server of the network by name
+func (s *Server) getServer(name string) (*RemoteServer, bool) {
+	s.linkMutex.RLock()
+	defer s.linkMutex.RUnlock()
+	rs, ok := s.servers[strings.ToLower(name)]
+	return rs, ok
+}
+
+// GetServers returns the other servers of the network, closest first
+func (s *Server) GetServers() []*RemoteServer {
+	s.linkMutex.RLock()
+	defer s.linkMutex.RUnlock()
+	servers := make([]*RemoteServer, 0, len(s.servers))
+	for _, rs := range s.servers {
+		servers = append(servers, rs)
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		if servers[i].Hops != servers[j].Hops {
+			return servers[i].Hops < servers[j].Hops
+		}
+		return servers[i].Name < servers[j].Name
+	})
+	return servers
+}
+
+// propagate sends a message to every link except the one it came from
+func (s *Server) propagate(m *irc.Message, from *Link) {
+	for _, l := range s.getLinks() {
+		if l != from {
+			l.send(m)
+		}
+	}
+}
+
+// serverMessage returns the SERVER message introducing a server to the other servers
+func (s *Server) serverMessage(rs *RemoteServer) *irc.Message {
+	return &irc.Message{Prefix: &irc.Prefix{Name: rs.Uplink}, Command: irc.SERVER, Params: []string{rs.Name, strconv.Itoa(rs.Hops + 1), rs.token}, Trailing: rs.Info}
+}
+
+// nickMessage returns the NICK message introducing a user to the other servers - RFC 2813 Section 4.1.3
+func (s *Server) nickMessage(c *Client) *irc.Message {
+	token := localToken
+	if c.home != nil {
+		token = c.home.token
+	}
+	modes := c.UserModeSet.String()
+	if len(modes) == 0 {
+		modes = "+"
+	}
+	return &irc.Message{Prefix: s.Prefix, Command: irc.NICK,
+		Params:   []string{c.Nickname, strconv.Itoa(c.HopCount() + 1), c.Name, c.Host, token, modes},
+		Trailing: c.RealName}
+}
+
+// burst sends the servers, users and channels known on this side of the link to the other server - RFC 2813 Section 5.2
+func (l *Link) burst() {
+	s := l.Server
+	for _, rs := range s.GetServers() { // closest first, so every server is introduced after its uplink
+		if rs.link != l {
+			l.send(s.serverMessage(rs))
+		}
+	}
+
+	for _, c := range s.getUsers() {
+		if c.route() != l {
+			l.send(s.nickMessage(c))
+		}
+	}
+
+	for _, channel := range s.getChannels() {
+		names := []string{}
+		for _, member := range channel.getMembers() {
+			if member.route() == l {
+				continue
+			}
+			names = append(names, channel.memberPrefixes(member, true)+member.Nickname)
+		}
+		if len(names) == 0 {
+			continue
+		}
+		empty := irc.Message{Prefix: s.Prefix, Command: irc.NJOIN, Params: []string{channel.Name}}
+		maxLength := maxLineLength - 2 - len(empty.Bytes()) - 2
+		list := ""
+		for _, name := range names {
+			if len(list) != 0 && len(list)+1+len(name) > maxLength {
+				l.send(&irc.Message{Prefix: s.Prefix, Command: irc.NJOIN, Params: []string{channel.Name}, Trailing: list})
+				list = ""
+			}
+			if len(list) != 0 {
+				list += ","
+			}
+			list += name
+		}
+		l.send(&irc.Message{Prefix: s.Prefix, Command: irc.NJOIN, Params: []string{channel.Name}, Trailing: list})
+
+		for _, modes := range channelModeMessages(channel) {
+			l.send(&irc.Message{Prefix: s.Prefix, Command: irc.MODE, Params: append([]string{channel.Name}, modes...)})
+		}
+		if len(channel.Topic) != 0 {
+			l.send(&irc.Message{Prefix: s.Prefix, Command: irc.TOPIC, Params: []string{channel.Name}, Trailing: channel.Topic})
+		}
+	}
+}
+
+// channelModeMessages returns the parameters of the MODE messages that set the modes and lists of a channel
+func channelModeMessages(channel *Channel) [][]string {
+	flags := "+"
+	params := []string{}
+	for mode, modeType := range ChannelModes {
+		if modeType == ChannelModeTypeFlag && channel.HasMode(mode) {
+			flags += string(mode)
+		}
+	}
+	if channel.HasMode(ChannelModeKey) {
+		flags += string(ChannelModeKey)
+		params = append(params, channel.GetKey())
+	}
+	if channel.HasMode(ChannelModeLimit) {
+		flags += string(ChannelModeLimit)
+		params = append(params, strconv.Itoa(channel.GetLimit()))
+	}
+	messages := [][]string{}
+	if len(flags) > 1 {
+		messages = append(messages, append([]string{flags}, params...))
+	}
+
+	lists := map[ChannelMode]*MaskSet{ChannelModeBan: channel.GetBanMasks(), ChannelModeExceptionMask: channel.GetExceptionMasks(), ChannelModeInvitationMask: channel.GetInvitationMasks()}
+	for mode, masks := range lists {
+		all := masks.Masks()
+		for len(all) != 0 {
+			n := len(all)
+			if n > maxModeParams {
+				n = maxModeParams
+			}
+			messages = append(messages, append([]string{"+" + strings.Repeat(string(mode), n)}, all[:n]...))
+			all = all[n:]
+		}
+	}
+	return messages
+}
+
+// linkHandlers respond to messages from linked servers
+var linkHandlers map[string]func(l *Link, m *irc.Message)
+
+func init() {
+	linkHandlers = map[string]func(l *Link, m *irc.Message){
+		irc.SERVER:  linkServer,
+		irc.NICK:    linkNick,
+		irc.NJOIN:   linkNJoin,
+		irc.JOIN:    linkJoin,
+		irc.PART:    linkPart,
+		irc.KICK:    linkKick,
+		irc.MODE:    linkMode,
+		irc.TOPIC:   linkTopic,
+		irc.PRIVMSG: linkMessage,
+		irc.NOTICE:  linkMessage,
+		irc.QUIT:    linkQuit,
+		irc.KILL:    linkKill,
+		irc.SQUIT:   linkSquit,
+		irc.TIME:    linkQuery,
+		irc.VERSION: linkQuery,
+	}
+}
+
+// handle handles a message from the other server. It returns false if the link was closed
+func (l *Link) handle(m *irc.Message) bool {
+	switch m.Command {
+	case irc.PING:
+		l.send(&irc.Message{Prefix: l.Server.Prefix, Command: irc.PONG, Params: []string{l.Server.Config.Name}, Trailing: m.Trailing})
+		return true
+	case irc.PONG:
+		return true
+	case irc.ERROR:
+		l.Server.unlink(l, m.Trailing)
+		return false
+	}
+	if len(m.Command) == 3 && m.Command[0] >= '0' && m.Command[0] <= '9' { // numeric replies are routed to their target
+		l.route(m)
+		return true
+	}
+	if handler, ok := linkHandlers[m.Command]; ok {
+		handler(l, m)
+	}
+	return l.established
+}
+
+// sender returns the remote client a message from the other server was sent by
+func (l *Link) sender(m *irc.Message) (*Client, bool) {
+	if m.Prefix == nil {
+		return nil, false
+	}
+	client, ok := l.Server.GetClientByNick(m.Prefix.Name)
+	if !ok || client.route() != l {
+		return nil, false
+	}
+	return client, true
+}
+
+// route passes a message on to the user it is addressed to
+func (l *Link) route(m *irc.Message) {
+	if len(m.Params) == 0 {
+		return
+	}
+	if client, ok := l.Server.GetClientByNick(m.Params[0]); ok && client.route() != l {
+		client.Relay(m, nil)
+	}
+}
+
+// linkArgs returns the parameters of a message with the trailing parameter appended
+func linkArgs(m *irc.Message) []string {
+	if len(m.Trailing) == 0 && !m.EmptyTrailing {
+		return m.Params
+	}
+	return append(append([]string{}, m.Params...), m.Trailing)
+}
+
+// linkServer adds a server introduced by the other server
+func linkServer(l *Link, m *irc.Message) {
+	s := l.Server
+	a := linkArgs(m)
+	if len(a) < 3 || m.Prefix == nil {
+		return
+	}
+	if _, known := s.getServer(a[0]); known || strings.EqualFold(a[0], s.Config.Name) { // the network would have a loop
+		l.Close("Server " + a[0] + " already exists")
+		return
+	}
+	hops, _ := strconv.Atoi(a[1])
+	rs := &RemoteServer{Name: a[0], Hops: hops, Uplink: m.Prefix.Name, link: l}
+	if len(a) > 3 {
+		rs.Info = a[3]
+	}
+	l.tokens[a[2]] = rs.Name
+	s.addServer(rs)
+	s.propagate(s.serverMessage(rs), l)
+}
+
+// linkNick adds a user introduced by the other server or changes the nickname of a remote user
+func linkNick(l *Link, m *irc.Message) {
+	s := l.Server
+	a := linkArgs(m)
+	if len(a) == 0 {
+		return
+	}
+	if client, ok := l.sender(m); ok { // nickname change
+		if existing, found := s.GetClientByNick(a[0]); found && existing != client {
+			s.nickCollision(l, a[0], client, existing)
+			return
+		}
+		client.UpdateNick(a[0])
+		return
+	}
+
+	if len(a) < 6 {
+		return
+	}
+	home, ok := s.getServer(l.tokens[a[4]])
+	if !ok {
+		return
+	}
+	hops, _ := strconv.Atoi(a[1])
+	realName := ""
+	if len(a) > 6 {
+		realName = a[6]
+	}
+	client := s.newRemoteClient(home, hops, a[0], a[2], a[3], realName)
+	for _, mode := range strings.TrimLeft(a[5], "+") {
+		if _, ok := UserModes[UserMode(mode)]; ok {
+			client.AddMode(UserMode(mode))
+		}
+	}
+	if existing, found := s.GetClientByNick(client.Nickname); found {
+		s.nickCollision(l, client.Nickname, nil, existing)
+		return
+	}
+	s.AddClientNick(client)
+	s.propagate(s.nickMessage(client), l)
+	client.notifyOnline()
+}
+
+// nickCollision removes both users when a linked server uses a nickname that is already taken - RFC 2813 Section 5.2.
+// The other server is told to kill its user by the nickname it used, incoming is set if that user was known here before
+func (s *Server) nickCollision(l *Link, nick string, incoming *Client, existing *Client) {
+	l.send(&irc.Message{Prefix: s.Prefix, Command: irc.KILL, Params: []string{nick}, Trailing: "Nick collision"})
+	if incoming != nil {
+		s.kill(incoming, "Nick collision", l)
+	}
+	s.kill(existing, "Nick collision", l)
+}
+
+// isKnown returns if a client is still listed under its nickname
+func (s *Server) isKnown(client *Client) bool {
+	c, ok := s.GetClientByNick(client.Nickname)
+	return ok && c == client
+}
+
+// kill removes a user from the network, telling the other servers except the one on from
+func (s *Server) kill(client *Client, reason string, from *Link) {
+	m := irc.Message{Prefix: s.Prefix, Command: irc.KILL, Params: []string{client.Nickname}, Trailing: reason}
+	s.propagate(&m, from)
+	for _, channel := range client.GetChannels() {
+		channel.Quit(client, "Killed ("+reason+")")
+	}
+	if client.home == nil {
+		client.Relay(&m, nil)
+		client.Close()
+		return
+	}
+	s.removeRemoteClient(client)
+}
+
+// removeRemoteClient forgets a remote user that left the network
+func (s *Server) removeRemoteClient(client *Client) {
+	if !s.isKnown(client) {
+		return
+	}
+	s.RemoveClientNick(client)
+	s.notifyOffline(client.Nickname)
+}
+
+// linkNJoin adds remote users to a channel during a burst - RFC 2813 Section 4.2.2
+func linkNJoin(l *Link, m *irc.Message) {
+	s := l.Server
+	a := linkArgs(m)
+	if len(a) < 2 {
+		return
+	}
+	channel := s.linkChannel(a[0])
+	for _, name := range strings.Split(a[1], ",") {
+		modes := ""
+		for len(name) != 0 && (name[0] == '@' || name[0] == '+') {
+			if name[0] == '@' {
+				modes += string(ChannelModeOperator)
+			} else {
+				modes += string(ChannelModeVoice)
+			}
+			name = name[1:]
+		}
+		client, ok := s.GetClientByNick(name)
+		if !ok || client.route() != l || channel.HasMember(client) {
+			continue
+		}
+		channel.join(client, modes)
+	}
+	s.propagate(m, l)
+}
+
+// linkChannel returns the channel with a name, creating it for channels that were created on another server
+func (s *Server) linkChannel(name string) *Channel {
+	channel, ok := s.GetChannel(name)
+	if !ok {
+		channel = NewChannel(s, nil)
+		channel.Name = name
+		s.AddChannel(channel)
+	}
+	return channel
+}
+
+// linkJoin adds a remote user to channels. The member modes follow the channel name after a ^G - RFC 2813 Section 4.2.1
+func linkJoin(l *Link, m *irc.Message) {
+	client, ok := l.sender(m)
+	a := linkArgs(m)
+	if !ok || len(a) == 0 {
+		return
+	}
+	for _, name := range strings.Split(a[0], ",") {
+		modes := ""
+		if i := strings.IndexByte(name, '\a'); i >= 0 {
+			name, modes = name[:i], name[i+1:]
+		}
+		channel := l.Server.linkChannel(name)
+		if !channel.HasMember(client) {
+			channel.join(client, modes)
+		}
+	}
+	l.Server.propagate(m, l)
+}
+
+// linkPart removes a remote user from channels
+func linkPart(l *Link, m *irc.Message) {
+	client, ok := l.sender(m)
+	if !ok || len(m.Params) == 0 {
+		return
+	}
+	for _, name := range strings.Split(m.Params[0], ",") {
+		if channel, found := l.Server.GetChannel(name); found {
+			channel.Part(client, m.Trailing)
+		}
+	}
+}
+
+// linkKick kicks users out of a channel for a remote channel operator
+func linkKick(l *Link, m *irc.Message) {
+	client, ok := l.sender(m)
+	a := linkArgs(m)
+	if !ok || len(a) < 2 {
+		return
+	}
+	if channel, found := l.Server.GetChannel(a[0]); found {
+		channel.Kick(client, strings.Split(a[1], ","), m.Trailing)
+	}
+}
+
+// linkMode changes channel modes for a remote user, or for the other server during a burst
+func linkMode(l *Link, m *irc.Message) {
+	a := linkArgs(m)
+	if len(a) < 2 {
+		return
+	}
+	channel, found := l.Server.GetChannel(a[0])
+	if !found {
+		return
+	}
+	if client, ok := l.sender(m); ok {
+		ChannelModeHandler(&irc.Message{Prefix: client.Prefix, Command: irc.MODE, Params: a}, client)
+		return
+	}
+	channel.serverModes(a[1:])
+	channel.shareState()
+	notify := irc.Message{Prefix: m.Prefix, Command: irc.MODE, Params: a}
+	channel.SendMessage(&notify)
+	l.Server.propagate(&notify, l)
+}
+
+// serverModes applies mode changes made by a server, which are not checked against the privileges of a member
+func (c *Channel) serverModes(params []string) {
+	modifier := ModeModifierAdd
+	args := params[1:]
+	next := func() (string, bool) {
+		if len(args) == 0 {
+			return "", false
+		}
+		arg := args[0]
+		args = args[1:]
+		return arg, true
+	}
+	for _, char := range params[0] {
+		switch ModeModifier(char) {
+		case ModeModifierAdd, ModeModifierRemove:
+			modifier = ModeModifier(char)
+			continue
+		}
+		mode := ChannelMode(char)
+		modeType, ok := ChannelModes[mode]
+		if !ok {
+			continue
+		}
+		switch modeType {
+		case ChannelModeTypeFlag:
+			if modifier == ModeModifierAdd {
+				c.AddMode(mode)
+			} else {
+				c.RemoveMode(mode)
+			}
+		case ChannelModeTypeMember:
+			nick, ok := next()
+			member, found := c.Server.GetClientByNick(nick)
+			if !ok || !found {
+				continue
+			}
+			if modifier == ModeModifierAdd {
+				c.AddMemberMode(member, mode)
+			} else {
+				c.RemoveMemberMode(member, mode)
+			}
+		case ChannelModeTypeList:
+			mask, ok := next()
+			if !ok {
+				continue
+			}
+			if modifier == ModeModifierAdd {
+				c.addMask(mode, NormalizeMask(mask))
+			} else {
+				c.removeMask(mode, NormalizeMask(mask))
+			}
+		case ChannelModeTypeParam, ChannelModeTypeSetParam:
+			if modifier == ModeModifierRemove {
+				if modeType == ChannelModeTypeParam {
+					next()
+				}
+				c.RemoveMode(mode)
+				continue
+			}
+			value, ok := next()
+			if !ok {
+				continue
+			}
+			if mode == ChannelModeKey {
+				c.SetKey(value)
+			} else if limit, err := strconv.Atoi(value); err == nil {
+				c.SetLimit(limit)
+			}
+		}
+	}
+}
+
+// linkTopic changes the topic of a channel for a remote user, or for the other server during a burst
+func linkTopic(l *Link, m *irc.Message) {
+	if len(m.Params) == 0 {
+		return
+	}
+	channel, found := l.Server.GetChannel(m.Params[0])
+	if !found {
+		return
+	}
+	if client, ok := l.sender(m); ok {
+		channel.TopicCommand(client, m.Trailing)
+		return
+	}
+	if channel.Topic == m.Trailing {
+		return
+	}
+	channel.Topic = m.Trailing
+	channel.shareState()
+	channel.SendMessage(m)
+	l.Server.propagate(m, l)
+}
+
+// linkMessage delivers a PRIVMSG or NOTICE from a remote user, or passes on one sent by a server
+func linkMessage(l *Link, m *irc.Message) {
+	client, ok := l.sender(m)
+	if !ok {
+		l.route(m)
+		return
+	}
+	message := irc.Message{Prefix: client.Prefix, Command: m.Command, Params: m.Params, Trailing: m.Trailing}
+	if m.Command == irc.PRIVMSG {
+		PrivMsgHandler(&message, client)
+	} else {
+		NoticeHandler(&message, client)
+	}
+}
+
+// linkQuit removes a remote user that quit
+func linkQuit(l *Link, m *irc.Message) {
+	client, ok := l.sender(m)
+	if !ok {
+		return
+	}
+	for _, channel := range client.GetChannels() {
+		channel.Quit(client, m.Trailing)
+	}
+	l.Server.removeRemoteClient(client)
+	l.Server.propagate(&irc.Message{Prefix: client.Prefix, Command: irc.QUIT, Trailing: m.Trailing}, l)
+}
+
+// linkKill removes a user that was killed elsewhere in the network
+func linkKill(l *Link, m *irc.Message) {
+	if len(m.Params) == 0 {
+		return
+	}
+	if client, ok := l.Server.GetClientByNick(m.Params[0]); ok {
+		l.Server.kill(client, m.Trailing, l)
+	}
+}
+
+// linkSquit handles a server leaving the network, or an operator asking for a link to be closed - RFC 2813 Section 4.1.6
+func linkSquit(l *Link, m *irc.Message) {
+	s := l.Server
+	if len(m.Params) == 0 {
+		return
+	}
+	name := m.Params[0]
+	if strings.EqualFold(name, s.Config.Name) || strings.EqualFold(name, l.Name) {
+		l.Close(m.Trailing)
+		return
+	}
+	rs, ok := s.getServer(name)
+	if !ok {
+		return
+	}
+	if rs.link == l { // the server split off somewhere behind the link
+		s.split(rs, m.Trailing, l)
+		return
+	}
+	if rs.Hops == 1 {
+		rs.link.Close(m.Trailing)
+		return
+	}
+	rs.link.send(m)
+}
+
+// linkQuery answers or passes on a TIME or VERSION query of a remote user
+func linkQuery(l *Link, m *irc.Message) {
+	client, ok := l.sender(m)
+	if !ok {
+		return
+	}
+	message := irc.Message{Prefix: client.Prefix, Command: m.Command, Params: m.Params}
+	if m.Command == irc.TIME {
+		TimeHandler(&message, client)
+	} else {
+		VersionHandler(&message, client)
+	}
+}
+
+// unlink removes a closed link, splitting the servers behind it off the network
+func (s *Server) unlink(l *Link, reason string) {
+	s.linkMutex.Lock()
+	current, ok := s.links[strings.ToLower(l.Name)]
+	if ok && current == l {
+		delete(s.links, strings.ToLower(l.Name))
+	}
+	s.linkMutex.Unlock()
+	l.established = false
+	if ok && current == l {
+		s.split(l.remote, reason, l)
+	}
+}
+
+// split removes a server and the servers behind it from the network. Their users quit in a netsplit batch
+// and the other links are told with SQUIT
+func (s *Server) split(rs *RemoteServer, reason string, from *Link) {
+	s.linkMutex.Lock()
+	gone := map[string]*RemoteServer{strings.ToLower(rs.Name): rs}
+	for found := true; found; {
+		found = false
+		for name, server := range s.servers {
+			if _, done := gone[name]; !done {
+				if _, behind := gone[strings.ToLower(server.Uplink)]; behind {
+					gone[name] = server
+					found = true
+				}
+			}
+		}
+	}
+	for name := range gone {
+		delete(s.servers, name)
+	}
+	s.linkMutex.Unlock()
+
+	quitting := []*Client{}
+	for _, c := range s.getUsers() {
+		if c.home != nil {
+			if _, behind := gone[strings.ToLower(c.home.Name)]; behind {
+				quitting = append(quitting, c)
+			}
+		}
+	}
+	s.QuitClients(quitting, rs.Uplink+" "+rs.Name, BatchNetsplit, rs.Uplink, rs.Name)
+	s.propagate(&irc.Message{Prefix: s.Prefix, Command: irc.SQUIT, Params: []string{rs.Name}, Trailing: reason}, from)
+}
+
+// getUsers returns the registered users of the network, local and remote
+func (s *Server) getUsers() []*Client {
+	s.clientByNickMutex.RLock()
+	defer s.clientByNickMutex.RUnlock()
+	users := make([]*Client, 0, len(s.clientsByNick))
+	for _, c := range s.clientsByNick {
+		if c.Registered {
+			users = append(users, c)
+		}
+	}
+	return users
+}
+
+// getChannels returns the active channels
+func (s *Server) getChannels() []*Channel {
+	s.channelMutex.RLock()
+	defer s.channelMutex.RUnlock()
+	channels := make([]*Channel, 0, len(s.channels))
+	for _, channel := range s.channels {
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+// newRemoteClient creates a client for a user connected to another server of the network
+func (s *Server) newRemoteClient(home *RemoteServer, hops int, nick string, user string, host string, realName string) *Client {
+	client := &Client{Server: s, home: home, hops: hops, Nickname: nick, Name: user, Host: host, RealName: realName}
+	client.Prefix = &irc.Prefix{Name: nick, User: user, Host: host}
+	client.Registered = true
+	client.Authorized = true
+	client.channels = map[string]*Channel{}
+	client.caps = map[string]interface{}{}
+	client.monitoring = map[string]string{}
+	client.UserModeSet = NewUserModeSet()
+	return client
+}
+
+// route returns the link a remote client is reached through, nil for local clients
+func (c *Client) route() *Link {
+	if c.home == nil {
+		return nil
+	}
+	return c.home.link
+}
+
+// forward sends a message addressed to a remote client, like a private message or a numeric reply, towards its server.
+// Other messages, like those sent to channel members, reach remote clients through their own server
+func (c *Client) forward(m *irc.Message) error {
+	if len(m.Params) == 0 || c.Server.Casefold(m.Params[0]) != c.Server.Casefold(c.Nickname) {
+		return nil
+	}
+	c.route().send(m)
+	return nil
+}
+
+// ServerName returns the name of the server the client is connected to
+func (c *Client) ServerName() string {
+	if c.home != nil {
+		return c.home.Name
+	}
+	if len(c.node) != 0 {
+		return c.node
+	}
+	return c.Server.Config.Name
+}
+
+// HopCount returns the number of links between this server and the server the client is connected to
+func (c *Client) HopCount() int {
+	return c.hops
+}
+
+// routeQuery passes a query like TIME or VERSION on to the server it names - RFC 2812 Section 3.4.
+// It returns false if this server should answer the query itself
+func (s *Server) routeQuery(message *irc.Message, client *Client) bool {
+	if len(message.Params) == 0 {
+		return false
+	}
+	mask := CompileMask(message.Params[0], strings.ToLower)
+	if mask.Match(s.Config.Name) {
+		return false
+	}
+	for _, rs := range s.GetServers() {
+		if mask.Match(rs.Name) {
+			rs.link.send(&irc.Message{Prefix: client.Prefix, Command: message.Command, Params: []string{rs.Name}})
+			return true
+		}
+	}
+	m := irc.Message{Prefix: s.Prefix, Command: irc.ERR_NOSUCHSERVER, Params: []string{client.Nickname, message.Params[0]}, Trailing: "No such server"}
+	client.Encode(&m)
+	return true
+}
+
+// SquitHandler is a CommandHandler to respond to SQUIT commands from an operator, closing a link
+// Implemented according to RFC 2812 Section 3.1.8
+func SquitHandler(message *irc.Message, client *Client) {
+	reason := message.Trailing
+	if len(reason) == 0 {
+		reason = client.Nickname
+	}
+	rs, ok := client.Server.getServer(message.Params[0])
+	if !ok {
+		m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_NOSUCHSERVER, Params: []string{client.Nickname, message.Params[0]}, Trailing: "No such server"}
+		client.Encode(&m)
+		return
+	}
+	if rs.Hops == 1 {
+		rs.link.Close(reason)
+		return
+	}
+	rs.link.send(&irc.Message{Prefix: client.Prefix, Command: irc.SQUIT, Params: []string{rs.Name}, Trailing: reason})
+}
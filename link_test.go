@@ -0,0 +1,158 @@
+package irc
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// newLinkedServer creates a server that may be linked with the given servers, all using the password "secret"
+func newLinkedServer(name string, peers ...string) *Server {
+	config := ServerConfig{Name: name}
+	for _, peer := range peers {
+		config.Links = append(config.Links, LinkConfig{Name: peer, Password: "secret"})
+	}
+	s := newTestServer(config)
+	opers := NewBasicOperAuthMethod()
+	opers.Add("oper", "operpass")
+	s.OperAuthMethod = opers
+	return s
+}
+
+// linkServers links two servers over a pipe, the first one connecting to the second
+func linkServers(t *testing.T, a *Server, b *Server) {
+	t.Helper()
+	conn, otherConn := net.Pipe()
+	go b.ServeConn(otherConn)
+	go a.LinkConn(conn, b.Config.Name)
+	waitFor(t, a, a.Config.Name+" knows "+b.Config.Name, func() bool { _, ok := a.getServer(b.Config.Name); return ok })
+	waitFor(t, b, b.Config.Name+" knows "+a.Config.Name, func() bool { _, ok := b.getServer(a.Config.Name); return ok })
+}
+
+func TestLinkBurst(t *testing.T) {
+	a := newLinkedServer("a.test", "b.test")
+	b := newLinkedServer("b.test", "a.test")
+
+	alice := connectClient(t, a, "alice")
+	alice.send("JOIN #x")
+	alice.expect("JOIN #x")
+	alice.send("TOPIC #x :linked topic")
+	alice.expect("TOPIC #x")
+
+	linkServers(t, a, b)
+
+	remote, ok := b.GetClientByNick("alice")
+	if !ok || remote.ServerName() != "a.test" || remote.HopCount() != 1 {
+		t.Fatal("alice was not sent in the burst")
+	}
+	bob := connectClient(t, b, "bob")
+	bob.send("JOIN #x")
+	bob.expect(" 332 ", "#x :linked topic")
+	if names := bob.expect(" 353 "); !strings.Contains(names, "@alice") {
+		t.Error("channel members were not sent in the burst:", names)
+	}
+	alice.expect(":bob!user@", "JOIN #x")
+
+	bob.send("LINKS")
+	bob.expect(" 364 bob a.test b.test ")
+}
+
+func TestLinkPropagation(t *testing.T) {
+	a := newLinkedServer("a.test", "b.test")
+	b := newLinkedServer("b.test", "a.test")
+	linkServers(t, a, b)
+
+	alice := connectClient(t, a, "alice")
+	bob := connectClient(t, b, "bob")
+	waitFor(t, b, "b.test knows alice", func() bool { _, ok := b.GetClientByNick("alice"); return ok })
+	waitFor(t, a, "a.test knows bob", func() bool { _, ok := a.GetClientByNick("bob"); return ok })
+
+	alice.send("JOIN #x")
+	alice.expect("JOIN #x")
+	bob.send("JOIN #x")
+	alice.expect(":bob!user@", "JOIN #x")
+
+	alice.send("PRIVMSG #x :hello channel")
+	bob.expect("PRIVMSG #x :hello channel")
+	bob.send("PRIVMSG alice :hello alice")
+	alice.expect(":bob!user@", "PRIVMSG alice :hello alice")
+
+	bob.send("PART #x :leaving")
+	alice.expect("PART #x :leaving")
+	bob.send("JOIN #x")
+	alice.expect("JOIN #x")
+
+	alice.send("KICK #x bob :out")
+	bob.expect("KICK #x bob :out")
+	waitFor(t, b, "bob left #x on b.test", func() bool {
+		channel, _ := b.GetChannel("#x")
+		client, _ := b.GetClientByNick("bob")
+		return channel != nil && client != nil && !channel.HasMember(client)
+	})
+}
+
+func TestLinkNickCollision(t *testing.T) {
+	a := newLinkedServer("a.test", "b.test")
+	b := newLinkedServer("b.test", "a.test")
+	daveA := connectClient(t, a, "dave")
+	daveB := connectClient(t, b, "dave")
+	alice := connectClient(t, a, "alice")
+
+	linkServers(t, a, b)
+
+	daveA.expect("Nick collision")
+	daveB.expect("Nick collision")
+	daveA.expectClosed()
+	daveB.expectClosed()
+	for _, s := range []*Server{a, b} {
+		waitFor(t, s, "dave is gone from "+s.Config.Name, func() bool { _, ok := s.GetClientByNick("dave"); return !ok })
+	}
+	if _, ok := b.GetClientByNick("alice"); !ok {
+		t.Error("alice should not be affected by the collision")
+	}
+	alice.send("PING :still here")
+	alice.expect("PONG")
+}
+
+func TestLinkSquit(t *testing.T) {
+	a := newLinkedServer("a.test", "b.test")
+	b := newLinkedServer("b.test", "a.test", "c.test")
+	c := newLinkedServer("c.test", "b.test")
+	linkServers(t, a, b)
+	linkServers(t, b, c)
+	waitFor(t, a, "a.test knows c.test", func() bool { _, ok := a.getServer("c.test"); return ok })
+
+	alice := connectClient(t, a, "alice")
+	carol := connectClient(t, c, "carol")
+	waitFor(t, a, "a.test knows carol", func() bool { _, ok := a.GetClientByNick("carol"); return ok })
+	alice.send("JOIN #x")
+	alice.expect("JOIN #x")
+	carol.send("JOIN #x")
+	alice.expect(":carol!user@", "JOIN #x")
+
+	alice.send("SQUIT c.test :no privileges")
+	alice.expect(" 481 ")
+
+	alice.send("OPER oper operpass")
+	alice.expect(" 381 ")
+	alice.send("SQUIT c.test :splitting")
+	alice.expect(":carol!user@", "QUIT")
+	for _, s := range []*Server{a, b} {
+		waitFor(t, s, s.Config.Name+" forgot c.test", func() bool {
+			_, known := s.getServer("c.test")
+			_, found := s.GetClientByNick("carol")
+			return !known && !found
+		})
+	}
+	waitFor(t, a, "carol left #x", func() bool {
+		channel, ok := a.GetChannel("#x")
+		return ok && len(channel.getMembers()) == 1
+	})
+	waitFor(t, c, "c.test forgot the other servers", func() bool { return len(c.GetServers()) == 0 })
+	if _, ok := c.GetClientByNick("alice"); ok {
+		t.Error("c.test should have removed alice")
+	}
+	if len(a.GetServers()) != 1 {
+		t.Error("a.test should still be linked with b.test")
+	}
+}
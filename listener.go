@@ -0,0 +1,206 @@
+package irc
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ListenerConfig describes an address the server accepts connections on
+type ListenerConfig struct {
+	Network   string      // "tcp", "tcp4", "tcp6" or "unix", defaults to "tcp"
+	Addr      string      // Address to listen on, the path of the socket for "unix"
+	TLSConfig *tls.Config // Connections are served with TLS if set
+
+	// ProxyProtocol is set if connections come from a proxy that sends a PROXY protocol header with the address of the client, version 1 and 2 are accepted
+	ProxyProtocol bool
+
+	// Class is the connection class of the clients connecting to the listener, it is recorded as Client.Class
+	Class string
+}
+
+// Listener accepts connections as described by its ListenerConfig, Server.Serve records the class of the clients and whether they are secure
+type Listener struct {
+	net.Listener
+	Config ListenerConfig
+}
+
+// Listen opens a Listener as described by the ListenerConfig.
+// A socket left over at the path of a "unix" listener is removed first
+func (l ListenerConfig) Listen() (*Listener, error) {
+	network := l.Network
+	if len(network) == 0 {
+		network = "tcp"
+	}
+	if network == "unix" {
+		if info, err := os.Stat(l.Addr); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(l.Addr)
+		}
+	}
+	listener, err := net.Listen(network, l.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if l.ProxyProtocol {
+		listener = proxyListener{listener}
+	}
+	if l.TLSConfig != nil {
+		listener = tls.NewListener(listener, l.TLSConfig)
+	}
+	return &Listener{Listener: listener, Config: l}, nil
+}
+
+// isSecure reports whether a connection is encrypted with TLS or local over a Unix socket
+func isSecure(conn net.Conn) bool {
+	switch conn.(type) {
+	case *tls.Conn, *net.UnixConn:
+		return true
+	}
+	return false
+}
+
+const (
+	proxyHeaderTimeout = 10 * time.Second // How long a proxy is given to send the PROXY protocol header
+	proxyV1MaxLength   = 107              // Longest version 1 header, CRLF included
+	proxyV2HeaderSize  = 16
+)
+
+var (
+	errProxyHeader   = errors.New("invalid PROXY protocol header")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxyListener accepts connections that start with a PROXY protocol header
+type proxyListener struct {
+	net.Listener
+}
+
+// Accept waits for the next connection, its header is read once it is first used so a slow proxy doesn't hold up the listener
+func (l proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn is a connection whose remote address is given by a PROXY protocol header
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	once   sync.Once
+	remote net.Addr // address of the client, nil if the proxy didn't give one
+	err    error
+}
+
+// readHeader reads the PROXY protocol header. If it is invalid the connection is closed and Read returns the error,
+// which the server logs to its ErrorLog
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.err = fmt.Errorf("reading PROXY header: %w", c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+// Read reads data following the PROXY protocol header
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the address of the client given by the proxy, or the address of the proxy if it gave none
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a version 1 or 2 PROXY protocol header and returns the source address it contains
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	signature, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(signature, proxyV2Signature) {
+		return readProxyV2Header(r)
+	}
+	if !bytes.HasPrefix(signature, []byte("PROXY ")) {
+		return nil, errProxyHeader
+	}
+
+	line := []byte{}
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyV1MaxLength {
+			return nil, errProxyHeader
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) == 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2Header reads a binary version 2 PROXY protocol header
+func readProxyV2Header(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, proxyV2HeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if header[12]&0xF == 0 { // LOCAL command, the connection was made by the proxy itself
+		return nil, nil
+	}
+	switch header[13] >> 4 {
+	case 1: // IPv4
+		if len(payload) < 12 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:]))}, nil
+	case 2: // IPv6
+		if len(payload) < 36 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:]))}, nil
+	}
+	return nil, nil
+}
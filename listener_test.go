@@ -0,0 +1,129 @@
+package irc
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// proxyV2Header builds a version 2 PROXY protocol header with the given command, address family and addresses
+func proxyV2Header(command byte, family byte, addresses []byte) string {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family<<4|1, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(addresses)))
+	return string(append(header, addresses...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0x13, 0x88, 0x1a, 0x0b}
+	ipv6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x13, 0x88, 0x1a, 0x0b)
+	tests := []struct {
+		header string
+		addr   string // empty if the header gives no address
+		err    bool
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 5000 6667\r\n", "192.0.2.1:5000", false},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 5000 6667\r\n", "[2001:db8::1]:5000", false},
+		{"PROXY UNKNOWN\r\n", "", false},
+		{"PROXY TCP4 not-an-ip 198.51.100.1 5000 6667\r\n", "", true},
+		{"PROXY UDP4 192.0.2.1 198.51.100.1 5000 6667\r\n", "", true},
+		{"PROXY TCP4 " + strings.Repeat("1", proxyV1MaxLength) + "\r\n", "", true},
+		{"NICK alice\r\nUSER user 0 * :alice\r\n", "", true},
+		{proxyV2Header(1, 1, ipv4), "192.0.2.1:5000", false},
+		{proxyV2Header(1, 2, ipv6), "[2001:db8::1]:5000", false},
+		{proxyV2Header(0, 1, ipv4), "", false},
+		{proxyV2Header(1, 1, ipv4[:8]), "", true},
+	}
+	for _, test := range tests {
+		r := bufio.NewReader(strings.NewReader(test.header + "NICK alice\r\n"))
+		addr, err := readProxyHeader(r)
+		if (err != nil) != test.err {
+			t.Errorf("header %q: error %v", test.header, err)
+			continue
+		}
+		if test.err {
+			continue
+		}
+		if got := fmt.Sprint(addr); (addr == nil && len(test.addr) != 0) || (addr != nil && got != test.addr) {
+			t.Errorf("header %q: address %v, want %q", test.header, addr, test.addr)
+		}
+		if rest, _ := r.ReadString('\n'); rest != "NICK alice\r\n" {
+			t.Errorf("header %q: %q is left after the header", test.header, rest)
+		}
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	s := newTestServer(ServerConfig{Name: "irc.test"})
+	s.ErrorLog = log.New(io.Discard, "", 0) // the connection without a header is logged
+	listener, err := ListenerConfig{Addr: "127.0.0.1:0", ProxyProtocol: true, Class: "proxied"}.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(context.Background(), listener)
+	defer s.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 5000 6667\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, conn)
+	c.register("alice")
+	if addr := s.SendQStats()["alice"].Addr; addr != "192.0.2.1:5000" {
+		t.Errorf("alice is connected from %s", addr)
+	}
+	s.Do(func() {
+		client, _ := s.GetClientByNick("alice")
+		if client.Class != "proxied" || client.Secure {
+			t.Errorf("alice has class %q and secure %v", client.Class, client.Secure)
+		}
+	})
+
+	conn, err = net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = newTestClient(t, conn) // a connection without a header is closed
+	c.send("NICK bob\r\nUSER user 0 * :bob")
+	c.expectClosed()
+}
+
+func TestUnixListener(t *testing.T) {
+	s := newTestServer(ServerConfig{Name: "irc.test"})
+	path := filepath.Join(t.TempDir(), "ircd.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip("unix sockets unavailable:", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false) // like after a crash, the socket is left over
+	stale.Close()
+	listener, err := ListenerConfig{Network: "unix", Addr: path}.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(context.Background(), listener)
+	defer s.Shutdown(context.Background())
+
+	conn, err := net.DialTimeout("unix", path, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTestClient(t, conn).register("alice")
+	s.Do(func() {
+		client, _ := s.GetClientByNick("alice")
+		if !client.Secure || !client.HasMode(UserModeSecure) {
+			t.Error("clients of a unix socket should be secure")
+		}
+	})
+
+}
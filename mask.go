@@ -0,0 +1,336 @@
+package irc
+
+import (
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Mask is a compiled IRC glob mask as used by bans, LINKS and WHO queries.
+// '*' matches any sequence of characters, '?' matches any single character and '\' escapes the following character
+type Mask struct {
+	raw      string
+	segments []maskSegment // runs separated by '*'
+	anchored bool          // mask has no '*' - segments[0] must match the whole string
+	minLen   int
+	fold     func(string) string
+}
+
+// maskSegment is a run of characters between two '*' wildcards.
+// It is kept as the case folded literal runs between its '?' wildcards, each of which matches a single character
+type maskSegment struct {
+	runs []string
+}
+
+// CompileMask compiles a mask, folding the case of its literal characters with fold. A nil fold compares case sensitively
+func CompileMask(mask string, fold func(string) string) *Mask {
+	if fold == nil {
+		fold = func(s string) string { return s }
+	}
+	m := &Mask{raw: mask, anchored: true, fold: fold}
+
+	var seg maskSegment
+	var text []byte
+	endRun := func() { // literal runs are folded on their own, so folding can't move the wildcards around them
+		run := fold(string(text))
+		seg.runs = append(seg.runs, run)
+		m.minLen += len(run)
+		text = nil
+	}
+	flush := func() {
+		endRun()
+		m.segments = append(m.segments, seg)
+		seg = maskSegment{}
+	}
+
+	for i := 0; i < len(mask); i++ {
+		switch ch := mask[i]; ch {
+		case '\\':
+			if i+1 < len(mask) {
+				i++
+				ch = mask[i]
+			}
+			text = append(text, ch)
+		case '*':
+			flush()
+			m.anchored = false
+		case '?':
+			endRun()
+			m.minLen++
+		default:
+			text = append(text, ch)
+		}
+	}
+	flush()
+
+	return m
+}
+
+// String returns the mask as it was provided
+func (m *Mask) String() string {
+	return m.raw
+}
+
+// IsLiteral returns if the mask contains no wildcards and only matches a single string
+func (m *Mask) IsLiteral() bool {
+	return m.anchored && m.segments[0].literal()
+}
+
+// Match checks if s matches the mask
+func (m *Mask) Match(s string) bool {
+	return m.matchFolded(m.fold(s))
+}
+
+// matchFolded checks an already case folded string against the mask
+func (m *Mask) matchFolded(s string) bool {
+	if len(s) < m.minLen {
+		return false
+	}
+	if m.anchored {
+		end, ok := m.segments[0].matchAt(s, 0)
+		return ok && end == len(s)
+	}
+
+	first := m.segments[0]
+	last := m.segments[len(m.segments)-1]
+	pos, ok := first.matchAt(s, 0)
+	if !ok {
+		return false
+	}
+	end, ok := last.matchEnd(s)
+	if !ok || end < pos {
+		return false
+	}
+
+	// Middle segments are matched greedily left to right, which is sufficient as every gap is a '*'
+	for _, seg := range m.segments[1 : len(m.segments)-1] {
+		_, segEnd, found := seg.index(s[pos:end])
+		if !found {
+			return false
+		}
+		pos += segEnd
+	}
+	return true
+}
+
+// literal returns if the segment has no '?' wildcards
+func (seg maskSegment) literal() bool {
+	return len(seg.runs) == 1
+}
+
+// matchAt checks if the segment matches s starting at offset i, returning the offset where the match ends
+func (seg maskSegment) matchAt(s string, i int) (int, bool) {
+	for j, run := range seg.runs {
+		if j != 0 { // a '?' comes before every run but the first
+			if i >= len(s) {
+				return 0, false
+			}
+			_, size := utf8.DecodeRuneInString(s[i:])
+			i += size
+		}
+		if !strings.HasPrefix(s[i:], run) {
+			return 0, false
+		}
+		i += len(run)
+	}
+	return i, true
+}
+
+// matchEnd checks if the segment matches the end of s, returning the offset where the match starts
+func (seg maskSegment) matchEnd(s string) (int, bool) {
+	i := len(s)
+	for j := len(seg.runs) - 1; j >= 0; j-- {
+		run := seg.runs[j]
+		if !strings.HasSuffix(s[:i], run) {
+			return 0, false
+		}
+		i -= len(run)
+		if j != 0 {
+			if i == 0 {
+				return 0, false
+			}
+			_, size := utf8.DecodeLastRuneInString(s[:i])
+			i -= size
+		}
+	}
+	return i, true
+}
+
+// index returns the first offset in s where the segment matches and the offset where that match ends
+func (seg maskSegment) index(s string) (int, int, bool) {
+	if seg.literal() {
+		i := strings.Index(s, seg.runs[0])
+		return i, i + len(seg.runs[0]), i >= 0
+	}
+	for i := 0; i < len(s); {
+		if end, ok := seg.matchAt(s, i); ok {
+			return i, end, true
+		}
+		_, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+	}
+	return 0, 0, false
+}
+
+// MaskSet is a set of compiled masks that can quickly be checked against a hostmask
+type MaskSet struct {
+	fold  func(string) string
+	exact map[string]*Mask // masks without wildcards, keyed by their folded text
+	globs []*Mask
+	keys  map[string]interface{} // folded text of every mask in globs
+	mutex sync.RWMutex
+}
+
+// NewMaskSet creates and returns a new MaskSet folding case with fold
+func NewMaskSet(fold func(string) string) *MaskSet {
+	if fold == nil {
+		fold = strings.ToLower
+	}
+	s := MaskSet{fold: fold}
+	s.exact = map[string]*Mask{}
+	s.keys = map[string]interface{}{}
+	return &s
+}
+
+// Add adds a mask to the set, returning false if it was already present
+func (s *MaskSet) Add(mask string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m := CompileMask(mask, s.fold)
+	if _, found := s.lookup(m); found {
+		return false
+	}
+	if m.IsLiteral() {
+		s.exact[m.segments[0].runs[0]] = m
+	} else {
+		s.globs = append(s.globs, m)
+		s.keys[s.fold(mask)] = nil
+	}
+	return true
+}
+
+// Remove removes a mask from the set, returning false if it wasn't present
+func (s *MaskSet) Remove(mask string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m := CompileMask(mask, s.fold)
+	i, found := s.lookup(m)
+	if !found {
+		return false
+	}
+	if m.IsLiteral() {
+		delete(s.exact, m.segments[0].runs[0])
+	} else {
+		s.globs = append(s.globs[:i], s.globs[i+1:]...)
+		delete(s.keys, s.fold(mask))
+	}
+	return true
+}
+
+// Has returns if the given mask is part of the set
+func (s *MaskSet) Has(mask string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, found := s.lookup(CompileMask(mask, s.fold))
+	return found
+}
+
+// lookup locates an equivalent mask in the set, returning its index in globs for wildcard masks
+func (s *MaskSet) lookup(m *Mask) (int, bool) {
+	if m.IsLiteral() {
+		_, found := s.exact[m.segments[0].runs[0]]
+		return 0, found
+	}
+	folded := s.fold(m.raw)
+	if _, found := s.keys[folded]; !found {
+		return 0, false
+	}
+	for i, g := range s.globs {
+		if s.fold(g.raw) == folded {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Match checks if the given hostmask matches any mask in the set
+func (s *MaskSet) Match(hostmask string) bool {
+	folded := s.fold(hostmask)
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if _, ok := s.exact[folded]; ok {
+		return true
+	}
+	for _, m := range s.globs {
+		if m.matchFolded(folded) {
+			return true
+		}
+	}
+	return false
+}
+
+// Masks returns the masks contained in the set
+func (s *MaskSet) Masks() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	masks := make([]string, 0, len(s.exact)+len(s.globs))
+	for _, m := range s.exact {
+		masks = append(masks, m.raw)
+	}
+	for _, m := range s.globs {
+		masks = append(masks, m.raw)
+	}
+	return masks
+}
+
+// Len returns how many masks are in the set
+func (s *MaskSet) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.exact) + len(s.globs)
+}
+
+// copy returns a new MaskSet containing the same masks
+func (s *MaskSet) copy() *MaskSet {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	tmp := NewMaskSet(s.fold)
+	for key, m := range s.exact {
+		tmp.exact[key] = m
+	}
+	tmp.globs = append(tmp.globs, s.globs...)
+	for key := range s.keys {
+		tmp.keys[key] = nil
+	}
+	return tmp
+}
+
+// NormalizeMask fills in the missing parts of a nick!user@host mask with wildcards
+func NormalizeMask(mask string) string {
+	p := parseMaskPrefix(mask)
+	if len(p[0]) == 0 {
+		p[0] = "*"
+	}
+	if len(p[1]) == 0 {
+		p[1] = "*"
+	}
+	if len(p[2]) == 0 {
+		p[2] = "*"
+	}
+	return p[0] + "!" + p[1] + "@" + p[2]
+}
+
+// parseMaskPrefix splits a mask into its nick, user and host parts
+func parseMaskPrefix(mask string) [3]string {
+	var p [3]string
+	if i := strings.LastIndexByte(mask, '@'); i >= 0 {
+		p[2] = mask[i+1:]
+		mask = mask[:i]
+	}
+	if i := strings.IndexByte(mask, '!'); i >= 0 {
+		p[1] = mask[i+1:]
+		mask = mask[:i]
+	}
+	p[0] = mask
+	return p
+}
@@ -0,0 +1,99 @@
+package irc
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMaskMatch(t *testing.T) {
+	tests := []struct {
+		mask  string
+		s     string
+		match bool
+	}{
+		{"nick!user@host", "NICK!User@Host", true},
+		{"nick!user@host", "nick!user@host2", false},
+		{"*!*@host", "nick!user@host", true},
+		{"*!*@host", "nick!user@otherhost", false},
+		{"n?ck!*@*", "nick!user@host", true},
+		{"n?ck!*@*", "nck!user@host", false},
+		{"*!*@*.example.com", "nick!user@irc.example.com", true},
+		{"*!*@*.example.com", "nick!user@example.com", false},
+		{"a*b*c", "abc", true},
+		{"a*b*c", "aXbYc", true},
+		{"a*b*c", "acb", false},
+		{"a*?c", "ac", false},
+		{"a*?c", "abc", true},
+		{`\*!*@*`, "*!user@host", true},
+		{`\*!*@*`, "nick!user@host", false},
+		{"?", "é", true}, // '?' matches a character, not a byte
+		{"??", "é", false},
+		{"x?z", "xéz", true},
+		{"*?z", "éz", true},
+		{"*é?*", "aébc", true},
+		{"É?Ö", "éxö", true}, // folding that changes the length of the text keeps the '?'
+		{"É?Ö", "é?ö", true},
+		{"É?Ö", "éö", false},
+	}
+	for _, test := range tests {
+		if match := CompileMask(test.mask, foldPRECIS).Match(test.s); match != test.match {
+			t.Errorf("CompileMask(%q).Match(%q) = %v, want %v", test.mask, test.s, match, test.match)
+		}
+	}
+}
+
+func TestMaskSet(t *testing.T) {
+	masks := NewMaskSet(foldRFC1459)
+	if !masks.Add("Nick!*@*") || masks.Add("nick!*@*") {
+		t.Error("masks differing in case should be the same")
+	}
+	if !masks.Add("nick!user@host") || masks.Len() != 2 {
+		t.Error("literal mask not added")
+	}
+	if !masks.Match("NICK!other@host") || masks.Match("other!user@host2") {
+		t.Error("wrong match result")
+	}
+	if !masks.Remove("NICK!*@*") || masks.Match("nick!other@host") {
+		t.Error("mask not removed")
+	}
+}
+
+func TestChannelModeSetMasks(t *testing.T) {
+	modes := NewChannelModeSet()
+	if modes.GetBanMasks().Len() != 0 || modes.HasMode(ChannelModeBan) {
+		t.Error("reading the ban list should not create it")
+	}
+	modes.AddBanMask("*!*@host")
+	copied := modes.Copy()
+	copied.AddBanMask("*!*@other")
+	if modes.GetBanMasks().Len() != 1 || copied.GetBanMasks().Len() != 2 {
+		t.Error("Copy should not share the ban list")
+	}
+}
+
+// BenchmarkMaskSetMatch checks a joining client against a channel with thousands of ban masks
+func BenchmarkMaskSetMatch(b *testing.B) {
+	for _, n := range []int{1000, 5000} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			masks := NewMaskSet(foldRFC1459)
+			for i := 0; i < n; i++ {
+				switch i % 3 {
+				case 0:
+					masks.Add("*!*@host" + strconv.Itoa(i) + ".example.com")
+				case 1:
+					masks.Add("nick" + strconv.Itoa(i) + "!*@*")
+				default:
+					masks.Add("nick" + strconv.Itoa(i) + "!user@host")
+				}
+			}
+			hostmask := "Joining!user@" + strings.Repeat("sub.", 4) + "example.org"
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if masks.Match(hostmask) {
+					b.Fatal("unexpected match")
+				}
+			}
+		})
+	}
+}
@@ -16,6 +16,7 @@ const (
 	UserModeOperator      UserMode = 'o'
 	UserModeLocalOperator UserMode = 'O'
 	UserModeServerNotice  UserMode = 's' //obsolete
+	UserModeSecure        UserMode = 'z' // Connected with TLS or over a Unix socket, set by the server
 )
 
 // UserModes contains the supported User UserMode types
@@ -27,6 +28,7 @@ var UserModes = map[UserMode]interface{}{
 	UserModeOperator:      nil,
 	UserModeLocalOperator: nil,
 	UserModeServerNotice:  nil,
+	UserModeSecure:        nil,
 }
 
 // UserModeSet provides means for storing and checking UserModes
@@ -113,10 +115,59 @@ const (
 	ChannelModeInvitationMask ChannelMode = 'I'
 )
 
+// ChannelModeType describes how a ChannelMode takes parameters, following the groups of the CHANMODES ISUPPORT token
+type ChannelModeType int
+
+const (
+	ChannelModeTypeList     ChannelModeType = iota // Adds or removes an entry of a list, always takes a parameter
+	ChannelModeTypeParam                           // Setting that always takes a parameter
+	ChannelModeTypeSetParam                        // Setting that only takes a parameter when being set
+	ChannelModeTypeFlag                            // Setting that never takes a parameter
+	ChannelModeTypeMember                          // Member status, takes a nickname as parameter
+)
+
+// ChannelModes contains the ChannelModes that can be changed with MODE and how they take parameters
+var ChannelModes = map[ChannelMode]ChannelModeType{
+	ChannelModeBan:            ChannelModeTypeList,
+	ChannelModeExceptionMask:  ChannelModeTypeList,
+	ChannelModeInvitationMask: ChannelModeTypeList,
+
+	ChannelModeKey: ChannelModeTypeParam,
+
+	ChannelModeLimit: ChannelModeTypeSetParam,
+
+	ChannelModeAnonymous:         ChannelModeTypeFlag,
+	ChannelModeInviteOnly:        ChannelModeTypeFlag,
+	ChannelModeModerated:         ChannelModeTypeFlag,
+	ChannelModeNoOutsideMessages: ChannelModeTypeFlag,
+	ChannelModePrivate:           ChannelModeTypeFlag,
+	ChannelModeSecret:            ChannelModeTypeFlag,
+	ChannelModeQuiet:             ChannelModeTypeFlag,
+	ChannelModeReOp:              ChannelModeTypeFlag,
+	ChannelModeTopic:             ChannelModeTypeFlag,
+
+	ChannelModeOperator: ChannelModeTypeMember,
+	ChannelModeVoice:    ChannelModeTypeMember,
+}
+
+// ChannelMemberPrefix is the prefix shown in front of a nickname for members with a given ChannelMode
+type ChannelMemberPrefix struct {
+	ChannelMode
+	Prefix rune
+}
+
+// ChannelMemberPrefixes lists the member prefixes from highest to lowest rank
+var ChannelMemberPrefixes = []ChannelMemberPrefix{
+	{ChannelModeOperator, '@'},
+	{ChannelModeVoice, '+'},
+}
+
 // ChannelModeSet represents a set of active ChannelModes
 type ChannelModeSet struct {
 	modes map[ChannelMode]interface{}
 	mutex sync.RWMutex
+
+	maskFold func(string) string // case folding used for ban, exception and invitation masks
 }
 
 // NewChannelModeSet creates and returns a new ChannelModeSet
@@ -126,16 +177,29 @@ func NewChannelModeSet() *ChannelModeSet {
 	return &c
 }
 
-// Copy creates and returns a deep copy of a ChannelModeSet
+// Copy creates and returns a deep copy of a ChannelModeSet, including its ban, exception and invitation lists
 func (c *ChannelModeSet) Copy() *ChannelModeSet {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
 	tmp := NewChannelModeSet()
+	tmp.maskFold = c.maskFold
 	for k, v := range c.modes {
+		if masks, ok := v.(*MaskSet); ok {
+			v = masks.copy()
+		}
 		tmp.modes[k] = v
 	}
 	return tmp
 
 }
 
+// reset removes all modes from the set
+func (c *ChannelModeSet) reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.modes = map[ChannelMode]interface{}{}
+}
+
 // AddMode adds a ChannelMode as active
 func (c *ChannelModeSet) AddMode(mode ChannelMode) {
 	c.mutex.Lock()
@@ -200,55 +264,89 @@ func (c *ChannelModeSet) String() string {
 	return s
 }
 
-// AddBanMask sets the channel ban mask
-func (c *ChannelModeSet) AddBanMask(mask string) {
-	masks := c.GetBanMasks()
-	masks[mask] = nil
-	c.AddModeWithValue(ChannelModeBan, masks)
+// maskSet returns the MaskSet stored for a list mode, or nil if no mask was added for it yet
+func (c *ChannelModeSet) maskSet(mode ChannelMode) *MaskSet {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	val, _ := c.modes[mode].(*MaskSet)
+	return val
 }
 
-// GetBanMasks gets the ban masks for the channel
-func (c *ChannelModeSet) GetBanMasks() map[string]interface{} {
-	val := c.GetMode(ChannelModeBan)
-	if val == nil {
-		return make(map[string]interface{}, 0)
+// masks returns the MaskSet of a list mode, an empty set that isn't stored if no mask was added for it yet
+func (c *ChannelModeSet) masks(mode ChannelMode) *MaskSet {
+	if val := c.maskSet(mode); val != nil {
+		return val
+	}
+	return NewMaskSet(c.maskFold)
+}
+
+// addMask adds a mask to the list of a list mode, creating the list if needed. It returns false if the mask was already present
+func (c *ChannelModeSet) addMask(mode ChannelMode, mask string) bool {
+	c.mutex.Lock()
+	val, ok := c.modes[mode].(*MaskSet)
+	if !ok {
+		val = NewMaskSet(c.maskFold)
+		c.modes[mode] = val
 	}
-	return val.(map[string]interface{})
+	c.mutex.Unlock()
+	return val.Add(mask)
+}
+
+// removeMask removes a mask from the list of a list mode, returning false if it wasn't present
+func (c *ChannelModeSet) removeMask(mode ChannelMode, mask string) bool {
+	val := c.maskSet(mode)
+	return val != nil && val.Remove(mask)
+}
+
+// matchMasks checks if a hostmask matches a mask in the list of a list mode
+func (c *ChannelModeSet) matchMasks(mode ChannelMode, hostmask string) bool {
+	val := c.maskSet(mode)
+	return val != nil && val.Match(hostmask)
+}
+
+// AddBanMask adds a mask to the channel ban list, returning false if it was already present
+func (c *ChannelModeSet) AddBanMask(mask string) bool {
+	return c.addMask(ChannelModeBan, mask)
+}
+
+// RemoveBanMask removes a mask from the channel ban list, returning false if it wasn't present
+func (c *ChannelModeSet) RemoveBanMask(mask string) bool {
+	return c.removeMask(ChannelModeBan, mask)
+}
+
+// GetBanMasks gets the ban masks for the channel
+func (c *ChannelModeSet) GetBanMasks() *MaskSet {
+	return c.masks(ChannelModeBan)
+}
 
+// AddExceptionMask adds a mask to the channel exception list, returning false if it was already present
+func (c *ChannelModeSet) AddExceptionMask(mask string) bool {
+	return c.addMask(ChannelModeExceptionMask, mask)
 }
 
-// AddExceptionMask sets the channel exception mask
-func (c *ChannelModeSet) AddExceptionMask(mask string) {
-	masks := c.GetExceptionMasks()
-	masks[mask] = nil
-	c.AddModeWithValue(ChannelModeExceptionMask, masks)
+// RemoveExceptionMask removes a mask from the channel exception list, returning false if it wasn't present
+func (c *ChannelModeSet) RemoveExceptionMask(mask string) bool {
+	return c.removeMask(ChannelModeExceptionMask, mask)
 }
 
 // GetExceptionMasks gets the exception masks for the channel
-func (c *ChannelModeSet) GetExceptionMasks() map[string]interface{} {
-	val := c.GetMode(ChannelModeExceptionMask)
-	if val == nil {
-		return make(map[string]interface{}, 0)
-	}
-	return val.(map[string]interface{})
+func (c *ChannelModeSet) GetExceptionMasks() *MaskSet {
+	return c.masks(ChannelModeExceptionMask)
+}
 
+// AddInvitationMask adds a mask to the channel invitation list, returning false if it was already present
+func (c *ChannelModeSet) AddInvitationMask(mask string) bool {
+	return c.addMask(ChannelModeInvitationMask, mask)
 }
 
-// AddInvitationMask sets the channel invitation mask
-func (c *ChannelModeSet) AddInvitationMask(mask string) {
-	masks := c.GetInvitationMasks()
-	masks[mask] = nil
-	c.AddModeWithValue(ChannelModeInvitationMask, masks)
+// RemoveInvitationMask removes a mask from the channel invitation list, returning false if it wasn't present
+func (c *ChannelModeSet) RemoveInvitationMask(mask string) bool {
+	return c.removeMask(ChannelModeInvitationMask, mask)
 }
 
 // GetInvitationMasks gets the invitation masks for the channel
-func (c *ChannelModeSet) GetInvitationMasks() map[string]interface{} {
-	val := c.GetMode(ChannelModeInvitationMask)
-	if val == nil {
-		return make(map[string]interface{}, 0)
-	}
-	return val.(map[string]interface{})
-
+func (c *ChannelModeSet) GetInvitationMasks() *MaskSet {
+	return c.masks(ChannelModeInvitationMask)
 }
 
 // SetLimit sets the channel member limit
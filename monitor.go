@@ -0,0 +1,186 @@
+package irc
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/sorcix/irc"
+)
+
+// monitorTargets returns the nicknames a client is monitoring
+func (c *Client) monitorTargets() []string {
+	c.Server.monitorMutex.RLock()
+	defer c.Server.monitorMutex.RUnlock()
+	targets := make([]string, 0, len(c.monitoring))
+	for _, nick := range c.monitoring {
+		targets = append(targets, nick)
+	}
+	return targets
+}
+
+// addMonitor starts monitoring nicknames for the client.
+// Nicknames past the configured limit are not added and are returned as rejected
+func (c *Client) addMonitor(nicks []string) (added []string, rejected []string) {
+	s := c.Server
+	s.monitorMutex.Lock()
+	defer s.monitorMutex.Unlock()
+	for i, nick := range nicks {
+		folded := s.Casefold(nick)
+		if _, found := c.monitoring[folded]; found {
+			continue
+		}
+		if len(c.monitoring) >= s.Config.MonitorLimit {
+			return added, nicks[i:]
+		}
+		c.monitoring[folded] = nick
+		if s.monitors[folded] == nil {
+			s.monitors[folded] = map[*Client]interface{}{}
+		}
+		s.monitors[folded][c] = nil
+		added = append(added, nick)
+	}
+	return added, nil
+}
+
+// removeMonitor stops monitoring nicknames for the client
+func (c *Client) removeMonitor(nicks []string) {
+	s := c.Server
+	s.monitorMutex.Lock()
+	defer s.monitorMutex.Unlock()
+	for _, nick := range nicks {
+		folded := s.Casefold(nick)
+		delete(c.monitoring, folded)
+		delete(s.monitors[folded], c)
+		if len(s.monitors[folded]) == 0 {
+			delete(s.monitors, folded)
+		}
+	}
+}
+
+// clearMonitor empties the monitor list of the client
+func (c *Client) clearMonitor() {
+	c.removeMonitor(c.monitorTargets())
+}
+
+// getMonitors returns the clients monitoring a nickname
+func (s *Server) getMonitors(nick string) []*Client {
+	s.monitorMutex.RLock()
+	defer s.monitorMutex.RUnlock()
+	watchers := s.monitors[s.Casefold(nick)]
+	clients := make([]*Client, 0, len(watchers))
+	for client := range watchers {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// notifyOnline tells the clients monitoring the client's nickname that it is now online
+func (c *Client) notifyOnline() {
+	for _, watcher := range c.Server.getMonitors(c.Nickname) {
+		watcher.sendMonitorReplies(irc.Message{Prefix: c.Server.Prefix, Command: RPL_MONONLINE}, []string{c.Prefix.String()}, false)
+	}
+}
+
+// notifyOffline tells the clients monitoring a nickname that it is no longer online
+func (s *Server) notifyOffline(nick string) {
+	for _, watcher := range s.getMonitors(nick) {
+		watcher.sendMonitorReplies(irc.Message{Prefix: s.Prefix, Command: RPL_MONOFFLINE}, []string{nick}, false)
+	}
+}
+
+// sendMonitorReplies sends a comma separated list of targets with a monitor numeric, split across as many messages as needed
+func (c *Client) sendMonitorReplies(m irc.Message, targets []string, reply bool) {
+	m.Params = []string{c.Nickname}
+	maxLength := maxLineLength - 2 - len(m.Bytes()) - 2 // Room for CR LF and the " :" in front of the list
+
+	send := func(list []string) {
+		m.Trailing = strings.Join(list, ",")
+		if reply {
+			c.Encode(&m)
+		} else {
+			c.Relay(&m, nil)
+		}
+	}
+	list := []string{}
+	length := 0
+	for _, target := range targets {
+		if len(list) != 0 && length+1+len(target) > maxLength {
+			send(list)
+			list, length = []string{}, 0
+		}
+		if len(list) != 0 {
+			length++
+		}
+		list = append(list, target)
+		length += len(target)
+	}
+	if len(list) != 0 {
+		send(list)
+	}
+}
+
+// sendMonitorStatus replies with whether each of the nicknames is online or offline
+func (c *Client) sendMonitorStatus(nicks []string) {
+	online, offline := []string{}, []string{}
+	for _, nick := range nicks {
+		if cl, found := c.Server.GetClientByNick(nick); found && cl.Registered {
+			online = append(online, cl.Prefix.String())
+		} else {
+			offline = append(offline, nick)
+		}
+	}
+	c.sendMonitorReplies(irc.Message{Prefix: c.Server.Prefix, Command: RPL_MONONLINE}, online, true)
+	c.sendMonitorReplies(irc.Message{Prefix: c.Server.Prefix, Command: RPL_MONOFFLINE}, offline, true)
+}
+
+// MonitorHandler is a CommandHandler to respond to MONITOR commands from a client
+// Implemented according to the IRCv3 monitor specification
+func MonitorHandler(message *irc.Message, client *Client) {
+	args := message.Params
+	if len(message.Trailing) != 0 {
+		args = append(args, message.Trailing)
+	}
+	if len(args[0]) != 1 {
+		m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_NEEDMOREPARAMS, Params: []string{client.Nickname, MONITOR}, Trailing: "Not enough parameters"}
+		client.Encode(&m)
+		return
+	}
+
+	var nicks []string
+	if len(args) > 1 {
+		for _, nick := range strings.Split(args[1], ",") {
+			if len(nick) != 0 {
+				nicks = append(nicks, nick)
+			}
+		}
+	}
+
+	switch args[0][0] {
+	case '+':
+		added, rejected := client.addMonitor(nicks)
+		if len(rejected) != 0 {
+			m := irc.Message{Prefix: client.Server.Prefix, Command: ERR_MONLISTFULL,
+				Params: []string{client.Nickname, strconv.Itoa(client.Server.Config.MonitorLimit), strings.Join(rejected, ",")}, Trailing: "Monitor list is full."}
+			client.Encode(&m)
+		}
+		client.sendMonitorStatus(added)
+
+	case '-':
+		client.removeMonitor(nicks)
+
+	case 'C', 'c':
+		client.clearMonitor()
+
+	case 'L', 'l':
+		client.sendMonitorReplies(irc.Message{Prefix: client.Server.Prefix, Command: RPL_MONLIST}, client.monitorTargets(), true)
+		m := irc.Message{Prefix: client.Server.Prefix, Command: RPL_ENDOFMONLIST, Params: []string{client.Nickname}, Trailing: "End of MONITOR list"}
+		client.Encode(&m)
+
+	case 'S', 's':
+		client.sendMonitorStatus(client.monitorTargets())
+
+	default:
+		m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_UNKNOWNCOMMAND, Params: []string{client.Nickname, MONITOR}, Trailing: "Unknown MONITOR subcommand"}
+		client.Encode(&m)
+	}
+}
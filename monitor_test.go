@@ -0,0 +1,72 @@
+package irc
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestMonitor(t *testing.T) {
+	s := newTestServer(ServerConfig{Name: "irc.test", MonitorLimit: 3})
+	alice := connectClient(t, s, "alice")
+	connectClient(t, s, "bob")
+
+	alice.send("MONITOR + Bob,carol")
+	alice.expect(" 730 alice :bob!user@")
+	alice.expect(" 731 alice :carol")
+	alice.send("MONITOR + dave,erin,frank")
+	alice.expect(" 734 alice 3 erin,frank ")
+	alice.expect(" 731 alice :dave")
+
+	carol := connectClient(t, s, "carol")
+	alice.expect(" 730 alice :carol!user@")
+	carol.send("NICK carla")
+	alice.expect(" 731 alice :carol")
+	carol.send("QUIT")
+	carol.expectClosed()
+
+	alice.send("MONITOR - dave\r\nMONITOR L")
+	if line := alice.expect(" 732 alice :"); strings.Contains(line, "dave") || !strings.Contains(strings.ToLower(line), "bob") {
+		t.Errorf("monitor list is %q", line)
+	}
+	alice.expect(" 733 alice ")
+	alice.send("MONITOR C\r\nMONITOR S\r\nMONITOR X")
+	alice.expect(" 421 alice MONITOR ")
+	waitFor(t, s, "the monitor list is cleared", func() bool {
+		client, _ := s.GetClientByNick("alice")
+		return len(client.monitorTargets()) == 0 && len(s.getMonitors("bob")) == 0
+	})
+}
+
+func TestMonitorListSplit(t *testing.T) {
+	s := newTestServer(ServerConfig{Name: "irc.test"})
+	alice := connectClient(t, s, "alice")
+	for i := 0; i < 4; i++ {
+		nicks := []string{}
+		for j := 0; j < 20; j++ {
+			nicks = append(nicks, fmt.Sprintf("nickname%d-%d", i, j))
+		}
+		alice.send("MONITOR + " + strings.Join(nicks, ","))
+	}
+	waitFor(t, s, "80 nicknames are monitored", func() bool {
+		client, _ := s.GetClientByNick("alice")
+		return len(client.monitorTargets()) == 80
+	})
+
+	alice.send("MONITOR L")
+	listed, lines := 0, 0
+	for {
+		m := alice.expectCommand(RPL_MONLIST, RPL_ENDOFMONLIST)
+		if m.Command == RPL_ENDOFMONLIST {
+			break
+		}
+		if length := len(m.Bytes()) + 2; length > maxLineLength {
+			t.Errorf("RPL_MONLIST of %d bytes", length)
+		}
+		listed += len(strings.Split(m.Trailing, ","))
+		lines++
+	}
+	if listed != 80 || lines < 2 {
+		t.Errorf("got %d nicknames in %d lines", listed, lines)
+	}
+}
@@ -0,0 +1,237 @@
+package irc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sorcix/irc"
+)
+
+// CapMultiline is the IRCv3 capability for sending and receiving messages with several lines
+const CapMultiline = "draft/multiline"
+
+// multilineConcatTag marks a line of a multiline batch that continues the previous line without a line break
+const multilineConcatTag = "draft/multiline-concat"
+
+// multilineBatch collects the lines of a draft/multiline batch sent by a client
+type multilineBatch struct {
+	id      string
+	target  string
+	command string
+	tags    Tags // Tags of the BATCH +id message, which apply to the whole message
+	label   string
+	text    strings.Builder
+	lines   int
+	failed  bool
+}
+
+// multilineCapValue returns the value of the draft/multiline capability, announcing the configured limits
+func multilineCapValue(config ServerConfig) string {
+	return fmt.Sprintf("max-bytes=%d,max-lines=%d", config.MultilineMaxBytes, config.MultilineMaxLines)
+}
+
+// BatchHandler is a CommandHandler to respond to BATCH commands from a client, used to send draft/multiline messages
+// Implemented according to the IRCv3 batch and draft/multiline specifications
+func BatchHandler(message *irc.Message, client *Client) {
+	args := message.Params
+	if len(message.Trailing) != 0 {
+		args = append(args, message.Trailing)
+	}
+	if len(args[0]) < 2 {
+		m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_NEEDMOREPARAMS, Params: []string{client.Nickname, BATCH}, Trailing: "Not enough parameters"}
+		client.Encode(&m)
+		return
+	}
+
+	id := args[0][1:]
+	switch args[0][0] {
+	case '+':
+		if len(args) < 3 || args[1] != BatchMultiline || !client.HasCap(CapMultiline) {
+			client.Fail(BATCH, "INVALID_BATCH", []string{args[0]}, "Unsupported batch")
+			return
+		}
+		if client.multiline != nil {
+			client.Fail(BATCH, "MULTILINE_INVALID", nil, "A multiline batch is already open")
+			return
+		}
+		client.multiline = &multilineBatch{id: id, target: args[2], tags: client.MessageTags().ClientOnly(), label: client.MessageTags()["label"]}
+		if client.response != nil { // The labeled reply is sent once the batch is complete
+			client.response.noAck = true
+		}
+
+	case '-':
+		batch := client.multiline
+		if batch == nil || batch.id != id {
+			client.Fail(BATCH, "INVALID_BATCH", []string{args[0]}, "Unknown batch")
+			return
+		}
+		client.multiline = nil
+		if batch.failed {
+			return
+		}
+		text := batch.text.String()
+		if len(strings.TrimSpace(text)) == 0 {
+			client.Fail(BATCH, "MULTILINE_INVALID", nil, "Multiline batch has no content")
+			return
+		}
+		// Deliver the collected text as a single message through the registered handler, so channel rules apply as usual
+		m := irc.Message{Prefix: client.Prefix, Command: batch.command, Params: []string{batch.target}, Trailing: text}
+		tags := client.tags
+		client.tags = Tags{}
+		for key, value := range batch.tags {
+			client.tags[key] = value
+		}
+		if len(batch.label) != 0 {
+			client.tags["label"] = batch.label
+		}
+		client.Server.CommandsMux.ServeIRC(&m, client)
+		client.tags = tags
+
+	default:
+		client.Fail(BATCH, "INVALID_BATCH", []string{args[0]}, "Invalid batch reference")
+	}
+}
+
+// addMultilineLine adds a PRIVMSG or NOTICE that is part of the open multiline batch of the client.
+// It returns false if the message is not part of a multiline batch and should be handled normally
+func (c *Client) addMultilineLine(message *irc.Message) bool {
+	batch := c.multiline
+	id, ok := c.MessageTags()["batch"]
+	if !ok || batch == nil || batch.id != id {
+		return false
+	}
+	if batch.failed {
+		return true
+	}
+
+	fail := func(code string, context []string, description string) {
+		batch.failed = true
+		c.Fail(BATCH, code, context, description)
+	}
+	if len(message.Params) == 0 || c.Server.Casefold(message.Params[0]) != c.Server.Casefold(batch.target) {
+		target := ""
+		if len(message.Params) != 0 {
+			target = message.Params[0]
+		}
+		fail("MULTILINE_INVALID_TARGET", []string{batch.target, target}, "Message target does not match the batch target")
+		return true
+	}
+	if len(batch.command) == 0 {
+		batch.command = message.Command
+	} else if batch.command != message.Command {
+		fail("MULTILINE_INVALID", nil, "Multiline batches may not mix PRIVMSG and NOTICE")
+		return true
+	}
+
+	_, concat := c.MessageTags()[multilineConcatTag]
+	if concat && len(message.Trailing) == 0 {
+		fail("MULTILINE_INVALID", nil, "Concatenated lines may not be blank")
+		return true
+	}
+	if batch.lines != 0 && !concat {
+		batch.text.WriteByte('\n')
+	}
+	batch.text.WriteString(message.Trailing)
+	batch.lines++
+
+	if batch.lines > c.Server.Config.MultilineMaxLines {
+		fail("MULTILINE_MAX_LINES", []string{strconv.Itoa(c.Server.Config.MultilineMaxLines)}, "Too many lines in multiline batch")
+	} else if batch.text.Len() > c.Server.Config.MultilineMaxBytes {
+		fail("MULTILINE_MAX_BYTES", []string{strconv.Itoa(c.Server.Config.MultilineMaxBytes)}, "Multiline batch is too long")
+	}
+	return true
+}
+
+// deliver sends a message to the client, as a reply to its own command or relayed.
+// PRIVMSG and NOTICE text with several lines, or too long for one line, is sent as a draft/multiline batch to clients that support it,
+// and as one message per line to other clients
+func (c *Client) deliver(m *irc.Message, tags Tags, reply bool) {
+	if fitsLine(m) {
+		if reply {
+			c.EncodeWithTags(m, tags)
+		} else {
+			c.Relay(m, tags)
+		}
+		return
+	}
+
+	lines := strings.Split(m.Trailing, "\n")
+	maxLength := textLength(m)
+
+	if c.HasCap(CapMultiline) && c.HasCap(CapBatch) {
+		batch := c.openBatch(m.Prefix, tags, reply, BatchMultiline, m.Params...)
+		for _, line := range lines {
+			for i, part := range splitLine(line, maxLength) {
+				l := irc.Message{Prefix: m.Prefix, Command: m.Command, Params: m.Params, Trailing: part, EmptyTrailing: len(part) == 0}
+				var lineTags Tags
+				if i != 0 {
+					lineTags = Tags{multilineConcatTag: ""}
+				}
+				batch.send(&l, lineTags)
+			}
+		}
+		batch.End()
+		return
+	}
+
+	first := true
+	for _, line := range lines {
+		for _, part := range splitLine(line, maxLength) {
+			if len(part) == 0 { // Blank lines can't be sent on their own
+				continue
+			}
+			l := irc.Message{Prefix: m.Prefix, Command: m.Command, Params: m.Params, Trailing: part}
+			lineTags := tags
+			if !first { // The msgid belongs to the first message only
+				lineTags = Tags{}
+				for key, value := range tags {
+					if key != "msgid" {
+						lineTags[key] = value
+					}
+				}
+			}
+			first = false
+			if reply {
+				c.EncodeWithTags(&l, lineTags)
+			} else {
+				c.Relay(&l, lineTags)
+			}
+		}
+	}
+}
+
+// textLength returns how much text fits in one line with the prefix, command and parameters of a message
+func textLength(m *irc.Message) int {
+	empty := irc.Message{Prefix: m.Prefix, Command: m.Command, Params: m.Params}
+	return maxLineLength - 2 - len(empty.Bytes()) - 2 // Room for CR LF and the " :" in front of the text
+}
+
+// fitsLine returns false for PRIVMSG and NOTICE text with several lines or too long for one line, which deliver splits up
+func fitsLine(m *irc.Message) bool {
+	if m.Command != irc.PRIVMSG && m.Command != irc.NOTICE {
+		return true
+	}
+	return !strings.Contains(m.Trailing, "\n") && len(m.Trailing) <= textLength(m)
+}
+
+// splitLine splits a line into parts of at most max bytes without breaking up UTF-8 characters
+func splitLine(line string, max int) []string {
+	if max <= 0 || len(line) <= max {
+		return []string{line}
+	}
+	parts := []string{}
+	for len(line) > max {
+		end := max
+		for end > 0 && !utf8.RuneStart(line[end]) {
+			end--
+		}
+		if end == 0 {
+			end = max
+		}
+		parts = append(parts, line[:end])
+		line = line[end:]
+	}
+	return append(parts, line)
+}
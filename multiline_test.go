@@ -0,0 +1,74 @@
+package irc
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSplitLine(t *testing.T) {
+	parts := splitLine("abcdéfghij", 5) // é is two bytes, starting at index 4
+	if strings.Join(parts, "|") != "abcd|éfgh|ij" {
+		t.Errorf("splitLine = %q", parts)
+	}
+	if parts := splitLine("short", 10); len(parts) != 1 || parts[0] != "short" {
+		t.Errorf("splitLine = %q", parts)
+	}
+}
+
+// multilineClients connects alice and bob with the draft/multiline capability and carol without it to a channel #c
+func multilineClients(t *testing.T, s *Server) (alice, bob, carol *testClient) {
+	alice = connectClient(t, s, "alice")
+	bob = connectClient(t, s, "bob")
+	carol = connectClient(t, s, "carol")
+	for _, c := range []*testClient{alice, bob} {
+		c.send("CAP REQ :batch draft/multiline")
+		c.expect("ACK :batch draft/multiline")
+	}
+	for _, c := range []*testClient{alice, bob, carol} {
+		c.send("JOIN #c")
+		c.expect("JOIN #c")
+	}
+	return alice, bob, carol
+}
+
+func TestMultiline(t *testing.T) {
+	s := newTestServer(ServerConfig{Name: "irc.test"})
+	alice, bob, carol := multilineClients(t, s)
+	alice.send(strings.Join([]string{
+		"BATCH +b1 draft/multiline #c",
+		"@batch=b1 PRIVMSG #c :line one",
+		"@batch=b1;draft/multiline-concat PRIVMSG #c : continued",
+		"@batch=b1 PRIVMSG #c :line two",
+		"BATCH -b1",
+	}, "\r\n"))
+
+	start := bob.expect("BATCH +", "draft/multiline #c")
+	ref := strings.Fields(start)[len(strings.Fields(start))-3][1:] // the reference follows BATCH +
+	bob.expect("@batch="+ref, "PRIVMSG #c :line one")
+	if line := bob.expect("@batch="+ref, "PRIVMSG #c :"); !strings.HasSuffix(line, "PRIVMSG #c :line two") {
+		t.Errorf("a line break was added between concatenated lines: %q", line)
+	}
+	bob.expect("BATCH -" + ref)
+
+	carol.expect(":alice!", "PRIVMSG #c :line one continued")
+	carol.expect(":alice!", "PRIVMSG #c :line two")
+}
+
+func TestMultilineLimits(t *testing.T) {
+	s := newTestServer(ServerConfig{Name: "irc.test", MultilineMaxLines: 2, MultilineMaxBytes: 20})
+	alice, _, carol := multilineClients(t, s)
+	alice.send("CAP LS 302")
+	alice.expect("draft/multiline=max-bytes=20,max-lines=2")
+
+	alice.send("BATCH +lines draft/multiline #c\r\n@batch=lines PRIVMSG #c :1\r\n@batch=lines PRIVMSG #c :2\r\n@batch=lines PRIVMSG #c :3\r\nBATCH -lines")
+	alice.expect("FAIL BATCH MULTILINE_MAX_LINES 2 ")
+	alice.send("BATCH +bytes draft/multiline #c\r\n@batch=bytes PRIVMSG #c :" + strings.Repeat("x", 21) + "\r\nBATCH -bytes")
+	alice.expect("FAIL BATCH MULTILINE_MAX_BYTES 20 ")
+	alice.send("BATCH +other draft/multiline #c\r\n@batch=other PRIVMSG #d :x\r\nBATCH -other")
+	alice.expect("FAIL BATCH MULTILINE_INVALID_TARGET #c #d ")
+
+	alice.send("PRIVMSG #c :after the failed batches")
+	if line := carol.expect(":alice!", "PRIVMSG #c :"); !strings.HasSuffix(line, "after the failed batches") {
+		t.Errorf("carol got %q from a failed batch", line)
+	}
+}
@@ -2,33 +2,206 @@ package irc
 
 import "github.com/sorcix/irc"
 
+// Command describes how an IRC command is served, the checks are made by the CommandsMux before the handler is called
+type Command struct {
+	Handler CommandHandler
+	// MinParams is the minimum number of parameters, the trailing parameter included.
+	// If the trailing parameter is needed to reach it, it is moved to Params so handlers can index Params up to MinParams
+	MinParams  int
+	Registered bool // Command is only available to registered clients
+	Oper       bool // Command is only available to IRC operators
+	// Cost is the weight of the command for flood control, 0 counts as 1.
+	// The CommandsMux doesn't limit clients itself, rate limiting middleware added with Use reads it through CommandsMux.Command
+	Cost int
+	// Middleware wraps the handler of this command only, it runs after the checks of the command and the middleware of the mux
+	Middleware []Middleware
+}
+
+// Middleware wraps a CommandHandler, to run code before and after it or to rewrite the message.
+// A middleware drops a message by not calling the handler it wraps. RegisteredHandler and RecoverHandler are middleware
+type Middleware func(CommandHandler) CommandHandler
+
+// WithChecks is a middleware making the checks of a Command like the CommandsMux does before calling a registered handler.
+// It is meant for handlers served outside of a CommandsMux, handlers registered with HandleCommand or Handle are checked already
+func WithChecks(command Command) Middleware {
+	return func(h CommandHandler) CommandHandler {
+		return CommandHandlerFunc(func(message *irc.Message, client *Client) {
+			if command.allowed(message, client) {
+				h.ServeIRC(message, client)
+			}
+		})
+	}
+}
+
+// chain wraps h in the middleware, the first middleware being the outermost one
+func chain(h CommandHandler, middleware []Middleware) CommandHandler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// DefaultCommands is the command table of the handlers provided by this package, see CommandsMux.RegisterDefaults
+var DefaultCommands = map[string]Command{
+	irc.PASS:     {Handler: CommandHandlerFunc(PassHandler), MinParams: 1},
+	irc.NICK:     {Handler: CommandHandlerFunc(NickHandler)},
+	irc.USER:     {Handler: CommandHandlerFunc(UserHandler), MinParams: 4},
+	CAP:          {Handler: CommandHandlerFunc(CapHandler), MinParams: 1},
+	AUTHENTICATE: {Handler: CommandHandlerFunc(AuthenticateHandler), MinParams: 1},
+	irc.PING:     {Handler: CommandHandlerFunc(PingHandler)},
+	irc.PONG:     {Handler: CommandHandlerFunc(PongHandler)},
+	irc.QUIT:     {Handler: CommandHandlerFunc(QuitHandler)},
+	irc.SERVER:   {Handler: CommandHandlerFunc(ServerHandler), MinParams: 3},
+
+	irc.JOIN:    {Handler: CommandHandlerFunc(JoinHandler), MinParams: 1, Registered: true},
+	irc.PART:    {Handler: CommandHandlerFunc(PartHandler), MinParams: 1, Registered: true},
+	irc.PRIVMSG: {Handler: CommandHandlerFunc(PrivMsgHandler), Registered: true},
+	irc.NOTICE:  {Handler: CommandHandlerFunc(NoticeHandler), Registered: true},
+	TAGMSG:      {Handler: CommandHandlerFunc(TagMsgHandler), Registered: true},
+	BATCH:       {Handler: CommandHandlerFunc(BatchHandler), MinParams: 1, Registered: true},
+	irc.WHO:     {Handler: CommandHandlerFunc(WhoHandler), Registered: true, Cost: 2},
+	irc.TOPIC:   {Handler: CommandHandlerFunc(TopicHandler), MinParams: 1, Registered: true},
+	irc.AWAY:    {Handler: CommandHandlerFunc(AwayHandler), Registered: true},
+	irc.MODE:    {Handler: CommandHandlerFunc(ModeHandler), MinParams: 1, Registered: true},
+	irc.NAMES:   {Handler: CommandHandlerFunc(NamesHandler), Registered: true, Cost: 2},
+	irc.MOTD:    {Handler: CommandHandlerFunc(MOTDHandler), Registered: true, Cost: 2},
+	irc.LIST:    {Handler: CommandHandlerFunc(ListHandler), Registered: true, Cost: 5},
+	irc.KICK:    {Handler: CommandHandlerFunc(KickHandler), MinParams: 2, Registered: true},
+	irc.TIME:    {Handler: CommandHandlerFunc(TimeHandler), Registered: true},
+	irc.VERSION: {Handler: CommandHandlerFunc(VersionHandler), Registered: true},
+	irc.LINKS:   {Handler: CommandHandlerFunc(LinksHandler), Registered: true, Cost: 2},
+	irc.INVITE:  {Handler: CommandHandlerFunc(InviteHandler), MinParams: 2, Registered: true},
+	irc.ISON:    {Handler: CommandHandlerFunc(IsonHandler), MinParams: 1, Registered: true},
+	irc.OPER:    {Handler: CommandHandlerFunc(OperHandler), MinParams: 2, Registered: true, Cost: 3},
+	irc.SQUIT:   {Handler: CommandHandlerFunc(SquitHandler), MinParams: 1, Registered: true, Oper: true},
+	MONITOR:     {Handler: CommandHandlerFunc(MonitorHandler), MinParams: 1, Registered: true},
+	SETNAME:     {Handler: CommandHandlerFunc(SetNameHandler), Registered: true},
+	CHATHISTORY: {Handler: CommandHandlerFunc(ChatHistoryHandler), Registered: true, Cost: 3},
+}
+
 // CommandsMux multiplexes incoming IRC commands
 type CommandsMux struct {
-	commands map[string]CommandHandler
+	commands   map[string]Command
+	middleware []Middleware
+	handler    CommandHandler // dispatch wrapped in the middleware
 }
 
 // NewCommandsMux creates and returns a new CommandsMux
 func NewCommandsMux() CommandsMux {
-	return CommandsMux{commands: map[string]CommandHandler{}}
+	return CommandsMux{commands: map[string]Command{}}
 }
 
-// Handle registers the given CommandHandler for a given IRC command
+// RegisterDefaults registers the handlers of this package for the commands of DefaultCommands
+func (c *CommandsMux) RegisterDefaults() {
+	for name, command := range DefaultCommands {
+		c.HandleCommand(name, command)
+	}
+}
+
+// HandleCommand registers the given Command for a given IRC command.
+// Middleware added to the command before, with UseFor, is kept and runs before the middleware of the given Command
+func (c *CommandsMux) HandleCommand(name string, command Command) {
+	if existing, ok := c.commands[name]; ok && len(existing.Middleware) != 0 {
+		command.Middleware = append(append([]Middleware{}, existing.Middleware...), command.Middleware...)
+	}
+	c.commands[name] = command
+}
+
+// Use adds middleware around the dispatch of every command. Middleware runs in the order it was added,
+// the first one sees the message first. The command is looked up after the middleware has run, so it can rewrite message.Command
+func (c *CommandsMux) Use(middleware ...Middleware) {
+	c.middleware = append(c.middleware, middleware...)
+	c.handler = chain(CommandHandlerFunc(c.dispatch), c.middleware)
+}
+
+// UseFor adds middleware around the handler of a given IRC command, after the middleware added with Use.
+// It may be called before a handler is registered for the command, the command stays unknown to clients until then
+func (c *CommandsMux) UseFor(name string, middleware ...Middleware) {
+	command := c.commands[name]
+	command.Middleware = append(command.Middleware, middleware...)
+	c.commands[name] = command
+}
+
+// Handle registers the given CommandHandler for a given IRC command.
+// If the command is already registered, only its handler is replaced and the checks and middleware of the command are kept.
+// Otherwise the command gets the checks of its entry in DefaultCommands, so the handlers of this package can be registered on their own
 func (c *CommandsMux) Handle(command string, handler CommandHandler) {
-	c.commands[command] = handler
+	cmd, ok := c.commands[command]
+	if !ok {
+		cmd = DefaultCommands[command]
+	}
+	cmd.Handler = handler
+	c.commands[command] = cmd
 }
 
 // HandleFunc registers the given handler function for a given IRC command
 func (c *CommandsMux) HandleFunc(command string, handler CommandHandlerFunc) {
-	c.commands[command] = CommandHandler(handler)
+	c.Handle(command, CommandHandler(handler))
+}
+
+// Command returns the registered Command for a given IRC command, ok is false if no handler is registered for it
+func (c *CommandsMux) Command(name string) (Command, bool) {
+	command, ok := c.commands[name]
+	return command, ok && command.Handler != nil
 }
 
-// ServeIRC dispatches the incoming IRC command to the appropriate handler
+// ServeIRC dispatches the incoming IRC command to the appropriate handler through the middleware.
+// Replies to commands with a label tag are sent with the label once the handler has finished
 func (c *CommandsMux) ServeIRC(message *irc.Message, client *Client) {
-	h, ok := c.commands[message.Command]
-	if !ok {
-		m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_UNKNOWNCOMMAND, Params: []string{client.Nickname}}
+	if client.startLabeledResponse() {
+		defer client.finishLabeledResponse()
+	}
+	if c.handler == nil {
+		c.dispatch(message, client)
+		return
+	}
+	c.handler.ServeIRC(message, client)
+}
+
+// dispatch checks the command and calls its handler
+func (c *CommandsMux) dispatch(message *irc.Message, client *Client) {
+	command, ok := c.commands[message.Command]
+	if !ok || command.Handler == nil {
+		m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_UNKNOWNCOMMAND, Params: []string{client.Nickname, message.Command}, Trailing: "Unknown command"}
 		client.Encode(&m)
 		return
 	}
-	h.ServeIRC(message, client)
+	if !command.allowed(message, client) {
+		return
+	}
+	if len(command.Middleware) == 0 {
+		command.Handler.ServeIRC(message, client)
+		return
+	}
+	chain(command.Handler, command.Middleware).ServeIRC(message, client)
+}
+
+// allowed checks that the client can use the command with the parameters of the message, replying with an error otherwise
+func (command Command) allowed(message *irc.Message, client *Client) bool {
+	nick := client.Nickname
+	if len(nick) == 0 {
+		nick = "*"
+	}
+	if command.Registered && !client.Registered {
+		m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_NOTREGISTERED, Params: []string{nick}, Trailing: "You have not registered"}
+		client.Encode(&m)
+		return false
+	}
+	if command.Oper && !client.HasMode(UserModeOperator) && !client.HasMode(UserModeLocalOperator) {
+		m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_NOPRIVILEGES, Params: []string{nick}, Trailing: "Permission Denied- You're not an IRC operator"}
+		client.Encode(&m)
+		return false
+	}
+	if len(message.Params) >= command.MinParams {
+		return true
+	}
+	if len(message.Params)+1 == command.MinParams && (len(message.Trailing) != 0 || message.EmptyTrailing) {
+		message.Params = append(message.Params, message.Trailing)
+		message.Trailing = ""
+		message.EmptyTrailing = false
+		return true
+	}
+	m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_NEEDMOREPARAMS, Params: []string{nick, message.Command}, Trailing: "Not enough parameters"}
+	client.Encode(&m)
+	return false
 }
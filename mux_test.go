@@ -0,0 +1,97 @@
+package irc
+
+import (
+	"testing"
+
+	"github.com/sorcix/irc"
+)
+
+// TestHandleWithoutCommand checks that handlers of this package registered with Handle get the checks of DefaultCommands
+func TestHandleWithoutCommand(t *testing.T) {
+	s := NewServer(ServerConfig{Name: "irc.test"})
+	for name, handler := range map[string]CommandHandlerFunc{
+		"NICK": NickHandler, "USER": UserHandler, "KICK": KickHandler, "MODE": ModeHandler, "INVITE": InviteHandler,
+		"TOPIC": TopicHandler, "OPER": OperHandler, "SQUIT": SquitHandler, "MONITOR": MonitorHandler, "BATCH": BatchHandler,
+	} {
+		s.CommandsMux.HandleFunc(name, handler)
+	}
+	client := connectClient(t, s, "alice")
+
+	for _, line := range []string{"KICK #x", "MODE", "INVITE bob", "TOPIC", "OPER oper", "MONITOR", "BATCH"} {
+		client.send(line)
+		client.expect(" 461 ")
+	}
+	client.send("SQUIT irc.test")
+	client.expect(" 481 ")
+}
+
+// TestUseForBeforeHandler checks that middleware added with UseFor works whether the command is registered before or after it
+func TestUseForBeforeHandler(t *testing.T) {
+	s := NewServer(ServerConfig{Name: "irc.test"})
+	called := map[string]int{}
+	count := func(h CommandHandler) CommandHandler {
+		return CommandHandlerFunc(func(message *irc.Message, client *Client) {
+			called[message.Command]++
+			h.ServeIRC(message, client)
+		})
+	}
+	s.CommandsMux.UseFor(irc.PING, count)
+	s.CommandsMux.UseFor("UNHANDLED", count)
+	s.CommandsMux.RegisterDefaults()
+	client := connectClient(t, s, "alice")
+
+	client.send("UNHANDLED")
+	client.expect(" 421 alice UNHANDLED ")
+	client.send("PING :alive")
+	client.expect("PONG")
+	s.Do(func() {})
+	if called[irc.PING] != 1 || called["UNHANDLED"] != 0 {
+		t.Error("middleware added with UseFor was not kept:", called)
+	}
+	if _, ok := s.CommandsMux.Command("UNHANDLED"); ok {
+		t.Error("a command without a handler should not be reported as registered")
+	}
+}
+
+// TestCommandCost checks that middleware added with Use can charge the cost of a command
+func TestCommandCost(t *testing.T) {
+	s := newTestServer(ServerConfig{Name: "irc.test"})
+	charged := map[string]int{}
+	s.CommandsMux.Use(func(h CommandHandler) CommandHandler {
+		return CommandHandlerFunc(func(message *irc.Message, client *Client) {
+			if command, ok := s.CommandsMux.Command(message.Command); ok {
+				charged[client.Nickname] += command.Cost
+			}
+			h.ServeIRC(message, client)
+		})
+	})
+	client := connectClient(t, s, "alice")
+	s.Do(func() { charged["alice"] = 0 })
+
+	client.send("LIST")
+	client.expect(" 323 ")
+	client.send("WHO alice")
+	client.expect(" 315 ")
+	s.Do(func() {
+		if charged["alice"] != 7 {
+			t.Error("LIST and WHO should cost 7, charged", charged["alice"])
+		}
+	})
+}
+
+func TestWithChecks(t *testing.T) {
+	s := newTestServer(ServerConfig{Name: "irc.test"})
+	called := false
+	handler := WithChecks(Command{MinParams: 2, Oper: true})(CommandHandlerFunc(func(message *irc.Message, client *Client) { called = true }))
+	s.CommandsMux.HandleCommand("CUSTOM", Command{Handler: CommandHandlerFunc(func(message *irc.Message, client *Client) {
+		handler.ServeIRC(message, client)
+	})})
+	client := connectClient(t, s, "alice")
+	client.send("CUSTOM a b")
+	client.expect(" 481 ")
+	s.Do(func() {
+		if called {
+			t.Error("handler called for a client that is not an operator")
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package irc
+
+import (
+	"github.com/sorcix/irc"
+)
+
+// getPeers returns the other clients that share at least one channel with the client
+func (c *Client) getPeers() []*Client {
+	c.channelMutex.RLock()
+	defer c.channelMutex.RUnlock()
+	peers := []*Client{}
+	seen := map[*Client]interface{}{c: nil}
+	for _, channel := range c.channels {
+		for _, member := range channel.getMembers() {
+			if _, found := seen[member]; found {
+				continue
+			}
+			seen[member] = nil
+			peers = append(peers, member)
+		}
+	}
+	return peers
+}
+
+// notifyPeers sends a state change of the client to its peers that enabled the given capability.
+// If includeSelf is set the client itself is also told when it enabled the capability
+func (c *Client) notifyPeers(m *irc.Message, capability string, includeSelf bool) {
+	tags := c.Server.stampTags(m, nil)
+	prepared := prepareMessage(m, tags)
+	for _, peer := range c.getPeers() {
+		if peer.HasCap(capability) {
+			peer.relayPrepared(prepared)
+		}
+	}
+	if includeSelf && c.HasCap(capability) {
+		c.EncodeWithTags(m, tags)
+	}
+}
+
+// notifyAway tells peers that enabled away-notify that the client is now away or back
+func (c *Client) notifyAway() {
+	m := irc.Message{Prefix: c.Prefix, Command: irc.AWAY}
+	if c.HasMode(UserModeAway) {
+		m.Trailing = c.AwayMessage
+	}
+	c.notifyPeers(&m, CapAwayNotify, false)
+}
+
+// ChangeHost changes the username and hostname the client is seen with, notifying clients that enabled chghost.
+// Outside of command handlers it is called through Server.Do
+func (c *Client) ChangeHost(user string, host string) {
+	if c.Prefix == nil {
+		c.Name, c.Host = user, host
+		return
+	}
+	m := irc.Message{Prefix: &irc.Prefix{Name: c.Prefix.Name, User: c.Prefix.User, Host: c.Prefix.Host}, Command: CHGHOST, Params: []string{user, host}}
+	c.Name, c.Host = user, host
+	c.Prefix.User, c.Prefix.Host = user, host
+	c.Server.claimNick(c, c.Nickname)
+	c.notifyPeers(&m, CapChgHost, true)
+}
+
+// SetRealName changes the real name of the client, notifying clients that enabled setname
+func (c *Client) SetRealName(realName string) {
+	c.RealName = realName
+	if c.Prefix == nil {
+		return
+	}
+	m := irc.Message{Prefix: c.Prefix, Command: SETNAME, Trailing: realName}
+	c.Server.claimNick(c, c.Nickname)
+	c.notifyPeers(&m, CapSetName, true)
+}
+
+// SetNameHandler is a CommandHandler to respond to SETNAME commands from a client
+// Implemented according to the IRCv3 setname specification
+func SetNameHandler(message *irc.Message, client *Client) {
+	realName := message.Trailing
+	if len(realName) == 0 && len(message.Params) != 0 {
+		realName = message.Params[0]
+	}
+	if len(realName) == 0 {
+		client.Fail(SETNAME, "INVALID_REALNAME", nil, "Real name can't be empty")
+		return
+	}
+	client.SetRealName(realName)
+}
@@ -0,0 +1,47 @@
+package irc
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNotifyCapabilities(t *testing.T) {
+	s := newTestServer(ServerConfig{Name: "irc.test"})
+	alice := connectClient(t, s, "alice")
+	bob := connectClient(t, s, "bob")
+	bob.send("CAP REQ :away-notify account-notify extended-join chghost echo-message setname")
+	bob.expect("ACK :away-notify")
+	plain := connectClient(t, s, "plain")
+	for _, c := range []*testClient{bob, plain, alice} {
+		c.send("JOIN #c")
+		c.expect("JOIN #c")
+	}
+	bob.expect(":alice!", "JOIN #c * :alice")
+	plain.expect(":alice!", "JOIN #c")
+
+	alice.send("AWAY :gone")
+	bob.expect(":alice!", "AWAY :gone")
+	alice.send("AWAY")
+	if line := bob.expect(":alice!", "AWAY"); strings.Contains(line, "gone") {
+		t.Errorf("coming back is sent as %q", line)
+	}
+
+	s.Do(func() {
+		client, _ := s.GetClientByNick("alice")
+		client.LogIn("alice-account")
+		client.ChangeHost("newuser", "new.host")
+	})
+	bob.expect(":alice!", "ACCOUNT alice-account")
+	bob.expect(":alice!user@", "CHGHOST newuser new.host")
+	alice.send("SETNAME :New Name")
+	bob.expect(":alice!newuser@new.host", "SETNAME :New Name")
+
+	bob.send("PRIVMSG #c :echoed")
+	bob.expect(":bob!", "PRIVMSG #c :echoed")
+
+	// plain only sees the message, none of the notifications
+	alice.send("PRIVMSG #c :done")
+	if line := plain.expect(":alice!"); !strings.HasSuffix(line, "PRIVMSG #c :done") {
+		t.Errorf("plain got %q", line)
+	}
+}
@@ -0,0 +1,40 @@
+package irc
+
+// Commands not defined by github.com/sorcix/irc
+const (
+	CAP          = "CAP"
+	AUTHENTICATE = "AUTHENTICATE"
+	TAGMSG       = "TAGMSG"
+	BATCH        = "BATCH"
+	CHATHISTORY  = "CHATHISTORY"
+	FAIL         = "FAIL"
+	ACCOUNT      = "ACCOUNT"
+	CHGHOST      = "CHGHOST"
+	SETNAME      = "SETNAME"
+	ACK          = "ACK"
+	MONITOR      = "MONITOR"
+)
+
+// Numeric replies not defined by github.com/sorcix/irc
+const (
+	RPL_ISUPPORT = "005"
+
+	ERR_INVALIDCAPCMD = "410"
+	ERR_INPUTTOOLONG  = "417"
+
+	RPL_MONONLINE    = "730"
+	RPL_MONOFFLINE   = "731"
+	RPL_MONLIST      = "732"
+	RPL_ENDOFMONLIST = "733"
+	ERR_MONLISTFULL  = "734"
+
+	RPL_LOGGEDIN    = "900"
+	RPL_LOGGEDOUT   = "901"
+	ERR_NICKLOCKED  = "902"
+	RPL_SASLSUCCESS = "903"
+	ERR_SASLFAIL    = "904"
+	ERR_SASLTOOLONG = "905"
+	ERR_SASLABORTED = "906"
+	ERR_SASLALREADY = "907"
+	RPL_SASLMECHS   = "908"
+)
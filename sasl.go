@@ -0,0 +1,376 @@
+package irc
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sorcix/irc"
+)
+
+// Capability and mechanism names for SASL authentication
+const (
+	CapSASL = "sasl"
+
+	SASLPlain       = "PLAIN"
+	SASLExternal    = "EXTERNAL"
+	SASLScramSHA256 = "SCRAM-SHA-256"
+)
+
+const (
+	saslChunkLength = 400  // Longest AUTHENTICATE payload, longer payloads are split over several messages
+	saslMaxLength   = 8192 // Longest decoded response accepted from a client
+)
+
+var errSASLFailed = errors.New("SASL authentication failed")
+
+// saslMechanism performs the server side of a SASL authentication exchange
+type saslMechanism interface {
+	// next processes a client response, returning the next challenge or the authenticated account once finished
+	next(response []byte) (challenge []byte, account string, err error)
+}
+
+// saslMechanisms contains the supported SASL mechanisms
+var saslMechanisms = map[string]func(client *Client, store AccountStore) saslMechanism{
+	SASLPlain: func(client *Client, store AccountStore) saslMechanism {
+		return &saslPlain{store: store}
+	},
+	SASLExternal: func(client *Client, store AccountStore) saslMechanism {
+		return &saslExternal{client: client, store: store}
+	},
+	SASLScramSHA256: func(client *Client, store AccountStore) saslMechanism {
+		return &saslScram{store: store}
+	},
+}
+
+// saslSession tracks an in progress AUTHENTICATE exchange of a client
+type saslSession struct {
+	mechanism saslMechanism
+	buffer    bytes.Buffer
+}
+
+// SetAccountStore sets the AccountStore used for SASL authentication and offers the sasl capability to clients.
+// Handlers read the store, so it must be called before the server is started or through Server.Do
+func (s *Server) SetAccountStore(store AccountStore) {
+	s.Accounts = store
+	mechanisms := make([]string, 0, len(saslMechanisms))
+	for name := range saslMechanisms {
+		mechanisms = append(mechanisms, name)
+	}
+	sort.Strings(mechanisms)
+	s.AddCapability(CapSASL, strings.Join(mechanisms, ","))
+}
+
+// CertificateFingerprint returns the hex encoded SHA-256 fingerprint of the TLS client certificate, or an empty string if none was provided
+func (c *Client) CertificateFingerprint() string {
+	tlsConn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	certificates := tlsConn.ConnectionState().PeerCertificates
+	if len(certificates) == 0 {
+		return ""
+	}
+	fingerprint := sha256.Sum256(certificates[0].Raw)
+	return hex.EncodeToString(fingerprint[:])
+}
+
+// LogIn records that the client is logged in to an account and notifies the client
+func (c *Client) LogIn(account string) {
+	c.Account = account
+	nick := c.Nickname
+	if len(nick) == 0 {
+		nick = "*"
+	}
+	prefix := nick
+	if c.Prefix != nil {
+		prefix = c.Prefix.String()
+	}
+	m := irc.Message{Prefix: c.Server.Prefix, Command: RPL_LOGGEDIN, Params: []string{nick, prefix, account}, Trailing: "You are now logged in as " + account}
+	c.Encode(&m)
+
+	if c.Registered {
+		m = irc.Message{Prefix: c.Prefix, Command: ACCOUNT, Params: []string{account}}
+		c.notifyPeers(&m, CapAccountNotify, false)
+	}
+}
+
+// AuthenticateHandler is a CommandHandler to respond to AUTHENTICATE commands from a client
+// Implemented according to the IRCv3 SASL Authentication specification
+func AuthenticateHandler(message *irc.Message, client *Client) {
+	nick := client.Nickname
+	if len(nick) == 0 {
+		nick = "*"
+	}
+	fail := func(command string, text string) {
+		client.sasl = nil
+		m := irc.Message{Prefix: client.Server.Prefix, Command: command, Params: []string{nick}, Trailing: text}
+		client.Encode(&m)
+	}
+
+	if client.Server.Accounts == nil || !client.HasCap(CapSASL) {
+		fail(ERR_SASLFAIL, "SASL authentication failed")
+		return
+	}
+	if len(client.Account) != 0 {
+		m := irc.Message{Prefix: client.Server.Prefix, Command: ERR_SASLALREADY, Params: []string{nick}, Trailing: "You have already authenticated using SASL"}
+		client.Encode(&m)
+		return
+	}
+
+	data := message.Params[0]
+	if data == "*" {
+		fail(ERR_SASLABORTED, "SASL authentication aborted")
+		return
+	}
+	if client.saslBusy { // the previous response is still being verified
+		fail(ERR_SASLFAIL, "SASL authentication failed")
+		return
+	}
+
+	if client.sasl == nil { // Starting a new exchange, data is the mechanism
+		newMechanism, ok := saslMechanisms[strings.ToUpper(data)]
+		if !ok {
+			mechanisms, _ := client.Server.Capabilities.Get(CapSASL)
+			m := irc.Message{Prefix: client.Server.Prefix, Command: RPL_SASLMECHS, Params: []string{nick, mechanisms}, Trailing: "are available SASL mechanisms"}
+			client.Encode(&m)
+			fail(ERR_SASLFAIL, "SASL authentication failed")
+			return
+		}
+		client.sasl = &saslSession{mechanism: newMechanism(client, client.Server.Accounts)}
+		m := irc.Message{Prefix: client.Server.Prefix, Command: AUTHENTICATE, Params: []string{"+"}}
+		client.Encode(&m)
+		return
+	}
+
+	if len(data) > saslChunkLength {
+		fail(ERR_SASLTOOLONG, "SASL message too long")
+		return
+	}
+	if data != "+" {
+		client.sasl.buffer.WriteString(data)
+	}
+	if client.sasl.buffer.Len() > base64.StdEncoding.EncodedLen(saslMaxLength) {
+		fail(ERR_SASLTOOLONG, "SASL message too long")
+		return
+	}
+	if len(data) == saslChunkLength { // More data will follow
+		return
+	}
+
+	response, err := base64.StdEncoding.DecodeString(client.sasl.buffer.String())
+	if err != nil {
+		fail(ERR_SASLFAIL, "SASL authentication failed")
+		return
+	}
+	client.sasl.buffer.Reset()
+
+	// Verifying credentials is slow and the AccountStore may have to wait for a database,
+	// so the response is processed by its own goroutine and the result is applied on the state goroutine
+	session := client.sasl
+	client.saslBusy = true
+	go func() {
+		challenge, account, err := session.mechanism.next(response)
+		client.Server.run(func() { client.finishAuthenticate(session, challenge, account, err) })
+	}()
+}
+
+// finishAuthenticate answers a SASL response once it has been processed by the mechanism of the session.
+// The result is dropped if the exchange was aborted in the meantime
+func (c *Client) finishAuthenticate(session *saslSession, challenge []byte, account string, err error) {
+	c.saslBusy = false
+	if c.sasl != session || c.closed() {
+		return
+	}
+	nick := c.Nickname
+	if len(nick) == 0 {
+		nick = "*"
+	}
+	if err != nil {
+		c.sasl = nil
+		m := irc.Message{Prefix: c.Server.Prefix, Command: ERR_SASLFAIL, Params: []string{nick}, Trailing: "SASL authentication failed"}
+		c.Encode(&m)
+		return
+	}
+	if len(account) != 0 {
+		c.sasl = nil
+		c.LogIn(account)
+		m := irc.Message{Prefix: c.Server.Prefix, Command: RPL_SASLSUCCESS, Params: []string{nick}, Trailing: "SASL authentication successful"}
+		c.Encode(&m)
+		return
+	}
+	c.sendAuthenticate(challenge)
+}
+
+// sendAuthenticate sends a SASL challenge to the client, split into chunks of saslChunkLength
+func (c *Client) sendAuthenticate(challenge []byte) {
+	encoded := base64.StdEncoding.EncodeToString(challenge)
+	for {
+		chunk := encoded
+		if len(chunk) > saslChunkLength {
+			chunk = chunk[:saslChunkLength]
+		}
+		encoded = encoded[len(chunk):]
+		if len(chunk) == 0 {
+			chunk = "+"
+		}
+		m := irc.Message{Prefix: c.Server.Prefix, Command: AUTHENTICATE, Params: []string{chunk}}
+		c.Encode(&m)
+		if len(chunk) < saslChunkLength {
+			return
+		}
+	}
+}
+
+// saslPlain implements the PLAIN mechanism - RFC 4616
+type saslPlain struct {
+	store AccountStore
+}
+
+func (p *saslPlain) next(response []byte) ([]byte, string, error) {
+	parts := bytes.Split(response, []byte{0})
+	if len(parts) != 3 {
+		return nil, "", errSASLFailed
+	}
+	authzid, authcid, password := string(parts[0]), string(parts[1]), string(parts[2])
+	if len(authzid) != 0 && authzid != authcid { // Logging in as another user is not supported
+		return nil, "", errSASLFailed
+	}
+	if len(authcid) == 0 || !p.store.CheckPassword(authcid, password) {
+		return nil, "", errSASLFailed
+	}
+	return nil, authcid, nil
+}
+
+// saslExternal implements the EXTERNAL mechanism using the TLS client certificate - RFC 4422 Appendix A
+type saslExternal struct {
+	client *Client
+	store  AccountStore
+}
+
+func (e *saslExternal) next(response []byte) ([]byte, string, error) {
+	fingerprint := e.client.CertificateFingerprint()
+	if len(fingerprint) == 0 {
+		return nil, "", errSASLFailed
+	}
+	account, ok := e.store.CertificateAccount(fingerprint)
+	if !ok {
+		return nil, "", errSASLFailed
+	}
+	if authzid := string(response); len(authzid) != 0 && authzid != account {
+		return nil, "", errSASLFailed
+	}
+	return nil, account, nil
+}
+
+// saslScram implements the SCRAM-SHA-256 mechanism without channel binding - RFC 5802 and RFC 7677
+type saslScram struct {
+	store AccountStore
+
+	account         string
+	credentials     SCRAMCredentials
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	verified        bool
+}
+
+func (s *saslScram) next(response []byte) ([]byte, string, error) {
+	switch {
+	case len(s.serverFirst) == 0:
+		return s.clientFirst(string(response))
+	case !s.verified:
+		return s.clientFinal(string(response))
+	case len(response) == 0: // Client acknowledged the server signature
+		return nil, s.account, nil
+	}
+	return nil, "", errSASLFailed
+}
+
+// clientFirst handles the client-first-message and returns the server-first-message
+func (s *saslScram) clientFirst(message string) ([]byte, string, error) {
+	// gs2-header is the channel binding flag and optional authzid, followed by the bare message
+	parts := strings.SplitN(message, ",", 3)
+	if len(parts) != 3 || (parts[0] != "n" && parts[0] != "y") {
+		return nil, "", errSASLFailed
+	}
+	s.gs2Header = parts[0] + "," + parts[1] + ","
+	s.clientFirstBare = parts[2]
+
+	attributes := scramAttributes(s.clientFirstBare)
+	username, clientNonce := attributes["n"], attributes["r"]
+	if len(username) == 0 || len(clientNonce) == 0 {
+		return nil, "", errSASLFailed
+	}
+	s.account = strings.NewReplacer("=2C", ",", "=3D", "=").Replace(username)
+	if authzid := strings.TrimPrefix(parts[1], "a="); len(authzid) != 0 && authzid != s.account {
+		return nil, "", errSASLFailed
+	}
+
+	credentials, ok := s.store.SCRAMCredentials(s.account)
+	if !ok {
+		return nil, "", errSASLFailed
+	}
+	s.credentials = credentials
+
+	serverNonce := make([]byte, 18)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return nil, "", err
+	}
+	s.nonce = clientNonce + base64.RawStdEncoding.EncodeToString(serverNonce)
+	s.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", s.nonce, base64.StdEncoding.EncodeToString(credentials.Salt), credentials.Iterations)
+	return []byte(s.serverFirst), "", nil
+}
+
+// clientFinal verifies the client-final-message and returns the server-final-message
+func (s *saslScram) clientFinal(message string) ([]byte, string, error) {
+	i := strings.LastIndex(message, ",p=")
+	if i < 0 {
+		return nil, "", errSASLFailed
+	}
+	withoutProof := message[:i]
+	attributes := scramAttributes(message)
+	if attributes["c"] != base64.StdEncoding.EncodeToString([]byte(s.gs2Header)) || attributes["r"] != s.nonce {
+		return nil, "", errSASLFailed
+	}
+	proof, err := base64.StdEncoding.DecodeString(attributes["p"])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, "", errSASLFailed
+	}
+
+	authMessage := []byte(s.clientFirstBare + "," + s.serverFirst + "," + withoutProof)
+	clientSignature := scramHMAC(s.credentials.StoredKey, authMessage)
+	clientKey := make([]byte, len(proof))
+	for j := range proof {
+		clientKey[j] = proof[j] ^ clientSignature[j]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if !hmac.Equal(storedKey[:], s.credentials.StoredKey) {
+		return nil, "", errSASLFailed
+	}
+
+	s.verified = true
+	serverSignature := scramHMAC(s.credentials.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), "", nil
+}
+
+// scramAttributes parses the comma separated key=value attributes of a SCRAM message
+func scramAttributes(message string) map[string]string {
+	attributes := map[string]string{}
+	for _, attribute := range strings.Split(message, ",") {
+		if len(attribute) < 2 || attribute[1] != '=' {
+			continue
+		}
+		attributes[attribute[:1]] = attribute[2:]
+	}
+	return attributes
+}
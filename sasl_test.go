@@ -0,0 +1,129 @@
+package irc
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// saslClient connects a client that enabled the sasl capability to a server with an account alice using password
+func saslClient(t *testing.T, password string) (*Server, *testClient) {
+	s := newTestServer(ServerConfig{Name: "irc.test"})
+	store := NewMemoryAccountStore()
+	if err := store.Add("alice", password); err != nil {
+		t.Fatal(err)
+	}
+	s.SetAccountStore(store)
+	c := connectClient(t, s, "alice")
+	c.send("CAP REQ :sasl")
+	c.expect("ACK :sasl")
+	return s, c
+}
+
+// plainResponse encodes the PLAIN response of alice with password
+func plainResponse(password string) string {
+	return base64.StdEncoding.EncodeToString([]byte("\x00alice\x00" + password))
+}
+
+func TestSASLPlain(t *testing.T) {
+	_, c := saslClient(t, "password")
+	c.send("AUTHENTICATE UNKNOWN")
+	c.expect(" 908 alice ", "PLAIN")
+	c.expect(" 904 alice ")
+
+	c.send("AUTHENTICATE PLAIN")
+	c.expect("AUTHENTICATE +")
+	c.send("AUTHENTICATE *")
+	c.expect(" 906 alice ")
+
+	c.send("AUTHENTICATE PLAIN")
+	c.expect("AUTHENTICATE +")
+	c.send("AUTHENTICATE " + plainResponse("wrong"))
+	c.expect(" 904 alice ")
+
+	c.send("AUTHENTICATE PLAIN")
+	c.expect("AUTHENTICATE +")
+	c.send("AUTHENTICATE " + plainResponse("password"))
+	c.expect(" 900 alice ", " alice :")
+	c.expect(" 903 alice ")
+	c.send("AUTHENTICATE PLAIN")
+	c.expect(" 907 alice ")
+}
+
+func TestSASLChunks(t *testing.T) {
+	password := strings.Repeat("p", 293) // the response is 400 characters long once encoded
+	_, c := saslClient(t, password)
+	response := plainResponse(password)
+	if len(response) != saslChunkLength {
+		t.Fatalf("response is %d characters long", len(response))
+	}
+	c.send("AUTHENTICATE PLAIN")
+	c.expect("AUTHENTICATE +")
+	c.send("AUTHENTICATE " + response + "\r\nAUTHENTICATE +") // a response of exactly 400 characters is ended by +
+	c.expect(" 903 alice ")
+
+	password = strings.Repeat("q", 500)
+	_, c = saslClient(t, password)
+	response = plainResponse(password)
+	c.send("AUTHENTICATE PLAIN")
+	c.expect("AUTHENTICATE +")
+	c.send("AUTHENTICATE " + response[:saslChunkLength] + "\r\nAUTHENTICATE " + response[saslChunkLength:])
+	c.expect(" 903 alice ")
+
+	_, c = saslClient(t, password)
+	c.send("AUTHENTICATE PLAIN")
+	c.expect("AUTHENTICATE +")
+	c.send("AUTHENTICATE " + response[:saslChunkLength+1])
+	c.expect(" 905 alice ")
+}
+
+func TestSASLScram(t *testing.T) {
+	s, c := saslClient(t, "pencil")
+	c.send("AUTHENTICATE " + SASLScramSHA256)
+	c.expect("AUTHENTICATE +")
+
+	clientFirstBare := "n=alice,r=rOprNGfwEbeRWgbNEkqO"
+	c.send("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("n,,"+clientFirstBare)))
+	serverFirst, err := base64.StdEncoding.DecodeString(c.expectCommand(AUTHENTICATE).Params[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	attributes := scramAttributes(string(serverFirst))
+	if !strings.HasPrefix(attributes["r"], "rOprNGfwEbeRWgbNEkqO") {
+		t.Fatalf("server nonce %q doesn't extend the client nonce", attributes["r"])
+	}
+	credentials, _ := s.Accounts.SCRAMCredentials("alice")
+	salt, _ := base64.StdEncoding.DecodeString(attributes["s"])
+	salted := scramHi([]byte("pencil"), salt, credentials.Iterations)
+	clientKey := scramHMAC(salted, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+
+	withoutProof := "c=biws,r=" + attributes["r"]
+	authMessage := []byte(clientFirstBare + "," + string(serverFirst) + "," + withoutProof)
+	proof := scramHMAC(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	c.send("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte(withoutProof+",p="+base64.StdEncoding.EncodeToString(proof))))
+	serverFinal, _ := base64.StdEncoding.DecodeString(c.expectCommand(AUTHENTICATE).Params[0])
+	serverSignature := scramHMAC(scramHMAC(salted, []byte("Server Key")), authMessage)
+	if string(serverFinal) != "v="+base64.StdEncoding.EncodeToString(serverSignature) {
+		t.Fatalf("server-final-message is %q", serverFinal)
+	}
+	c.send("AUTHENTICATE +")
+	c.expect(" 900 alice ", " alice :")
+	c.expect(" 903 alice ")
+}
+
+func TestSASLScramWrongProof(t *testing.T) {
+	_, c := saslClient(t, "pencil")
+	c.send("AUTHENTICATE " + SASLScramSHA256)
+	c.expect("AUTHENTICATE +")
+	c.send("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("n,,n=alice,r=nonce")))
+	serverFirst, _ := base64.StdEncoding.DecodeString(c.expectCommand(AUTHENTICATE).Params[0])
+	proof := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	final := "c=biws,r=" + scramAttributes(string(serverFirst))["r"] + ",p=" + proof
+	c.send("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte(final)))
+	c.expect(" 904 alice ")
+}
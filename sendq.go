@@ -0,0 +1,173 @@
+package irc
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// closeTimeout is how long the messages queued for a closed client are given to be written
+const closeTimeout = 5 * time.Second
+
+var (
+	errSendQExceeded = errors.New("max SendQ exceeded")
+	errClientClosed  = errors.New("client connection closed")
+)
+
+// SendQStats describes the send queue of a client
+type SendQStats struct {
+	Addr     string // Remote address of the connection
+	Messages int    // Messages waiting to be written
+	Bytes    int    // Bytes waiting to be written
+	Peak     int    // Most bytes that have been waiting at once
+	Limit    int    // Bytes that may be waiting before the client is disconnected
+}
+
+// sendQueue holds the messages waiting to be written to a client.
+// Messages are written by their own goroutine, so a slow client doesn't hold up the clients sending to it
+type sendQueue struct {
+	lines    [][]byte
+	messages int // messages not written yet, including the ones being written
+	bytes    int
+	peak     int
+	limit    int
+	closing  bool // set once the connection is to be closed after the queue has been written
+	detached bool // set once the writer is to stop without closing the connection
+	exceeded bool
+	mutex    sync.Mutex
+	queued   chan struct{}
+	done     chan struct{} // closed once the writer has stopped
+}
+
+// startWriter creates the send queue of the client and starts the goroutine writing it to the connection
+func (c *Client) startWriter() {
+	c.sendq = &sendQueue{limit: c.Server.Config.SendQ, queued: make(chan struct{}, 1), done: make(chan struct{})}
+	go c.write()
+}
+
+// enqueue adds a line to the send queue, a client whose queue overflows is disconnected
+func (c *Client) enqueue(line []byte) error {
+	q := c.sendq
+	q.mutex.Lock()
+	if q.closing || q.detached {
+		q.mutex.Unlock()
+		return errClientClosed
+	}
+	if q.bytes+len(line) > q.limit {
+		exceeded := !q.exceeded
+		q.exceeded = true
+		q.mutex.Unlock()
+		if exceeded {
+			c.Server.run(func() { c.disconnect("Max SendQ exceeded", time.Now()) })
+		}
+		return errSendQExceeded
+	}
+	q.lines = append(q.lines, line)
+	q.messages++
+	q.bytes += len(line)
+	if q.bytes > q.peak {
+		q.peak = q.bytes
+	}
+	q.mutex.Unlock()
+	q.signal()
+	return nil
+}
+
+// signal wakes the writer up
+func (q *sendQueue) signal() {
+	select {
+	case q.queued <- struct{}{}:
+	default:
+	}
+}
+
+// write writes queued messages to the connection until the client is closed
+func (c *Client) write() {
+	q := c.sendq
+	defer close(q.done)
+	for range q.queued {
+		q.mutex.Lock()
+		lines := q.lines
+		q.lines = nil
+		q.mutex.Unlock()
+
+		written := 0
+		for _, line := range lines {
+			if _, err := c.conn.Write(line); err != nil {
+				c.conn.Close()
+				return
+			}
+			written += len(line)
+		}
+
+		q.mutex.Lock()
+		q.messages -= len(lines)
+		q.bytes -= written
+		empty := len(q.lines) == 0
+		closing, detached := q.closing, q.detached
+		q.mutex.Unlock()
+		if empty && closing {
+			c.conn.Close()
+			return
+		}
+		if empty && detached {
+			return
+		}
+	}
+}
+
+// closeWriter makes the writer close the connection once the queue has been written, or at the deadline
+func (c *Client) closeWriter(deadline time.Time) error {
+	q := c.sendq
+	q.mutex.Lock()
+	detached := q.detached
+	q.closing = true
+	q.mutex.Unlock()
+	if detached {
+		return c.Conn.Close()
+	}
+	c.conn.SetWriteDeadline(deadline)
+	q.signal()
+	return nil
+}
+
+// detachWriter waits for the queue to be written and stops the writer, leaving the connection open for a link to take over.
+// It waits for the connection, so it must not be called on the state goroutine
+func (c *Client) detachWriter() {
+	q := c.sendq
+	q.mutex.Lock()
+	q.detached = true
+	q.mutex.Unlock()
+	q.signal()
+	<-q.done
+}
+
+// closed reports whether the client has been closed
+func (c *Client) closed() bool {
+	q := c.sendq
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.closing
+}
+
+// SendQStats returns the state of the send queue of the client
+func (c *Client) SendQStats() SendQStats {
+	q := c.sendq
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return SendQStats{Addr: c.conn.RemoteAddr().String(), Messages: q.messages, Bytes: q.bytes, Peak: q.peak, Limit: q.limit}
+}
+
+// SendQStats returns the send queues of the registered clients by their nickname.
+// Like Do, it must not be called from a command handler
+func (s *Server) SendQStats() map[string]SendQStats {
+	stats := map[string]SendQStats{}
+	s.Do(func() { // nicknames change on the state goroutine
+		for _, client := range s.getClients() {
+			if client.Registered {
+				stats[client.Nickname] = client.SendQStats()
+			}
+		}
+	})
+	return stats
+}
@@ -0,0 +1,77 @@
+package irc
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+func TestSendQStats(t *testing.T) {
+	s := newTestServer(ServerConfig{Name: "test.server", SendQ: 4096})
+	ln, err := net.Listen("unix", filepath.Join(t.TempDir(), "ircd.sock"))
+	if err != nil {
+		t.Skip("unix sockets unavailable:", err)
+	}
+	go s.Serve(context.Background(), ln)
+	defer s.Shutdown(context.Background())
+
+	for _, nick := range []string{"alice", "bob"} { // clients of a unix socket share the same address
+		conn, err := net.Dial("unix", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		newTestClient(t, conn).register(nick)
+	}
+
+	stats := s.SendQStats()
+	if len(stats) != 2 {
+		t.Fatalf("got stats for %d clients, want 2: %v", len(stats), stats)
+	}
+	for _, nick := range []string{"alice", "bob"} {
+		if stat, ok := stats[nick]; !ok || stat.Limit != 4096 || stat.Peak == 0 {
+			t.Errorf("stats of %s = %+v, %v", nick, stat, ok)
+		}
+	}
+}
+
+func TestSendQExceeded(t *testing.T) {
+	s := newTestServer(ServerConfig{Name: "test.server", SendQ: 4096})
+	alice := connectClient(t, s, "alice")
+	defer alice.close()
+	alice.send("JOIN #c")
+	alice.expect("JOIN #c")
+
+	// slow reads until it has joined the channel, then leaves what the server sends it unread
+	conn, serverConn := net.Pipe()
+	defer conn.Close()
+	go s.ServeConn(serverConn)
+	go conn.Write([]byte("NICK slow\r\nUSER user 0 * :slow\r\nJOIN #c\r\n"))
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal("slow didn't join the channel:", err)
+		}
+		if m := irc.ParseMessage(line); m != nil && m.Command == irc.JOIN {
+			break
+		}
+	}
+	alice.expect("JOIN", "#c", "slow")
+
+	for i := 0; i < 100; i++ {
+		alice.send(fmt.Sprintf("PRIVMSG #c :%d %s", i, strings.Repeat("x", 100)))
+	}
+	alice.expect("slow", "QUIT", "Max SendQ exceeded")
+	waitFor(t, s, "slow is disconnected", func() bool {
+		_, ok := s.GetClientByNick("slow")
+		return !ok
+	})
+}
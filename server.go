@@ -1,8 +1,11 @@
 package irc
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"log"
 	"net"
 	"sync"
 	"time"
@@ -24,21 +27,95 @@ type Server struct {
 	CommandsMux CommandsMux
 	created     time.Time
 
+	// ISupport contains the tokens advertised to clients with RPL_ISUPPORT, custom tokens may be added with ISupport.Set
+	ISupport *ISupport
+	// Capabilities contains the IRCv3 capabilities offered to clients, use AddCapability and RemoveCapability to change them at runtime
+	Capabilities *CapabilityRegistry
+
 	channels     map[string]*Channel
 	channelMutex sync.RWMutex
 
+	monitors     map[string]map[*Client]interface{} // clients monitoring each casefolded nickname
+	monitorMutex sync.RWMutex
+
 	OperAuthMethod
+
+	// Accounts verifies SASL credentials, set it with SetAccountStore to offer the sasl capability
+	Accounts AccountStore
+
+	// History records channel and direct messages, set it with SetHistoryStore to offer the draft/chathistory capability
+	History HistoryStore
+
+	links        map[string]*Link         // direct links to other servers
+	servers      map[string]*RemoteServer // every other server of the network
+	serverTokens int
+	linkMutex    sync.RWMutex
+
+	// Admit is called by Serve from the goroutine of each accepted connection with the ListenerConfig of its listener. It
+	// returns the class of the client and a function, which may be nil, called once the connection has been handled.
+	// Connections it returns an error for are sent an ERROR with the error and closed. If nil, every connection is served
+	// in the class of its listener
+	Admit func(conn net.Conn, listener ListenerConfig) (class string, release func(), err error)
+
+	// ErrorLog receives errors the server can't report to a client, like failures to accept connections.
+	// If nil, errors are logged with the standard logger of the log package
+	ErrorLog *log.Logger
+
+	// Cluster shares nicknames, channels and messages with other Server instances, set it with SetClusterBus
+	Cluster        ClusterBus
+	clusterClients map[string]*Client // clients standing in for users of other cluster nodes
+	clusterMutex   sync.Mutex
+
+	listeners      map[net.Listener]interface{} // listeners Serve is accepting connections on
+	handlers       int                          // number of connections being handled
+	handlersDone   chan struct{}                // closed once the last connection has been handled after Shutdown
+	shuttingDown   bool
+	lifecycleMutex sync.Mutex
+
+	state *stateLoop // functions waiting for the state goroutine, which changes the clients, channels and links
 }
 
+// ErrServerClosed is returned by Serve and Start once Shutdown has been called
+var ErrServerClosed = errors.New("irc: server closed")
+
 // ServerConfig contains configuration data for seeding a server
 type ServerConfig struct {
 	Name      string
+	Network   string
 	MOTD      string
 	Version   string
-	TLSConfig *tls.Config
-	Addr      string
+	Info      string      // Description of the server shown in LINKS, defaults to "<name> - Golang IRC server"
+	TLSConfig *tls.Config // TLS settings of the listener on Addr
+	Addr      string      // Address of a TCP listener, Listeners describes more listeners
+
+	// Listeners lists the addresses the server accepts connections on when started with Start
+	Listeners []ListenerConfig
+
+	NickLength    int // Maximum nickname length, defaults to 30
+	ChannelLength int // Maximum channel name length, defaults to 50
+	TopicLength   int // Maximum topic length, defaults to 390
+
+	ChatHistoryLimit int // Maximum number of messages returned by a single CHATHISTORY command, defaults to 100
+
+	MultilineMaxBytes int // Maximum length of the text of a draft/multiline message, defaults to 4096
+	MultilineMaxLines int // Maximum number of lines of a draft/multiline message, defaults to 100
+
+	MonitorLimit int // Maximum number of nicknames a client may MONITOR, defaults to 100
 
 	Password string
+
+	// SendQ is the maximum number of bytes waiting to be written to a client, clients that don't read fast enough to stay
+	// below it are disconnected. Defaults to 1048576
+	SendQ int
+
+	// ShutdownMessage is the reason given to clients in QUIT and ERROR messages when the server shuts down, defaults to "Server shutting down"
+	ShutdownMessage string
+
+	// Links lists the servers this server may be linked with - RFC 2813
+	Links []LinkConfig
+
+	// CaseMapping determines how nicknames and channel names are compared, defaults to CaseMappingRFC1459
+	CaseMapping CaseMapping
 }
 
 // NewServer creates and returns a new Server based on the provided config
@@ -51,15 +128,74 @@ func NewServer(config ServerConfig) *Server {
 	s.clientsByNick = map[string]*Client{}
 	s.Prefix = &irc.Prefix{Name: config.Name}
 	s.channels = map[string]*Channel{}
+	s.monitors = map[string]map[*Client]interface{}{}
+	s.links = map[string]*Link{}
+	s.servers = map[string]*RemoteServer{}
+	s.clusterClients = map[string]*Client{}
+	s.listeners = map[net.Listener]interface{}{}
+	s.handlersDone = make(chan struct{})
 	if len(s.Config.Name) == 0 {
 		s.Config.Name = "localhost"
 	}
 	if len(s.Config.Version) == 0 {
 		s.Config.Version = "1.0"
 	}
+	if s.Config.CaseMapping.Fold == nil {
+		s.Config.CaseMapping = CaseMappingRFC1459
+	}
+	if len(s.Config.Info) == 0 {
+		s.Config.Info = fmt.Sprintf("%s - Golang IRC server", s.Config.Name)
+	}
+	if len(s.Config.Network) == 0 {
+		s.Config.Network = s.Config.Name
+	}
+	if s.Config.NickLength == 0 {
+		s.Config.NickLength = 30
+	}
+	if s.Config.ChannelLength == 0 {
+		s.Config.ChannelLength = 50
+	}
+	if s.Config.TopicLength == 0 {
+		s.Config.TopicLength = 390
+	}
+	if s.Config.ChatHistoryLimit == 0 {
+		s.Config.ChatHistoryLimit = 100
+	}
+	if s.Config.MultilineMaxBytes == 0 {
+		s.Config.MultilineMaxBytes = 4096
+	}
+	if s.Config.MultilineMaxLines == 0 {
+		s.Config.MultilineMaxLines = 100
+	}
+	if s.Config.MonitorLimit == 0 {
+		s.Config.MonitorLimit = 100
+	}
+	if s.Config.SendQ == 0 {
+		s.Config.SendQ = 1 << 20
+	}
+	if len(s.Config.ShutdownMessage) == 0 {
+		s.Config.ShutdownMessage = "Server shutting down"
+	}
+	s.ISupport = newServerISupport(&s)
+	s.Capabilities = NewCapabilityRegistry()
+	for _, capability := range []string{CapCapNotify, CapEchoMessage, CapAwayNotify, CapAccountNotify, CapExtendedJoin,
+		CapChgHost, CapSetName, CapInviteNotify, CapMultiPrefix, CapUserhostInNames, CapLabeledResponse} {
+		s.Capabilities.Add(capability, "")
+	}
+	s.Capabilities.Add(CapMessageTags, "")
+	s.Capabilities.Add(CapServerTime, "")
+	s.Capabilities.Add(CapAccountTag, "")
+	s.Capabilities.Add(CapBatch, "")
+	s.Capabilities.Add(CapMultiline, multilineCapValue(s.Config))
+	s.startStateLoop()
 	return &s
 }
 
+// Casefold returns the canonical form of a nickname or channel name according to the server's CaseMapping
+func (s *Server) Casefold(name string) string {
+	return s.Config.CaseMapping.Fold(name)
+}
+
 // AddClient adds a new Client
 func (s *Server) AddClient(client *Client) {
 	s.clientMutex.Lock()
@@ -74,6 +210,17 @@ func (s *Server) RemoveClient(client *Client) {
 	delete(s.clients, client.conn.RemoteAddr())
 }
 
+// getClients returns a snapshot of all connected clients
+func (s *Server) getClients() []*Client {
+	s.clientMutex.RLock()
+	defer s.clientMutex.RUnlock()
+	clients := make([]*Client, 0, len(s.clients))
+	for _, client := range s.clients {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
 // GetClient finds a client by its address and returns it
 func (s *Server) GetClient(addr net.Addr) *Client {
 	s.clientMutex.RLock()
@@ -85,87 +232,280 @@ func (s *Server) GetClient(addr net.Addr) *Client {
 func (s *Server) AddClientNick(client *Client) {
 	s.clientByNickMutex.Lock()
 	defer s.clientByNickMutex.Unlock()
-	s.clientsByNick[client.Nickname] = client
+	s.clientsByNick[s.Casefold(client.Nickname)] = client
+	s.claimNick(client, client.Nickname)
 }
 
 // RemoveClientNick removes a client based on its nickname
 func (s *Server) RemoveClientNick(client *Client) {
 	s.clientByNickMutex.Lock()
 	defer s.clientByNickMutex.Unlock()
-	delete(s.clientsByNick, client.Nickname)
+	delete(s.clientsByNick, s.Casefold(client.Nickname))
+	s.releaseNick(client.Nickname)
 }
 
 // UpdateClientNick updates the nickname of a client as it is stored by the server
 func (s *Server) UpdateClientNick(client *Client, oldNick string) {
 	s.clientByNickMutex.Lock()
 	defer s.clientByNickMutex.Unlock()
-	delete(s.clientsByNick, oldNick)
-	s.clientsByNick[client.Nickname] = client
-
+	delete(s.clientsByNick, s.Casefold(oldNick))
+	s.clientsByNick[s.Casefold(client.Nickname)] = client
+	s.claimNick(client, client.Nickname)
+	if s.Casefold(oldNick) != s.Casefold(client.Nickname) {
+		s.releaseNick(oldNick)
+	}
 }
 
-// GetClientByNick returns a client with the corresponding nickname
+// GetClientByNick returns a client with the corresponding nickname.
+// Users of other cluster nodes are returned as clients that pass messages on to their node
 func (s *Server) GetClientByNick(nick string) (*Client, bool) {
 	s.clientByNickMutex.RLock()
-	defer s.clientByNickMutex.RUnlock()
-	c, ok := s.clientsByNick[nick]
-	return c, ok
+	c, ok := s.clientsByNick[s.Casefold(nick)]
+	s.clientByNickMutex.RUnlock()
+	if ok || s.Cluster == nil {
+		return c, ok
+	}
+	return s.clusterClient(nick)
 }
 
-// Start the server listening on the configured port
-func (s *Server) Start() {
-	var listener net.Listener
+// Start the server listening on the configured Listeners, and on Addr if it is set or there are no Listeners.
+// It returns ErrServerClosed once Shutdown has been called, or the first error that stopped a listener
+func (s *Server) Start() error {
+	configs := s.Config.Listeners
+	if len(s.Config.Addr) != 0 || len(configs) == 0 {
+		configs = append([]ListenerConfig{{Addr: s.Config.Addr, TLSConfig: s.Config.TLSConfig}}, configs...)
+	}
+	listeners := []*Listener{}
+	for _, config := range configs {
+		listener, err := config.Listen()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, listener)
+	}
+
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener *Listener) {
+			errs <- s.Serve(context.Background(), listener)
+		}(listener)
+	}
 	var err error
-	if s.Config.TLSConfig != nil {
-		listener, err = tls.Listen("tcp", s.Config.Addr, s.Config.TLSConfig)
-	} else {
-		listener, err = net.Listen("tcp", s.Config.Addr)
+	for range listeners {
+		if e := <-errs; err == nil {
+			err = e
+		}
 	}
+	return err
+}
 
-	if err != nil {
-		fmt.Println("Error starting listner", err.Error())
-		return
+// Serve accepts connections on the listener and handles each of them in its own goroutine, with the class and TLS settings
+// of its ListenerConfig if listener is a *Listener. Connections are first passed to Admit if it is set.
+// The listener is closed when ctx is done or Shutdown is called, Serve then returns the error of ctx or ErrServerClosed.
+// Temporary errors accepting connections are logged to ErrorLog and retried after a delay growing up to a second, other errors are returned
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	s.lifecycleMutex.Lock()
+	if s.shuttingDown {
+		s.lifecycleMutex.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	s.listeners[listener] = nil
+	s.lifecycleMutex.Unlock()
+	defer func() {
+		s.lifecycleMutex.Lock()
+		delete(s.listeners, listener)
+		s.lifecycleMutex.Unlock()
+	}()
+
+	config := ListenerConfig{}
+	if l, ok := listener.(*Listener); ok {
+		config = l.Config
 	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			listener.Close()
+		case <-stop:
+		}
+	}()
 
+	var delay time.Duration // how long to wait after a temporary error before accepting again
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			fmt.Println("Error accepting connection", err.Error())
-			//return
-			continue
+			if s.isShuttingDown() {
+				return ErrServerClosed
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() { // like running out of file descriptors
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				s.logf("Error accepting connection: %v; retrying in %v", err, delay)
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+				}
+				continue
+			}
+			return err
+		}
+		delay = 0
+
+		go s.admit(conn, config)
+	}
+}
+
+// admit serves a connection accepted by Serve if Admit lets it in
+func (s *Server) admit(conn net.Conn, config ListenerConfig) {
+	if s.Admit == nil {
+		s.ServeConnFrom(conn, config)
+		return
+	}
+	class, release, err := s.Admit(conn, config)
+	if err != nil {
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte("ERROR :Closing link: " + err.Error() + "\r\n"))
+		conn.Close()
+		return
+	}
+	if release != nil {
+		defer release()
+	}
+	config.Class = class
+	s.ServeConnFrom(conn, config)
+}
+
+// logf reports an error through ErrorLog
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// Shutdown stops the server gracefully. Listeners stop accepting connections, links are closed once their queued messages
+// have been sent, and every client quits its channels with Config.ShutdownMessage and gets an ERROR before being disconnected.
+// Queued messages are written until the deadline of ctx, or for a few seconds if it has none. Shutdown returns once every
+// connection has been handled to its end, or with the error of ctx if it is done first. Like Do, it must not be called from a command handler
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lifecycleMutex.Lock()
+	if !s.shuttingDown {
+		s.shuttingDown = true
+		for listener := range s.listeners {
+			listener.Close()
+		}
+		if s.handlers == 0 {
+			close(s.handlersDone)
 		}
+	}
+	s.lifecycleMutex.Unlock()
 
-		ircConn := irc.NewConn(conn)
-		client := s.newClient(ircConn, conn)
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(closeTimeout)
+	}
+	var links []*Link
+	s.Do(func() {
+		links = s.getLinks()
+		for _, l := range links {
+			l.drain(s.Config.ShutdownMessage, deadline)
+		}
+		for _, client := range s.getClients() {
+			client.disconnect(s.Config.ShutdownMessage, deadline)
+		}
+	})
 
-		defer client.Close()
-		go func() {
-			fmt.Println("Incoming connection from:", conn.RemoteAddr())
-			client.handleIncoming()
-			fmt.Println("Disconnected with:", conn.RemoteAddr())
-		}()
+	select {
+	case <-s.handlersDone:
+		return nil
+	case <-ctx.Done():
+		for _, l := range links {
+			l.conn.Close()
+		}
+		return ctx.Err()
+	}
+}
 
+// isShuttingDown reports whether Shutdown has been called
+func (s *Server) isShuttingDown() bool {
+	s.lifecycleMutex.Lock()
+	defer s.lifecycleMutex.Unlock()
+	return s.shuttingDown
+}
+
+// startHandling counts a connection being handled and adds its client, it returns false once the server is shutting down
+func (s *Server) startHandling(client *Client) bool {
+	s.lifecycleMutex.Lock()
+	defer s.lifecycleMutex.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	s.handlers++
+	s.AddClient(client)
+	return true
+}
+
+// stopHandling counts a connection that has been handled to its end
+func (s *Server) stopHandling() {
+	s.lifecycleMutex.Lock()
+	defer s.lifecycleMutex.Unlock()
+	s.handlers--
+	if s.shuttingDown && s.handlers == 0 {
+		close(s.handlersDone)
 	}
 }
 
+// ServeConn handles an incoming connection from a client, or from a server that links with SERVER, until it is closed.
+// Clients connected with TLS or over a Unix socket are marked as secure
+func (s *Server) ServeConn(conn net.Conn) {
+	s.ServeConnFrom(conn, ListenerConfig{})
+}
+
+// ServeConnFrom handles a connection accepted on a listener described by listener like ServeConn, recording the class of the client
+func (s *Server) ServeConnFrom(conn net.Conn, listener ListenerConfig) {
+	client := s.newClient(irc.NewConn(conn), conn)
+	client.Class = listener.Class
+	if isSecure(conn) {
+		client.Secure = true
+		client.AddMode(UserModeSecure)
+	}
+	client.handleIncoming()
+}
+
 // AddChannel adds an active channel
 func (s *Server) AddChannel(channel *Channel) {
 	s.channelMutex.Lock()
 	defer s.channelMutex.Unlock()
-	s.channels[channel.Name] = channel
+	s.channels[s.Casefold(channel.Name)] = channel
 }
 
 // RemoveChannel removes a channel from the active listing
 func (s *Server) RemoveChannel(channel *Channel) {
 	s.channelMutex.Lock()
 	defer s.channelMutex.Unlock()
-	delete(s.channels, channel.Name)
+	delete(s.channels, s.Casefold(channel.Name))
 }
 
-// GetChannel finds and returns an active channel with a matching name if it exists
+// GetChannel finds and returns an active channel with a matching name if it exists.
+// On a cluster the channel is brought up to date with the other nodes, and created if it only exists there
 func (s *Server) GetChannel(channelName string) (*Channel, bool) {
 	s.channelMutex.RLock()
-	defer s.channelMutex.RUnlock()
-	c, ok := s.channels[channelName]
-	return c, ok
+	c, ok := s.channels[s.Casefold(channelName)]
+	s.channelMutex.RUnlock()
+	if s.Cluster == nil {
+		return c, ok
+	}
+	return s.getClusterChannel(channelName, c)
 }
@@ -0,0 +1,209 @@
+package irc
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// testTimeout is how long tests wait for a line they expect
+const testTimeout = 2 * time.Second
+
+// testClient is a client connected to a Server over a pipe
+type testClient struct {
+	t     testing.TB
+	conn  net.Conn
+	lines chan string
+}
+
+// newTestServer creates a server with the default commands registered
+func newTestServer(config ServerConfig) *Server {
+	s := NewServer(config)
+	s.CommandsMux.RegisterDefaults()
+	return s
+}
+
+// connectClient connects a client to the server, returning once it is registered with nick
+func connectClient(t testing.TB, s *Server, nick string) *testClient {
+	c := dialClient(t, s)
+	c.register(nick)
+	return c
+}
+
+// dialClient connects a client to the server without registering it
+func dialClient(t testing.TB, s *Server) *testClient {
+	conn, serverConn := net.Pipe()
+	go s.ServeConn(serverConn)
+	return newTestClient(t, conn)
+}
+
+// newTestClient starts reading the lines a server sends to a connection
+func newTestClient(t testing.TB, conn net.Conn) *testClient {
+	c := &testClient{t: t, conn: conn, lines: make(chan string, 1000)}
+	go func() {
+		defer close(c.lines)
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			c.lines <- strings.TrimRight(line, "\r\n")
+		}
+	}()
+	return c
+}
+
+// register registers the client with nick, returning once it is welcomed
+func (c *testClient) register(nick string) {
+	c.t.Helper()
+	c.send("NICK " + nick)
+	c.send("USER user 0 * :" + nick)
+	c.expectCommand(irc.RPL_ENDOFMOTD, irc.ERR_NOMOTD)
+}
+
+// send sends a line to the server
+func (c *testClient) send(line string) {
+	c.t.Helper()
+	go c.conn.Write([]byte(line + "\r\n"))
+}
+
+// expect waits for a line containing all the given strings, skipping other lines
+func (c *testClient) expect(contains ...string) string {
+	c.t.Helper()
+	return c.wait(fmt.Sprintf("%q", contains), func(line string) bool {
+		for _, s := range contains {
+			if !strings.Contains(line, s) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// expectCommand waits for a message with one of the given commands, skipping other lines
+func (c *testClient) expectCommand(commands ...string) *irc.Message {
+	c.t.Helper()
+	line := c.wait(fmt.Sprint(commands), func(line string) bool {
+		_, rest := splitTags(line)
+		m := irc.ParseMessage(rest)
+		for _, command := range commands {
+			if m != nil && m.Command == command {
+				return true
+			}
+		}
+		return false
+	})
+	_, rest := splitTags(line)
+	return irc.ParseMessage(rest)
+}
+
+// wait waits for a line accepted by match, skipping other lines
+func (c *testClient) wait(description string, match func(string) bool) string {
+	c.t.Helper()
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case line, ok := <-c.lines:
+			if !ok {
+				c.t.Fatalf("connection closed while waiting for %s", description)
+			}
+			if match(line) {
+				return line
+			}
+		case <-timeout:
+			c.t.Fatalf("timed out waiting for %s", description)
+		}
+	}
+}
+
+// expectClosed waits for the server to close the connection
+func (c *testClient) expectClosed() {
+	c.t.Helper()
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case _, ok := <-c.lines:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			c.t.Fatal("timed out waiting for the connection to be closed")
+		}
+	}
+}
+
+// close closes the connection of the client
+func (c *testClient) close() {
+	c.conn.Close()
+}
+
+// waitFor polls a condition checked on the state goroutine of the server until it is true
+func waitFor(t testing.TB, s *Server, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		var ok bool
+		s.Do(func() { ok = condition() })
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting until", description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServeAdmit(t *testing.T) {
+	s := newTestServer(ServerConfig{Name: "test.server"})
+	released := make(chan struct{})
+	var admitted int32
+	s.Admit = func(conn net.Conn, listener ListenerConfig) (string, func(), error) {
+		if atomic.AddInt32(&admitted, 1) > 1 {
+			return "", nil, errors.New("too many connections in class " + listener.Class)
+		}
+		return "small", func() { close(released) }, nil
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(context.Background(), &Listener{Listener: ln, Config: ListenerConfig{Class: "clients"}})
+	defer s.Shutdown(context.Background())
+
+	first, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(first, "NICK first\r\nUSER user 0 * :first\r\n")
+	waitFor(t, s, "first is registered", func() bool {
+		client, ok := s.GetClientByNick("first")
+		return ok && client.Class == "small"
+	})
+
+	second, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.SetReadDeadline(time.Now().Add(testTimeout))
+	line, err := bufio.NewReader(second).ReadString('\n')
+	if err != nil || line != "ERROR :Closing link: too many connections in class clients\r\n" {
+		t.Fatalf("second connection got %q, %v", line, err)
+	}
+
+	first.Close()
+	select {
+	case <-released:
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for the first connection to be released")
+	}
+}
@@ -0,0 +1,60 @@
+package irc
+
+import "sync"
+
+// The clients, channels and links of a Server are changed by a single goroutine, the state goroutine.
+// Goroutines reading connections parse the incoming messages and pass them to the state goroutine to be handled,
+// timers and cluster events are passed on the same way. Handlers never wait for connections, messages for clients
+// are written by their send queues. The mutexes of the server, channels and clients remain so snapshots can be read
+// from other goroutines, like the accessors exported for applications embedding the server.
+
+// stateLoop holds the functions waiting to be run by the state goroutine
+type stateLoop struct {
+	tasks  []func()
+	mutex  sync.Mutex
+	queued chan struct{}
+}
+
+// startStateLoop starts the state goroutine of the server
+func (s *Server) startStateLoop() {
+	s.state = &stateLoop{queued: make(chan struct{}, 1)}
+	go s.runState()
+}
+
+// runState runs the queued functions one after another, in the order they were queued
+func (s *Server) runState() {
+	for range s.state.queued {
+		s.state.mutex.Lock()
+		tasks := s.state.tasks
+		s.state.tasks = nil
+		s.state.mutex.Unlock()
+
+		for _, task := range tasks {
+			task()
+		}
+	}
+}
+
+// run queues f to be run by the state goroutine and returns without waiting for it.
+// It is used by timers, by send queues that overflowed and for cluster events, which may come from another node's state goroutine
+func (s *Server) run(f func()) {
+	s.state.mutex.Lock()
+	s.state.tasks = append(s.state.tasks, f)
+	s.state.mutex.Unlock()
+	select {
+	case s.state.queued <- struct{}{}:
+	default:
+	}
+}
+
+// Do runs f on the state goroutine and waits for it to finish, so f may change the clients and channels of the server
+// and configuration fields read by command handlers.
+// It must not be called from a command handler or from another function run by the state goroutine, which would wait forever
+func (s *Server) Do(f func()) {
+	done := make(chan struct{})
+	s.run(func() {
+		defer close(done)
+		f()
+	})
+	<-done
+}
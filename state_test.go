@@ -0,0 +1,185 @@
+package irc
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// loadCommands returns a random command changing or reading the state of the server, for the clients of the load tests
+func loadCommands(r *rand.Rand, client int, i int) string {
+	channel := "#c" + strconv.Itoa(r.Intn(4))
+	switch r.Intn(11) {
+	case 0:
+		return "JOIN " + channel
+	case 1:
+		return "PART " + channel
+	case 2:
+		return fmt.Sprintf("NICK n%d_%d", client, i)
+	case 3:
+		return "WHO *"
+	case 4:
+		return "NAMES"
+	case 5:
+		return "LIST"
+	case 6:
+		return fmt.Sprintf("MODE %s +v u%d", channel, r.Intn(40))
+	case 7:
+		return "AWAY :away"
+	case 8:
+		return "@+draft/react=1 TAGMSG " + channel
+	default:
+		return fmt.Sprintf("PRIVMSG %s :hello %d", channel, i)
+	}
+}
+
+// testLoad runs clients sending random commands to servers forming a cluster, some of the clients never read.
+// Run with -race to check that the state of the servers is only changed by their state goroutines
+func testLoad(t *testing.T, nodes int) {
+	bus := NewMemoryClusterBus()
+	servers := []*Server{}
+	addrs := []string{}
+	for n := 0; n < nodes; n++ {
+		s := newTestServer(ServerConfig{Name: fmt.Sprintf("node%d.test", n), SendQ: 1 << 14})
+		if nodes > 1 {
+			s.SetClusterBus(bus)
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.Serve(context.Background(), ln)
+		servers = append(servers, s)
+		addrs = append(addrs, ln.Addr().String())
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", addrs[i%nodes])
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if i%10 != 0 { // the other clients never read, so their send queues overflow
+				go func() {
+					reader := bufio.NewReader(conn)
+					for {
+						if _, err := reader.ReadString('\n'); err != nil {
+							return
+						}
+					}
+				}()
+			}
+			fmt.Fprintf(conn, "CAP REQ :message-tags server-time echo-message away-notify extended-join multi-prefix\r\nCAP END\r\nNICK u%d\r\nUSER u 0 * :u\r\n", i)
+			r := rand.New(rand.NewSource(int64(i)))
+			for j := 0; j < 300; j++ {
+				if _, err := fmt.Fprintf(conn, "%s\r\n", loadCommands(r, i, j)); err != nil {
+					return
+				}
+			}
+			if i%3 == 0 {
+				conn.Close()
+				return
+			}
+			fmt.Fprintf(conn, "QUIT :bye\r\n")
+		}(i)
+	}
+	wg.Wait()
+
+	for n, s := range servers {
+		client := connectClient(t, s, "late"+strconv.Itoa(n))
+		client.send("JOIN #c0")
+		client.expect("JOIN #c0")
+		client.close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, s := range servers {
+		if err := s.Shutdown(ctx); err != nil {
+			t.Error("shutting down", s.Config.Name, err)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	testLoad(t, 1)
+}
+
+func TestLoadCluster(t *testing.T) {
+	testLoad(t, 3)
+}
+
+// TestServerBeforeReading checks that a connection sending SERVER without reading what it was sent doesn't hold up the server
+func TestServerBeforeReading(t *testing.T) {
+	s := newTestServer(ServerConfig{Name: "irc.test", Links: []LinkConfig{{Name: "peer.test", Password: "secret"}}})
+	for _, handshake := range []string{"SERVER x 1 :x", "PASS secret 0210 IRC|\r\nSERVER peer.test 1 :peer"} {
+		conn, serverConn := net.Pipe()
+		defer conn.Close()
+		go s.ServeConn(serverConn)
+		go conn.Write([]byte("PING :unread\r\nUNKNOWN\r\n" + handshake + "\r\n"))
+
+		client := connectClient(t, s, "alice")
+		client.send("JOIN #responsive")
+		client.expect("JOIN #responsive")
+		client.send("QUIT")
+		client.expectClosed()
+	}
+}
+
+// blockingAccountStore is an AccountStore that waits to be released before checking a password
+type blockingAccountStore struct {
+	release chan struct{}
+}
+
+func (b blockingAccountStore) CheckPassword(account string, password string) bool {
+	<-b.release
+	return account == "alice" && password == "password"
+}
+
+func (b blockingAccountStore) SCRAMCredentials(account string) (SCRAMCredentials, bool) {
+	return SCRAMCredentials{}, false
+}
+
+func (b blockingAccountStore) CertificateAccount(fingerprint string) (string, bool) {
+	return "", false
+}
+
+// TestAuthenticateOffState checks that checking SASL credentials doesn't hold up the state goroutine
+func TestAuthenticateOffState(t *testing.T) {
+	s := newTestServer(ServerConfig{Name: "irc.test"})
+	store := blockingAccountStore{release: make(chan struct{})}
+	s.SetAccountStore(store)
+	alice := connectClient(t, s, "alice")
+	alice.send("CAP REQ :sasl")
+	alice.expect("ACK :sasl")
+	alice.send("AUTHENTICATE PLAIN")
+	alice.expect("AUTHENTICATE +")
+	alice.send("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("\x00alice\x00password")))
+
+	bob := connectClient(t, s, "bob")
+	bob.send("JOIN #responsive")
+	bob.expect("JOIN #responsive")
+	alice.send("AUTHENTICATE PLAIN") // a second exchange isn't started while the first one is verified
+	alice.expect(" 904 ")
+
+	close(store.release)
+	waitFor(t, s, "the aborted exchange was verified", func() bool {
+		client, _ := s.GetClientByNick("alice")
+		return !client.saslBusy
+	})
+	alice.send("AUTHENTICATE PLAIN")
+	alice.expect("AUTHENTICATE +")
+	alice.send("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("\x00alice\x00password")))
+	alice.expect(" 900 ", " alice ")
+	alice.expect(" 903 ")
+}
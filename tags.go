@@ -0,0 +1,364 @@
+package irc
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// IRCv3 capabilities for receiving message tags
+const (
+	CapMessageTags = "message-tags"
+	CapServerTime  = "server-time"
+	CapAccountTag  = "account-tag"
+)
+
+// serverTimeFormat is the format of the time tag - IRCv3 server-time specification
+const serverTimeFormat = "2006-01-02T15:04:05.000Z"
+
+const (
+	maxClientTagsLength = 4094 // Longest tag data a client may send, excluding the leading '@' and trailing space
+	maxTagsLength       = 8191 // Longest tag data sent to a client, including the leading '@' and trailing space
+	maxLineLength       = 512  // Longest message without tags, including the CR LF
+)
+
+var errInputTooLong = errors.New("input line was too long")
+
+// Tags contains IRCv3 message tags. Keys of client-only tags start with '+'
+type Tags map[string]string
+
+// tagCaps contains the capability a client needs to receive a server tag, all other tags require message-tags
+var tagCaps = map[string]string{
+	"time":    CapServerTime,
+	"account": CapAccountTag,
+	"batch":   CapBatch,
+	"label":   CapLabeledResponse,
+}
+
+var (
+	tagValueEscaper   = strings.NewReplacer(`\`, `\\`, ";", `\:`, " ", `\s`, "\r", `\r`, "\n", `\n`)
+	tagValueUnescapes = map[byte]byte{':': ';', 's': ' ', '\\': '\\', 'r': '\r', 'n': '\n'}
+)
+
+// ParseTags parses the tags of a message, without the leading '@'
+func ParseTags(raw string) Tags {
+	tags := Tags{}
+	for _, tag := range strings.Split(raw, ";") {
+		if len(tag) == 0 {
+			continue
+		}
+		key, value := tag, ""
+		if i := strings.IndexByte(tag, '='); i >= 0 {
+			key, value = tag[:i], unescapeTagValue(tag[i+1:])
+		}
+		if len(key) == 0 {
+			continue
+		}
+		tags[key] = value
+	}
+	return tags
+}
+
+// unescapeTagValue reverses the escaping of tag values, dropping invalid escapes
+func unescapeTagValue(value string) string {
+	if strings.IndexByte(value, '\\') < 0 {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			b.WriteByte(value[i])
+			continue
+		}
+		i++
+		if i == len(value) { // trailing backslash is dropped
+			break
+		}
+		if unescaped, ok := tagValueUnescapes[value[i]]; ok {
+			b.WriteByte(unescaped)
+		} else {
+			b.WriteByte(value[i])
+		}
+	}
+	return b.String()
+}
+
+// String formats the tags for sending, without the leading '@'
+func (t Tags) String() string {
+	keys := make([]string, 0, len(t))
+	for key := range t {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for i, key := range keys {
+		if i != 0 {
+			b.WriteByte(';')
+		}
+		b.WriteString(key)
+		if value := t[key]; len(value) != 0 {
+			b.WriteByte('=')
+			b.WriteString(tagValueEscaper.Replace(value))
+		}
+	}
+	return b.String()
+}
+
+// ClientOnly returns the client-only tags
+func (t Tags) ClientOnly() Tags {
+	tags := Tags{}
+	for key, value := range t {
+		if strings.HasPrefix(key, "+") {
+			tags[key] = value
+		}
+	}
+	return tags
+}
+
+// msgIDEncoding is used to format message IDs
+var msgIDEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewMsgID returns a new unique message ID for the msgid tag
+func NewMsgID() string {
+	id := make([]byte, 15)
+	rand.Read(id)
+	return strings.ToLower(msgIDEncoding.EncodeToString(id))
+}
+
+// stampTags returns a copy of tags with the time, msgid and account tags added for a message being relayed.
+// Tags already present are kept, so a message fanned out to several clients shares the same msgid
+func (s *Server) stampTags(m *irc.Message, tags Tags) Tags {
+	stamped := make(Tags, len(tags)+3)
+	for key, value := range tags {
+		stamped[key] = value
+	}
+	if _, ok := stamped["time"]; !ok {
+		stamped["time"] = time.Now().UTC().Format(serverTimeFormat)
+	}
+	if _, ok := stamped["msgid"]; !ok {
+		stamped["msgid"] = NewMsgID()
+	}
+	if _, ok := stamped["account"]; !ok && m.Prefix != nil {
+		sender, found := s.GetClientByNick(m.Prefix.Name)
+		if found && sender.Prefix == m.Prefix && len(sender.Account) != 0 {
+			stamped["account"] = sender.Account
+		}
+	}
+	return stamped
+}
+
+// splitTags separates the tags from the rest of a raw message line
+func splitTags(line string) (tags string, rest string) {
+	if !strings.HasPrefix(line, "@") {
+		return "", line
+	}
+	i := strings.IndexByte(line, ' ')
+	if i < 0 {
+		return line[1:], ""
+	}
+	return line[1:i], strings.TrimLeft(line[i+1:], " ")
+}
+
+// MessageTags returns the tags of the message currently being handled for this client
+func (c *Client) MessageTags() Tags {
+	if c.tags == nil {
+		return Tags{}
+	}
+	return c.tags
+}
+
+// readMessage reads and parses the next message and its tags from the client
+func (c *Client) readMessage() (*irc.Message, Tags, error) {
+	line, err := c.reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull { // line is longer than allowed, skip the rest of it
+		for err == bufio.ErrBufferFull {
+			_, err = c.reader.ReadSlice('\n')
+		}
+		if err == nil {
+			err = errInputTooLong
+		}
+		return nil, nil, err
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rawTags, rest := splitTags(string(line))
+	if len(rawTags) > maxClientTagsLength || len(rest) > maxLineLength {
+		return nil, nil, errInputTooLong
+	}
+	var tags Tags
+	if len(rawTags) != 0 {
+		tags = ParseTags(rawTags)
+	}
+	return irc.ParseMessage(rest), tags, nil
+}
+
+// canReceiveTag returns if the client has enabled the capability needed to receive a tag
+func (c *Client) canReceiveTag(key string) bool {
+	capability, ok := tagCaps[key]
+	if !ok {
+		capability = CapMessageTags
+	}
+	return c.HasCap(capability)
+}
+
+// Encode sends a message to the client as a reply to the command being handled
+func (c *Client) Encode(m *irc.Message) error {
+	return c.EncodeWithTags(m, nil)
+}
+
+// EncodeWithTags sends a message with tags to the client as a reply to the command being handled.
+// If a batch was opened with StartBatch the message becomes part of it.
+// Replies to a command with a label are held back until the command has been handled
+func (c *Client) EncodeWithTags(m *irc.Message, tags Tags) error {
+	if c.batch != nil {
+		tags = c.batch.tag(tags)
+	}
+	if c.response != nil {
+		c.response.add(m, tags)
+		return nil
+	}
+	return c.Relay(m, tags)
+}
+
+// Relay sends a message to the client together with the tags the client has enabled the capabilities for.
+// It is used for messages that are not replies to the client's own commands, like messages from other clients,
+// so they never become part of a batch the client's command handler has open.
+// Messages for clients on other servers are forwarded over the link to their server if they are addressed to the client,
+// messages for users of other cluster nodes are published to their node
+func (c *Client) Relay(m *irc.Message, tags Tags) error {
+	if c.home != nil {
+		return c.forward(m)
+	}
+	if len(c.node) != 0 {
+		return c.publishToNode(m, tags)
+	}
+	return c.enqueue(encodeLine(m, c.allowedTags(tags)))
+}
+
+// allowedTags returns the tags the client has enabled the capabilities for
+func (c *Client) allowedTags(tags Tags) Tags {
+	allowed := Tags{}
+	for key, value := range tags {
+		if c.canReceiveTag(key) {
+			allowed[key] = value
+		}
+	}
+	return allowed
+}
+
+// encodeLine serializes a message with tags into a line ending in CR LF.
+// Client-only tags are dropped first when there is too much tag data, the message is sent without tags if that isn't enough
+func encodeLine(m *irc.Message, tags Tags) []byte {
+	if len(tags) == 0 {
+		return append(m.Bytes(), '\r', '\n')
+	}
+
+	raw := tags.String()
+	if len(raw)+2 > maxTagsLength {
+		for key := range tags {
+			if strings.HasPrefix(key, "+") {
+				delete(tags, key)
+			}
+		}
+		raw = tags.String()
+		if len(raw)+2 > maxTagsLength || len(tags) == 0 {
+			return append(m.Bytes(), '\r', '\n')
+		}
+	}
+
+	return append(append([]byte("@"+raw+" "), m.Bytes()...), '\r', '\n')
+}
+
+// preparedMessage is a message serialized once for all the clients it is relayed to, so fan-out to large channels doesn't encode it per member.
+// Clients only differ in the tags they can receive, a line is kept for every set of tags that was needed.
+// A preparedMessage is used by one goroutine at a time
+type preparedMessage struct {
+	message *irc.Message
+	tags    Tags
+	keys    []string          // keys of the tags, bit i of a mask stands for keys[i]
+	lines   map[uint64][]byte // lines by the mask of the tags they include
+	fits    bool              // false for text that deliver splits up
+}
+
+// prepareMessage prepares a message with tags to be relayed to many clients
+func prepareMessage(m *irc.Message, tags Tags) *preparedMessage {
+	p := &preparedMessage{message: m, tags: tags, lines: map[uint64][]byte{}, fits: fitsLine(m)}
+	for key := range tags {
+		p.keys = append(p.keys, key)
+	}
+	return p
+}
+
+// relayPrepared sends a prepared message to the client like deliver does for relayed messages,
+// the line is shared with the other clients that can receive the same tags
+func (c *Client) relayPrepared(p *preparedMessage) error {
+	if c.home != nil || len(c.node) != 0 || !p.fits || len(p.keys) > 64 {
+		c.deliver(p.message, p.tags, false)
+		return nil
+	}
+	var mask uint64
+	for i, key := range p.keys {
+		if c.canReceiveTag(key) {
+			mask |= 1 << uint(i)
+		}
+	}
+	line, ok := p.lines[mask]
+	if !ok {
+		allowed := Tags{}
+		for i, key := range p.keys {
+			if mask&(1<<uint(i)) != 0 {
+				allowed[key] = p.tags[key]
+			}
+		}
+		line = encodeLine(p.message, allowed)
+		p.lines[mask] = line
+	}
+	return c.enqueue(line)
+}
+
+// TagMsgHandler is a CommandHandler to respond to TAGMSG commands from a client, relaying client-only tags
+// Implemented according to the IRCv3 Message Tags specification
+func TagMsgHandler(message *irc.Message, client *Client) {
+	if len(message.Params) == 0 {
+		m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_NORECIPIENT, Params: []string{client.Nickname}, Trailing: "No recipient given (TAGMSG)"}
+		client.Encode(&m)
+		return
+	}
+
+	tags := client.MessageTags().ClientOnly()
+	to := message.Params[0]
+	ch, ok := client.Server.GetChannel(to)
+	if ok { // message is to a channel
+		if !ch.CanSend(client) {
+			m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_CANNOTSENDTOCHAN, Params: []string{client.Nickname, ch.Name}, Trailing: "Cannot send to channel"}
+			client.Encode(&m)
+			return
+		}
+		ch.TagMsg(client, tags)
+		return
+	}
+	// message to a user?
+	cl, ok := client.Server.GetClientByNick(to)
+	if ok {
+		m := irc.Message{Prefix: client.Prefix, Command: TAGMSG, Params: []string{cl.Nickname}}
+		tags = client.Server.stampTags(&m, tags)
+		if cl.HasCap(CapMessageTags) {
+			cl.Relay(&m, tags)
+		}
+		if client.HasCap(CapEchoMessage) && client.HasCap(CapMessageTags) {
+			client.EncodeWithTags(&m, tags)
+		}
+		return
+	}
+
+	m := irc.Message{Prefix: client.Server.Prefix, Command: irc.ERR_NOSUCHNICK, Params: []string{client.Nickname, to}, Trailing: "No such nick/channel"}
+	client.Encode(&m)
+}
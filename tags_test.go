@@ -0,0 +1,123 @@
+package irc
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+func TestParseTags(t *testing.T) {
+	tags := ParseTags(`a=b;flag;+example.org/c=semi\:space\sback\\slash\rcr\nlf;bad=\x\;=novalue;;empty=`)
+	want := Tags{"a": "b", "flag": "", "+example.org/c": "semi;space back\\slash\rcr\nlf", "bad": "x", "empty": ""}
+	if len(tags) != len(want) {
+		t.Fatalf("ParseTags = %q, want %q", tags, want)
+	}
+	for key, value := range want {
+		if tags[key] != value {
+			t.Errorf("tag %s = %q, want %q", key, tags[key], value)
+		}
+	}
+}
+
+func TestTagsString(t *testing.T) {
+	tags := Tags{"b": "semi; space\\", "a": "", "+c": "\r\n"}
+	raw := tags.String()
+	if raw != `+c=\r\n;a;b=semi\:\sspace\\` {
+		t.Errorf("String = %q", raw)
+	}
+	parsed := ParseTags(raw)
+	for key, value := range tags {
+		if parsed[key] != value {
+			t.Errorf("tag %s = %q after a round trip, want %q", key, parsed[key], value)
+		}
+	}
+	if clientOnly := tags.ClientOnly(); len(clientOnly) != 1 || clientOnly["+c"] != "\r\n" {
+		t.Errorf("ClientOnly = %q", clientOnly)
+	}
+}
+
+func TestEncodeLineTooManyTags(t *testing.T) {
+	m := &irc.Message{Command: irc.PRIVMSG, Params: []string{"#c"}, Trailing: "hi"}
+	line := string(encodeLine(m, Tags{"msgid": "id", "+big": strings.Repeat("x", maxTagsLength)}))
+	if line != "@msgid=id PRIVMSG #c :hi\r\n" {
+		t.Errorf("client-only tags should be dropped first, got %q", line)
+	}
+	line = string(encodeLine(m, Tags{"big": strings.Repeat("x", maxTagsLength)}))
+	if line != "PRIVMSG #c :hi\r\n" {
+		t.Errorf("the message should be sent without tags, got %q", line)
+	}
+}
+
+func TestInputTooLong(t *testing.T) {
+	s := newTestServer(ServerConfig{Name: "irc.test"})
+	c := connectClient(t, s, "alice")
+	c.send("@+a=" + strings.Repeat("x", maxClientTagsLength) + " PING :tags")
+	c.expect(" 417 alice ")
+	c.send("PING :" + strings.Repeat("x", maxLineLength))
+	c.expect(" 417 alice ")
+	c.send("@+a=" + strings.Repeat("x", maxClientTagsLength-3) + " PING :" + strings.Repeat("x", maxLineLength-10))
+	c.expectCommand(irc.PONG)
+}
+
+func TestTagMsg(t *testing.T) {
+	s := newTestServer(ServerConfig{Name: "irc.test"})
+	alice := connectClient(t, s, "alice")
+	bob := connectClient(t, s, "bob")
+	bob.send("CAP REQ :message-tags")
+	bob.expect("ACK :message-tags")
+
+	alice.send("@+draft/react=x;time=2000-01-01T00:00:00.000Z TAGMSG bob")
+	m := bob.expect(":alice!", "TAGMSG bob")
+	tags, _ := splitTags(m)
+	parsed := ParseTags(tags)
+	if parsed["+draft/react"] != "x" || len(parsed["msgid"]) == 0 || len(parsed["time"]) != 0 {
+		t.Errorf("bob got tags %q", parsed)
+	}
+
+	alice.send("JOIN #c")
+	alice.expect("JOIN #c")
+	bob.send("JOIN #c")
+	bob.expect("JOIN #c")
+	alice.send("@+draft/typing=active TAGMSG #c")
+	bob.expect("+draft/typing=active", ":alice!", "TAGMSG #c")
+	alice.send("@+draft/reply=id PRIVMSG #c :tagged")
+	bob.expect("+draft/reply=id", "PRIVMSG #c :tagged")
+	alice.send("TAGMSG nobody")
+	alice.expect(" 401 alice nobody ")
+}
+
+func TestServerTags(t *testing.T) {
+	s := newTestServer(ServerConfig{Name: "irc.test"})
+	alice := connectClient(t, s, "alice")
+	s.Do(func() {
+		client, _ := s.GetClientByNick("alice")
+		client.Account = "alice-account"
+	})
+	plain := connectClient(t, s, "plain")
+	tagged := connectClient(t, s, "tagged")
+	tagged.send("CAP REQ :server-time account-tag message-tags")
+	tagged.expect("ACK :server-time account-tag message-tags")
+	for _, c := range []*testClient{alice, plain, tagged} {
+		c.send("JOIN #c")
+		c.expect("JOIN #c")
+	}
+
+	alice.send("PRIVMSG #c :stamped")
+	if line := plain.expect("PRIVMSG #c :stamped"); strings.HasPrefix(line, "@") {
+		t.Errorf("a client without capabilities got %q", line)
+	}
+	line := tagged.expect("PRIVMSG #c :stamped")
+	raw, _ := splitTags(line)
+	tags := ParseTags(raw)
+	if _, err := time.Parse(serverTimeFormat, tags["time"]); err != nil {
+		t.Errorf("time tag of %q: %v", line, err)
+	}
+	if tags["account"] != "alice-account" || len(tags["msgid"]) == 0 {
+		t.Errorf("tagged got %q", line)
+	}
+	if NewMsgID() == NewMsgID() {
+		t.Error("message IDs should be unique")
+	}
+}